@@ -1,57 +1,124 @@
 package arplib
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"math/rand/v2"
 	"net"
 	"net/netip"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
 
 	db "github.com/Nerdberg/fahrmarke/dblib"
 	"github.com/mdlayher/arp"
 )
 
-const hashIterations = 1000
-
 type scanResults struct {
 	sync.RWMutex
-	usersOnline map[int]bool
+	usersOnline   map[int]bool
+	devicesOnline map[int]bool
+	// changed is when the set of online users or devices last changed
+	changed time.Time
+	// restored is set while the sets come from before a restart and no scan
+	// has confirmed them yet, until restoredUntil
+	restored      bool
+	restoredUntil time.Time
+	// lastSeen is when each user was last part of a successful scan
+	lastSeen map[int]time.Time
 }
 
 var onlineMap scanResults = scanResults{
-	usersOnline: make(map[int]bool),
+	usersOnline:   make(map[int]bool),
+	devicesOnline: make(map[int]bool),
+	lastSeen:      make(map[int]time.Time),
 }
 
-func (s *scanResults) Add(userID int) {
-	s.Lock()
-	defer s.Unlock()
-	s.usersOnline[userID] = true
+// missedScanGrace keeps users online that were not seen in the last scans
+// but within this window, so a phone sleeping through one ARP request does
+// not flicker offline. 0 means twice the scan interval.
+var missedScanGrace time.Duration
+
+func SetMissedScanGrace(d time.Duration) {
+	missedScanGrace = d
+}
+
+// PresenceGrace is how long a user stays online after the last scan that saw
+// one of their devices.
+func PresenceGrace() time.Duration {
+	if missedScanGrace > 0 {
+		return missedScanGrace
+	}
+	return 2 * scanEvery
 }
 
-func (s *scanResults) Clear() {
+// swap replaces the online sets in one step, so readers never see a
+// half-built result. users are the users seen in the scan; online users
+// missing from it stay online within PresenceGrace. It returns the previous
+// and the new set of online users.
+func (s *scanResults) swap(users, devices map[int]bool) (previous, current map[int]bool) {
 	s.Lock()
 	defer s.Unlock()
-	s.usersOnline = make(map[int]bool)
+	now := clk.Now()
+	for id := range users {
+		s.lastSeen[id] = now
+	}
+	previous = s.usersOnline
+	grace := PresenceGrace()
+	for id := range previous {
+		if !users[id] && now.Sub(s.lastSeen[id]) <= grace {
+			users[id] = true
+		}
+	}
+	if !sameSet(previous, users) || !sameSet(s.devicesOnline, devices) {
+		s.changed = now
+	}
+	s.usersOnline = users
+	s.devicesOnline = devices
+	s.restored = false
+	return previous, users
 }
 
-func (s *scanResults) IsUserOnline(userID int) bool {
+func (s *scanResults) IsDeviceOnline(deviceID int) bool {
 	s.RLock()
 	defer s.RUnlock()
-	return s.usersOnline[userID]
+	return s.devicesOnline[deviceID]
 }
 
-func HashMAC(mac net.HardwareAddr, salt string) string {
-	hash := salt + mac.String()
-	for i := 0; i < hashIterations; i++ {
-		hasher := sha256.New()
-		hasher.Write([]byte(hash))
-		hash = hex.EncodeToString(hasher.Sum(nil))
+func (s *scanResults) snapshot() map[int]bool {
+	s.RLock()
+	defer s.RUnlock()
+	m := make(map[int]bool, len(s.usersOnline))
+	for id, online := range s.usersOnline {
+		m[id] = online
+	}
+	if awayCountsOnline {
+		now := clk.Now()
+		for id := range s.lastSeen {
+			if s.state(id, now) == StateAway {
+				m[id] = true
+			}
+		}
+	}
+	return m
+}
+
+func (s *scanResults) IsUserOnline(userID int) bool {
+	s.RLock()
+	defer s.RUnlock()
+	switch s.state(userID, clk.Now()) {
+	case StateHere:
+		return true
+	case StateAway:
+		return awayCountsOnline
 	}
-	return hash
+	return false
 }
 
 func hostsFromCIDR(cidr string) ([]netip.Addr, error) {
@@ -73,6 +140,53 @@ func hostsFromCIDR(cidr string) ([]netip.Addr, error) {
 	return ips, nil
 }
 
+// splitRanges splits the Range setting, a comma or space separated list of
+// CIDRs.
+func splitRanges(ranges string) []string {
+	return strings.FieldsFunc(ranges, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// parseRanges returns the valid CIDRs of the Range setting. Invalid ones are
+// logged and skipped.
+func parseRanges(ranges string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, cidr := range splitRanges(ranges) {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			log.Println("Skipping invalid range "+cidr+":", err)
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// hostsFromRanges returns the hosts of every valid CIDR in ranges, each
+// address once even if ranges overlap.
+func hostsFromRanges(ranges string) ([]netip.Addr, error) {
+	prefixes := parseRanges(ranges)
+	if len(prefixes) == 0 {
+		return nil, errors.New("no valid CIDR in " + strconv.Quote(ranges))
+	}
+	seen := make(map[netip.Addr]bool)
+	var ips []netip.Addr
+	for _, prefix := range prefixes {
+		hosts, err := hostsFromCIDR(prefix.String())
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range hosts {
+			if !seen[ip] {
+				seen[ip] = true
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, nil
+}
+
 func inc(ip net.IP) {
 	for j := len(ip) - 1; j >= 0; j-- {
 		ip[j]++
@@ -82,115 +196,566 @@ func inc(ip net.IP) {
 	}
 }
 
-func Scan(interfaceName string, cidr string) ([]net.HardwareAddr, error) {
-	//As ARP is not implemented on windows by mdlayher/arp, we skip scanning on windows
-	if runtime.GOOS == "windows" {
-		log.Println("Skipping ARP scan on Windows")
-		dummy := []net.HardwareAddr{}
-		dummystring := []string{"de:ad:be:ef:de:ad", "ab:cd:ef:01:23:45"}
-		for _, ds := range dummystring {
-			mac, err := net.ParseMAC(ds)
-			if err == nil {
-				dummy = append(dummy, mac)
+var (
+	scanRate    int  // ARP requests per second, 0 sends all at once
+	scanShuffle bool // randomize the order of the targets
+)
+
+// SetScanPacing configures how gently Scan probes the network.
+func SetScanPacing(rate int, shuffle bool) {
+	scanRate = rate
+	scanShuffle = shuffle
+}
+
+// scanWorkers is the number of ARP requests in flight at a time.
+var scanWorkers = 64
+
+func SetScanWorkers(n int) {
+	if n < 1 {
+		n = 1
+	}
+	scanWorkers = n
+}
+
+// ScanResult is the outcome of a scan. Targets that did not answer are normal,
+// Errors counts targets whose probe failed for other reasons (e.g. the
+// interface went down mid-scan).
+type ScanResult struct {
+	MACs []net.HardwareAddr
+	// Hosts maps the answering addresses to their MAC, only filled by
+	// sources that know the IP of a device.
+	Hosts   map[netip.Addr]net.HardwareAddr
+	Targets int
+	Errors  int
+}
+
+func (r *ScanResult) merge(other ScanResult) {
+	r.MACs = append(r.MACs, other.MACs...)
+	for ip, mac := range other.Hosts {
+		if r.Hosts == nil {
+			r.Hosts = make(map[netip.Addr]net.HardwareAddr)
+		}
+		r.Hosts[ip] = mac
+	}
+	r.Targets += other.Targets
+	r.Errors += other.Errors
+}
+
+// SuccessRatio is the share of targets that were probed without error.
+func (r ScanResult) SuccessRatio() float64 {
+	if r.Targets == 0 {
+		return 1
+	}
+	return float64(r.Targets-r.Errors) / float64(r.Targets)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout())
+}
+
+// arpConn is the part of an ARP client used for probing. Scan uses one per
+// interface: a single goroutine sends the requests and a single goroutine
+// reads the replies, which the underlying packet socket allows.
+type arpConn interface {
+	Request(ip netip.Addr) error
+	SetReadDeadline(t time.Time) error
+	// ReadReply returns the sender of the next ARP reply. Other ARP
+	// packets come back with an invalid address.
+	ReadReply() (netip.Addr, net.HardwareAddr, error)
+}
+
+// arpClient adapts *arp.Client to arpConn.
+type arpClient struct {
+	*arp.Client
+}
+
+func (c arpClient) ReadReply() (netip.Addr, net.HardwareAddr, error) {
+	p, _, err := c.Read()
+	if err != nil {
+		return netip.Addr{}, nil, err
+	}
+	if p.Operation != arp.OperationReply {
+		return netip.Addr{}, nil, nil
+	}
+	return p.SenderIP, p.SenderHardwareAddr, nil
+}
+
+// replyPoll is how long a read for replies blocks before the pending
+// requests are checked for timeouts.
+const replyPoll = 50 * time.Millisecond
+
+// probeHosts sends an ARP request to each of ips over conn, with at most
+// scanWorkers requests waiting for a reply at a time, and matches the
+// replies to their request by the sender address. A request not answered
+// within timeout is given up. Targets not sent by deadline are skipped and,
+// like hosts that did not answer, not counted as errors. A failing read
+// ends the probe, every target not answered by then counts as an error.
+func probeHosts(conn arpConn, ips []netip.Addr, timeout time.Duration, deadline time.Time, pace <-chan time.Time) ScanResult {
+	var mu sync.Mutex // guards result and pending
+	result := ScanResult{Targets: len(ips), Hosts: make(map[netip.Addr]net.HardwareAddr)}
+	// pending maps the targets waiting for a reply to when they time out
+	pending := make(map[netip.Addr]time.Time)
+	slots := make(chan struct{}, max(1, scanWorkers))
+	stop := make(chan struct{})
+	sent := make(chan struct{})
+
+	go func() {
+		defer close(sent)
+		for i, ip := range ips {
+			if pace != nil && i > 0 {
+				select {
+				case <-pace:
+				case <-stop:
+					return
+				}
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-stop:
+				return
+			}
+			if time.Now().After(deadline) {
+				return
+			}
+			mu.Lock()
+			pending[ip.Unmap()] = time.Now().Add(timeout)
+			mu.Unlock()
+			if err := conn.Request(ip); err != nil {
+				mu.Lock()
+				delete(pending, ip.Unmap())
+				result.Errors++
+				mu.Unlock()
+				<-slots
+			}
+		}
+	}()
+
+	done := false
+	for !done {
+		_ = conn.SetReadDeadline(time.Now().Add(replyPoll))
+		ip, mac, err := conn.ReadReply()
+		failed := err != nil && !isTimeout(err)
+		if failed {
+			log.Println("Failed to read ARP replies:", err)
+			close(stop)
+			<-sent
+		}
+		now := time.Now()
+		mu.Lock()
+		if _, ok := pending[ip.Unmap()]; ok && err == nil && mac != nil {
+			delete(pending, ip.Unmap())
+			result.MACs = append(result.MACs, mac)
+			result.Hosts[ip.Unmap()] = mac
+			<-slots
+		}
+		for ip, expires := range pending {
+			if failed || now.After(expires) {
+				delete(pending, ip)
+				<-slots
 			}
 		}
-		return dummy, nil
+		if failed {
+			result.Errors = result.Targets - len(result.MACs)
+		}
+		idle := len(pending) == 0
+		mu.Unlock()
+		select {
+		case <-sent:
+			done = idle
+		default:
+		}
+	}
+	return result
+}
+
+// fakeScanMACs replaces real scanning when set, for UI development only.
+var fakeScanMACs []net.HardwareAddr
+
+// SetFakeScan makes Scan report the given MACs instead of scanning. Never
+// enable this in a real deployment, it fabricates presence.
+func SetFakeScan(macs []net.HardwareAddr) {
+	fakeScanMACs = macs
+	if len(macs) > 0 {
+		log.Printf("DevFakeScan enabled, reporting %d fake MACs instead of scanning", len(macs))
+	}
+}
+
+// Scan probes every host of cidr on the interface. It may run concurrently
+// for different interfaces, as ScanInterfaces does. Each call opens one ARP
+// client, requests go out from one goroutine and replies are read by another.
+func Scan(interfaceName string, cidr string) (ScanResult, error) {
+	if len(fakeScanMACs) > 0 {
+		return ScanResult{MACs: fakeScanMACs, Targets: len(fakeScanMACs)}, nil
+	}
+	//As ARP is not implemented on windows by mdlayher/arp, we skip scanning on windows
+	if runtime.GOOS == "windows" {
+		log.Println("ARP scanning is not supported on Windows, nobody will be seen. Set DevFakeScan for UI development")
+		return ScanResult{}, nil
 	}
 
 	timeout := 500 * time.Millisecond
 
-	iface, err := net.InterfaceByName(interfaceName)
+	ips, err := hostsFromRanges(cidr)
 	if err != nil {
-		return nil, errors.New("Failed to get interface: " + err.Error())
+		return ScanResult{}, errors.New("Failed to get hosts from range: " + err.Error())
 	}
+	// until the probes ran, every target counts as failed
+	failed := ScanResult{Targets: len(ips), Errors: len(ips)}
 
-	ips, err := hostsFromCIDR(cidr)
+	iface, err := net.InterfaceByName(interfaceName)
 	if err != nil {
-		return nil, errors.New("Failed to get hosts from CIDR: " + err.Error())
+		return failed, errors.New("Failed to get interface: " + err.Error())
 	}
 
-	// open ARP client on the interface (requires elevated privileges)
+	// one ARP client for all requests (requires elevated privileges)
 	c, err := arp.Dial(iface)
 	if err != nil {
-		return nil, errors.New("Failed to open ARP client: " + err.Error())
+		if errors.Is(err, os.ErrPermission) {
+			status.setPrivileged(false)
+		}
+		return failed, errors.New("Failed to open ARP client: " + err.Error())
 	}
 	defer c.Close()
+	status.setPrivileged(true)
 
-	results := make(chan net.HardwareAddr)
+	if scanShuffle {
+		rand.Shuffle(len(ips), func(i, j int) { ips[i], ips[j] = ips[j], ips[i] })
+	}
 
-	for _, ip := range ips {
-		go func(ip netip.Addr) {
-			// set deadline per request to avoid blocking forever
-			_ = c.SetReadDeadline(time.Now().Add(timeout))
-			mac, err := c.Resolve(ip)
-			if err == nil && mac != nil {
-				results <- mac
-				return
-			}
-			// if Resolve failed, optionally try sending a request manually
-			// (c.Resolve already does ARP request + wait)
-			results <- nil
-		}(ip)
+	var pace <-chan time.Time
+	var pacing time.Duration
+	if scanRate > 0 {
+		pacing = time.Second / time.Duration(scanRate)
+		ticker := time.NewTicker(pacing)
+		defer ticker.Stop()
+		pace = ticker.C
 	}
 
-	// collect responses with a simple timeout
-	deadline := time.After(time.Duration(len(ips))*(timeout) + 2*time.Second)
-	var found []net.HardwareAddr
-expect:
-	for i := 0; i < len(ips); i++ {
-		select {
-		case r := <-results:
-			if r != nil {
-				found = append(found, r)
+	// every request slot waits at most one timeout per host, plus the pacing
+	workers := max(1, scanWorkers)
+	rounds := (len(ips) + workers - 1) / workers
+	budget := time.Duration(rounds)*timeout + time.Duration(len(ips))*pacing + 2*time.Second
+	return probeHosts(arpClient{c}, ips, timeout, time.Now().Add(budget), pace), nil
+}
+
+// scanInterface scans one interface, tests replace it to fake the network.
+var scanInterface = Scan
+
+// maxParallelScans bounds how many interfaces are scanned at the same time.
+const maxParallelScans = 4
+
+// ScanInterfaces runs Scan on every interface concurrently and merges the
+// results. A failing interface is logged and does not affect the others.
+func ScanInterfaces(interfaceNames []string, cidr string) ScanResult {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result ScanResult
+	)
+	sem := make(chan struct{}, maxParallelScans)
+	for _, name := range interfaceNames {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			r, err := scanInterface(name, cidr)
+			if err != nil {
+				log.Println("Error scanning interface "+name+":", err)
 			}
-		case <-deadline:
-			break expect
-		}
+			mu.Lock()
+			result.merge(r)
+			mu.Unlock()
+		}(name)
 	}
-	return found, nil
+	wg.Wait()
+	return result
 }
 
-func performMacScan(interfaceName string, cidr string) {
-	macs, err := Scan(interfaceName, cidr)
-	if err != nil {
-		log.Println("Error during periodic scan:", err)
+// minScanSuccessRatio is the share of targets that must have been probed
+// without error for a scan to replace the current presence set.
+var minScanSuccessRatio = 0.5
+
+func SetMinScanSuccessRatio(ratio float64) {
+	minScanSuccessRatio = ratio
+}
+
+// scanRunning keeps scans from overlapping when one takes longer than the
+// interval or the self-test runs.
+var scanRunning sync.Mutex
+
+// performMacScan runs one scan. A ctx cancelled while known devices are
+// being woken skips the scan.
+func performMacScan(ctx context.Context, interfaceNames []string, cidr string) {
+	if !scanRunning.TryLock() {
+		log.Println("Previous scan still running, skipping this one")
+		return
+	}
+	defer scanRunning.Unlock()
+	if wakeDevices && !wakeKnownDevices(ctx, cidr) {
+		return
+	}
+	// the wake-up wait is not part of the scan duration
+	start := clk.Now()
+	observations, result := gatherObservations(interfaceNames, cidr)
+	if ratio := result.SuccessRatio(); ratio < minScanSuccessRatio {
+		msg := fmt.Sprintf("%d of %d targets failed (%.0f%% ok, need %.0f%%)",
+			result.Errors, result.Targets, ratio*100, minScanSuccessRatio*100)
+		log.Println("Discarding unreliable scan: " + msg + ", keeping previous presence")
+		status.finish(false, msg)
+		logScan(start, result, len(observations), 0, msg)
+		return
 	}
 	devices, err := db.GetDevicesSparse()
 	if err != nil {
 		log.Println("Error retrieving devices from database:", err)
+		status.finish(false, err.Error())
+		logScan(start, result, len(observations), 0, err.Error())
 		return
 	}
-	var onlineUserIDs []int
+	seen, seenMACs, unknown := matchDevices(observations, devices)
+	if wakeDevices {
+		rememberWakeTargets(seenMACs, devices)
+	}
+	if trackUnknown {
+		recordUnknown(unknown)
+	}
+	rememberUnknownHosts(result.Hosts, unknown)
+	// every seen device is online, but only presence-counting devices make
+	// their owner present
+	current := make(map[int]bool)
+	onlineDevices := make(map[int]bool, len(seen))
+	var seenIDs []int
+	var counting []db.Device
+	for _, d := range seen {
+		onlineDevices[d.ID] = true
+		seenIDs = append(seenIDs, d.ID)
+		if d.CountsPresence {
+			current[d.UserID] = true
+			counting = append(counting, d)
+		}
+	}
+	previous, current := onlineMap.swap(current, onlineDevices)
+	recordTransitions(previous, current)
+	savePresenceState(counting)
+	recordOccupancy(len(current))
+	logPresence(counting, clk.Now())
+	if err := db.TouchDevices(seenIDs, clk.Now()); err != nil {
+		log.Println("Error updating device last seen:", err)
+	}
+	upgradeHashes(seen, seenMACs)
+	status.finish(true, "")
+	logScan(start, result, len(observations), len(seen), "")
+}
+
+// logScan writes a SCAN_LOG entry for the scan started at start and updates
+// the scan metrics. An empty errMsg marks the scan as successful.
+func logScan(start time.Time, result ScanResult, responses, matched int, errMsg string) {
+	now := clk.Now()
+	observeScan(now.Sub(start), matched, errMsg != "")
+	err := db.AddScanLog(db.ScanLogEntry{
+		TS:         start.Unix(),
+		DurationMS: now.Sub(start).Milliseconds(),
+		Targets:    result.Targets,
+		Responses:  responses,
+		Matched:    matched,
+		Errors:     result.Errors,
+		OK:         errMsg == "",
+		Error:      errMsg,
+	})
+	if err != nil {
+		log.Println("Error writing scan log:", err)
+	}
+	if scanLogRetention > 0 {
+		if err := db.PruneScanLog(now.Add(-scanLogRetention)); err != nil {
+			log.Println("Error pruning scan log:", err)
+		}
+	}
+}
+
+// scanLogRetention is how long SCAN_LOG entries are kept, 0 keeps them
+// forever.
+var scanLogRetention = 7 * 24 * time.Hour
+
+func SetScanLogRetention(d time.Duration) {
+	scanLogRetention = d
+}
+
+// trackUnknown enables recording of MACs that match no registered device.
+var trackUnknown bool
+
+func SetTrackUnknown(enabled bool) {
+	trackUnknown = enabled
+}
+
+func recordUnknown(macs []net.HardwareAddr) {
+	salt, err := db.UnknownDeviceSalt()
+	if err != nil {
+		log.Println("Error recording unknown devices:", err)
+		return
+	}
+	devices := make([]db.UnknownDevice, 0, len(macs))
 	for _, mac := range macs {
-		for i, device := range devices {
-			hashedMac := HashMAC(mac, device.Salt)
-			if hashedMac == device.MACAddress {
-				onlineUserIDs = append(onlineUserIDs, device.UserID)
-				// Remove matched device to speed up further lookups
-				devices = append(devices[:i], devices[i+1:]...)
-				break
-			}
+		devices = append(devices, db.UnknownDevice{
+			MACHash: HashMACScheme(mac, salt, CurrentHashScheme, DefaultHashIterations),
+			OUI:     OUI(mac),
+			Vendor:  LookupVendor(mac),
+		})
+	}
+	if err := db.RecordUnknownDevices(devices); err != nil {
+		log.Println("Error recording unknown devices:", err)
+	}
+}
+
+// eventRetention is how long presence events are kept, 0 keeps them forever.
+var eventRetention time.Duration
+
+func SetEventRetention(d time.Duration) {
+	eventRetention = d
+}
+
+// openHook is called when the space opens (first user present) or closes
+// (last user gone).
+var openHook func(open bool)
+
+func SetOpenHook(hook func(open bool)) {
+	openHook = hook
+}
+
+// recordTransitions writes a presence event for every user whose online state
+// differs between the two scans, tells the subscribers and prunes events past
+// the retention.
+func recordTransitions(previous, current map[int]bool) {
+	if open := len(current) > 0; open != (len(previous) > 0) && openHook != nil {
+		openHook(open)
+	}
+	now := clk.Now()
+	var events []db.PresenceEvent
+	var change Change
+	for uid := range current {
+		if !previous[uid] {
+			events = append(events, db.PresenceEvent{UserID: uid, Online: true, TS: now.Unix()})
+			change.Online = append(change.Online, uid)
 		}
 	}
-	onlineMap.Clear()
-	for _, uid := range onlineUserIDs {
-		onlineMap.Add(uid)
+	for uid := range previous {
+		if !current[uid] {
+			events = append(events, db.PresenceEvent{UserID: uid, Online: false, TS: now.Unix()})
+			change.Offline = append(change.Offline, uid)
+		}
+	}
+	if len(events) > 0 {
+		publish(change)
+	}
+	if err := db.AddPresenceEvents(events); err != nil {
+		log.Println("Error recording presence events:", err)
+	}
+	if eventRetention > 0 {
+		if err := db.PrunePresenceEvents(now.Add(-eventRetention)); err != nil {
+			log.Println("Error pruning presence events:", err)
+		}
 	}
 }
 
-func StartScanTicker(interfaceName string, cidr string, scanInterval time.Duration) {
-	performMacScan(interfaceName, cidr)
+// recordOccupancy stores the present count of a scan for the history API.
+func recordOccupancy(present int) {
+	now := clk.Now()
+	if err := db.AddOccupancy(now, present); err != nil {
+		log.Println("Error recording occupancy:", err)
+	}
+	if eventRetention > 0 {
+		if err := db.PruneOccupancy(now.Add(-eventRetention)); err != nil {
+			log.Println("Error pruning occupancy:", err)
+		}
+	}
+}
+
+// minScanInterval is the lower bound for the scan interval, protecting the
+// network from back-to-back scans.
+var minScanInterval = 15 * time.Second
+
+func SetMinScanInterval(d time.Duration) {
+	minScanInterval = d
+}
+
+func clampScanInterval(d time.Duration) time.Duration {
+	if d < minScanInterval {
+		log.Println("Scan interval", d, "is below the minimum of", minScanInterval, "- using the minimum")
+		return minScanInterval
+	}
+	return d
+}
+
+// StartScanTicker scans right away and then every scanInterval until ctx is
+// cancelled. The returned function waits until the scan loop has exited,
+// including a scan that was running when ctx was cancelled.
+func StartScanTicker(ctx context.Context, interfaceNames []string, cidr string, scanInterval time.Duration) (wait func()) {
+	scanInterval = clampScanInterval(scanInterval)
+	scanTargets.interfaces = interfaceNames
+	scanTargets.cidr = cidr
+	scanEvery = scanInterval
 	ticker := time.NewTicker(scanInterval)
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
+		defer ticker.Stop()
+		// the buffered presence log would be lost on shutdown
+		defer func() { flushPresenceLog(clk.Now()) }()
+		performMacScan(ctx, interfaceNames, cidr)
 		for {
 			select {
 			case <-ticker.C:
-				performMacScan(interfaceName, cidr)
+				expireRestored()
+				performMacScan(ctx, interfaceNames, cidr)
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
+	return func() { <-done }
+}
+
+func sameSet(a, b map[int]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id := range a {
+		if !b[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func CheckDeviceIsPresent(deviceID int) bool {
+	return onlineMap.IsDeviceOnline(deviceID)
+}
+
+// LastPresenceChange returns when the online set last changed.
+func LastPresenceChange() time.Time {
+	onlineMap.RLock()
+	defer onlineMap.RUnlock()
+	return onlineMap.changed
+}
+
+// OnlineSet returns a point-in-time copy of the online users, taken under a
+// single lock. Use it instead of CheckUserIsPresent when checking many users.
+func OnlineSet() map[int]bool {
+	return onlineMap.snapshot()
+}
+
+// LastSeen returns when the user was last seen by a scan. ok is false if
+// the user has not been seen since the start.
+func LastSeen(userID int) (t time.Time, ok bool) {
+	onlineMap.RLock()
+	defer onlineMap.RUnlock()
+	t, ok = onlineMap.lastSeen[userID]
+	return t, ok
 }
 
+// CheckUserIsPresent reports whether the user is online, counting the grace
+// for missed scans.
 func CheckUserIsPresent(UserID int) bool {
 	return onlineMap.IsUserOnline(UserID)
 }
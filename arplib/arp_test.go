@@ -0,0 +1,378 @@
+package arplib
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/clock"
+)
+
+// resetPresence empties the online map and puts the real clock back when
+// the test ends.
+func resetPresence(t testing.TB) {
+	reset := func() {
+		onlineMap.Lock()
+		onlineMap.usersOnline = make(map[int]bool)
+		onlineMap.devicesOnline = make(map[int]bool)
+		onlineMap.lastSeen = make(map[int]time.Time)
+		onlineMap.restored = false
+		onlineMap.Unlock()
+		SetClock(clock.Real{})
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// fakeInterfaces makes scanInterface answer with one MAC per interface
+// after delay, as if each interface had one device.
+func fakeInterfaces(t testing.TB, delay time.Duration, macs map[string]net.HardwareAddr) {
+	orig := scanInterface
+	scanInterface = func(name string, cidr string) (ScanResult, error) {
+		time.Sleep(delay)
+		mac, ok := macs[name]
+		if !ok {
+			return ScanResult{}, nil
+		}
+		return ScanResult{MACs: []net.HardwareAddr{mac}, Targets: 1}, nil
+	}
+	t.Cleanup(func() { scanInterface = orig })
+}
+
+func testMAC(last byte) net.HardwareAddr {
+	return net.HardwareAddr{0x02, 0, 0, 0, 0, last}
+}
+
+func TestScanInterfacesMerges(t *testing.T) {
+	fakeInterfaces(t, 0, map[string]net.HardwareAddr{"eth0": testMAC(1), "wlan0": testMAC(2)})
+	result := ScanInterfaces([]string{"eth0", "wlan0"}, "10.0.0.0/24")
+	if len(result.MACs) != 2 || result.Targets != 2 {
+		t.Errorf("got %d MACs of %d targets, want 2 of 2", len(result.MACs), result.Targets)
+	}
+}
+
+func BenchmarkScanInterfaces(b *testing.B) {
+	names := []string{"eth0", "eth1", "wlan0", "wlan1"}
+	fakeInterfaces(b, 10*time.Millisecond, map[string]net.HardwareAddr{})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ScanInterfaces(names, "10.0.0.0/24")
+		}
+	})
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var result ScanResult
+			for _, name := range names {
+				r, _ := scanInterface(name, "10.0.0.0/24")
+				result.merge(r)
+			}
+		}
+	})
+}
+
+func TestSwapNeverShowsEmptySnapshot(t *testing.T) {
+	resetPresence(t)
+	onlineMap.swap(map[int]bool{1: true, 2: true}, map[int]bool{10: true, 20: true})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if n := len(OnlineSet()); n != 2 {
+					t.Errorf("snapshot has %d users, want 2", n)
+					return
+				}
+				if !CheckDeviceIsPresent(10) {
+					t.Error("device went offline during an update")
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		onlineMap.swap(map[int]bool{1: true, 2: true}, map[int]bool{10: true, 20: true})
+	}
+	close(stop)
+	wg.Wait()
+}
+
+type fakeReply struct {
+	ip  netip.Addr
+	mac net.HardwareAddr
+}
+
+// fakeNetwork is an arpConn whose hosts answer after delay, the later the
+// higher their address, so replies arrive out of order. Every request is
+// also answered by a host nobody asked. It fails if replies are read by two
+// goroutines at once.
+type fakeNetwork struct {
+	hosts    map[netip.Addr]net.HardwareAddr
+	down     netip.Addr // requests to it fail
+	delay    time.Duration
+	readErr  error
+	replies  chan fakeReply
+	deadline atomic.Int64
+	reading  atomic.Bool
+	// inFlight counts answered requests whose reply was not read yet
+	inFlight, maxInFlight atomic.Int32
+}
+
+func newFakeNetwork(hosts map[netip.Addr]net.HardwareAddr, delay time.Duration) *fakeNetwork {
+	return &fakeNetwork{hosts: hosts, delay: delay, replies: make(chan fakeReply, 1024)}
+}
+
+var errConcurrentRead = errors.New("replies read concurrently")
+
+func (f *fakeNetwork) Request(ip netip.Addr) error {
+	if ip == f.down {
+		return errors.New("network is down")
+	}
+	mac, ok := f.hosts[ip]
+	if !ok {
+		return nil
+	}
+	n := f.inFlight.Add(1)
+	for m := f.maxInFlight.Load(); n > m && !f.maxInFlight.CompareAndSwap(m, n); m = f.maxInFlight.Load() {
+	}
+	delay := f.delay * time.Duration(1+ip.As4()[3]%4)
+	go func() {
+		f.replies <- fakeReply{netip.MustParseAddr("10.9.9.9"), testMAC(0xff)}
+		time.Sleep(delay)
+		f.replies <- fakeReply{ip, mac}
+	}()
+	return nil
+}
+
+func (f *fakeNetwork) SetReadDeadline(t time.Time) error {
+	f.deadline.Store(t.UnixNano())
+	return nil
+}
+
+func (f *fakeNetwork) ReadReply() (netip.Addr, net.HardwareAddr, error) {
+	if !f.reading.CompareAndSwap(false, true) {
+		return netip.Addr{}, nil, errConcurrentRead
+	}
+	defer f.reading.Store(false)
+	if f.readErr != nil {
+		return netip.Addr{}, nil, f.readErr
+	}
+	select {
+	case r := <-f.replies:
+		if _, ok := f.hosts[r.ip]; ok {
+			f.inFlight.Add(-1)
+		}
+		return r.ip, r.mac, nil
+	case <-time.After(time.Until(time.Unix(0, f.deadline.Load()))):
+		return netip.Addr{}, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// setScanWorkers changes the request limit for the test.
+func setScanWorkers(t testing.TB, n int) {
+	orig := scanWorkers
+	SetScanWorkers(n)
+	t.Cleanup(func() { scanWorkers = orig })
+}
+
+func testHosts(t testing.TB) []netip.Addr {
+	ips, err := hostsFromCIDR("10.0.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ips
+}
+
+func TestProbeHosts(t *testing.T) {
+	setScanWorkers(t, 8)
+	ips := testHosts(t)
+	hosts := map[netip.Addr]net.HardwareAddr{}
+	for i := 0; i < len(ips); i += 5 {
+		hosts[ips[i]] = testMAC(byte(i))
+	}
+	network := newFakeNetwork(hosts, time.Millisecond)
+	network.down = ips[51]
+
+	result := probeHosts(network, ips, 20*time.Millisecond, time.Now().Add(time.Minute), nil)
+	if result.Targets != len(ips) {
+		t.Errorf("got %d targets, want %d", result.Targets, len(ips))
+	}
+	// a concurrent read would end the probe and fail every target
+	if result.Errors != 1 {
+		t.Errorf("got %d errors, want 1", result.Errors)
+	}
+	if len(result.MACs) != len(hosts) || len(result.Hosts) != len(hosts) {
+		t.Errorf("got %d MACs for %d hosts, want %d", len(result.MACs), len(result.Hosts), len(hosts))
+	}
+	for ip, mac := range hosts {
+		if got := result.Hosts[ip]; got.String() != mac.String() {
+			t.Errorf("%s: got %v, want %v", ip, got, mac)
+		}
+	}
+	if m := network.maxInFlight.Load(); m > 8 {
+		t.Errorf("%d requests in flight, want at most 8", m)
+	}
+}
+
+func TestProbeHostsStopsAtDeadline(t *testing.T) {
+	ips := testHosts(t)
+	network := newFakeNetwork(map[netip.Addr]net.HardwareAddr{ips[0]: testMAC(1)}, 0)
+	result := probeHosts(network, ips, time.Second, time.Now().Add(-time.Second), nil)
+	if len(result.MACs) != 0 || result.Errors != 0 {
+		t.Errorf("probed past the deadline: %d MACs, %d errors", len(result.MACs), result.Errors)
+	}
+}
+
+func TestProbeHostsReadFailure(t *testing.T) {
+	ips := testHosts(t)
+	network := newFakeNetwork(nil, 0)
+	network.readErr = errors.New("interface went down")
+	done := make(chan ScanResult)
+	go func() { done <- probeHosts(network, ips, time.Second, time.Now().Add(time.Minute), nil) }()
+	select {
+	case result := <-done:
+		if result.Errors != len(ips) {
+			t.Errorf("got %d errors, want all %d targets", result.Errors, len(ips))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("probe kept going after the read failed")
+	}
+}
+
+func BenchmarkProbeHosts(b *testing.B) {
+	ips := testHosts(b)
+	hosts := map[netip.Addr]net.HardwareAddr{}
+	for i, ip := range ips {
+		hosts[ip] = testMAC(byte(i))
+	}
+	for _, workers := range []int{1, 8, 64} {
+		b.Run(strconv.Itoa(workers)+"workers", func(b *testing.B) {
+			setScanWorkers(b, workers)
+			network := newFakeNetwork(hosts, 100*time.Microsecond)
+			for i := 0; i < b.N; i++ {
+				probeHosts(network, ips, time.Second, time.Now().Add(time.Minute), nil)
+			}
+		})
+	}
+}
+
+func TestScanTickerStopsOnCancel(t *testing.T) {
+	resetPresence(t)
+	orig, origMin := scanInterface, minScanInterval
+	t.Cleanup(func() { scanInterface, minScanInterval = orig, origMin })
+	SetMinScanInterval(time.Millisecond)
+	var scans atomic.Int32
+	scanInterface = func(name string, cidr string) (ScanResult, error) {
+		scans.Add(1)
+		return ScanResult{Targets: 1}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wait := StartScanTicker(ctx, []string{"eth0"}, "10.0.0.0/24", 5*time.Millisecond)
+	for scans.Load() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	stopped := make(chan struct{})
+	go func() {
+		wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scan loop still running after cancel")
+	}
+	n := scans.Load()
+	time.Sleep(20 * time.Millisecond)
+	if scans.Load() != n {
+		t.Error("scans continued after the loop exited")
+	}
+}
+
+func TestScanUnionsInterfaces(t *testing.T) {
+	resetPresence(t)
+	wired := createTestUser(t, "wired")
+	wireless := createTestUser(t, "wireless")
+	addTestDevice(t, wired, testMAC(1))
+	addTestDevice(t, wireless, testMAC(2))
+	fakeInterfaces(t, 0, map[string]net.HardwareAddr{"eth0": testMAC(1), "wlan0": testMAC(2)})
+
+	performMacScan(context.Background(), []string{"eth0", "wlan0"}, "10.0.0.0/24")
+	if !CheckUserIsPresent(wired) || !CheckUserIsPresent(wireless) {
+		t.Errorf("got wired %v, wireless %v, want both present",
+			CheckUserIsPresent(wired), CheckUserIsPresent(wireless))
+	}
+}
+
+func TestHostsFromRanges(t *testing.T) {
+	for _, tc := range []struct {
+		ranges      string
+		prefixes    int
+		hosts       int
+		first, last string
+		wantErr     bool
+	}{
+		{"10.0.0.0/24", 1, 254, "10.0.0.1", "10.0.0.254", false},
+		{"10.0.0.0/30, 192.168.1.0/29", 2, 2 + 6, "10.0.0.1", "192.168.1.6", false},
+		{"10.0.0.0/30 10.0.0.0/30", 2, 2, "10.0.0.1", "10.0.0.2", false},
+		{"bogus,10.0.0.0/30 10.0.0.0/33", 1, 2, "10.0.0.1", "10.0.0.2", false},
+		{"bogus", 0, 0, "", "", true},
+	} {
+		if n := len(parseRanges(tc.ranges)); n != tc.prefixes {
+			t.Errorf("%q: got %d valid ranges, want %d", tc.ranges, n, tc.prefixes)
+		}
+		ips, err := hostsFromRanges(tc.ranges)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: got error %v", tc.ranges, err)
+			continue
+		}
+		if len(ips) != tc.hosts {
+			t.Errorf("%q: got %d hosts, want %d", tc.ranges, len(ips), tc.hosts)
+			continue
+		}
+		if tc.hosts > 0 && (ips[0].String() != tc.first || ips[len(ips)-1].String() != tc.last) {
+			t.Errorf("%q: got hosts %s to %s, want %s to %s", tc.ranges, ips[0], ips[len(ips)-1], tc.first, tc.last)
+		}
+	}
+}
+
+func TestMissedScanGrace(t *testing.T) {
+	resetPresence(t)
+	clk := clock.NewFake(time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC))
+	SetClock(clk)
+	origGrace, origEvery := missedScanGrace, scanEvery
+	t.Cleanup(func() { missedScanGrace, scanEvery = origGrace, origEvery })
+	SetMissedScanGrace(0)
+	scanEvery = time.Minute
+
+	onlineMap.swap(map[int]bool{1: true}, map[int]bool{})
+	seen := clk.Now()
+	clk.Advance(time.Minute)
+	onlineMap.swap(map[int]bool{}, map[int]bool{})
+	if !CheckUserIsPresent(1) {
+		t.Error("user went offline after missing one scan")
+	}
+	if ts, ok := LastSeen(1); !ok || !ts.Equal(seen) {
+		t.Errorf("got last seen %v, %v, want %v", ts, ok, seen)
+	}
+	clk.Advance(time.Minute + time.Second)
+	onlineMap.swap(map[int]bool{}, map[int]bool{})
+	if CheckUserIsPresent(1) {
+		t.Error("user still online past the grace")
+	}
+}
@@ -0,0 +1,55 @@
+package arplib
+
+import "time"
+
+// Presence states of a user.
+const (
+	StateHere = "here" // seen in the last scan
+	StateAway = "away" // not seen now, but within awayThreshold
+	StateGone = "gone"
+)
+
+var (
+	awayThreshold    = 30 * time.Minute
+	awayCountsOnline = false
+)
+
+// SetAwayPolicy sets how long a user stays "away" after the last sighting and
+// whether away users still count as online.
+func SetAwayPolicy(threshold time.Duration, countsOnline bool) {
+	awayThreshold = threshold
+	awayCountsOnline = countsOnline
+}
+
+// state must be called with s locked.
+func (s *scanResults) state(userID int, now time.Time) string {
+	if s.usersOnline[userID] {
+		return StateHere
+	}
+	if seen, ok := s.lastSeen[userID]; ok && now.Sub(seen) <= awayThreshold {
+		return StateAway
+	}
+	return StateGone
+}
+
+// PresenceState returns StateHere, StateAway or StateGone for the user.
+func PresenceState(userID int) string {
+	onlineMap.RLock()
+	defer onlineMap.RUnlock()
+	return onlineMap.state(userID, clk.Now())
+}
+
+// PresenceStates returns the state of every user that is not gone, taken
+// under a single lock like OnlineSet.
+func PresenceStates() map[int]string {
+	onlineMap.RLock()
+	defer onlineMap.RUnlock()
+	now := clk.Now()
+	m := make(map[int]string, len(onlineMap.lastSeen))
+	for id := range onlineMap.lastSeen {
+		if st := onlineMap.state(id, now); st != StateGone {
+			m[id] = st
+		}
+	}
+	return m
+}
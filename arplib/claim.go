@@ -0,0 +1,39 @@
+package arplib
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// unknownHosts holds the addresses of unregistered devices seen in the last
+// scan. It only lives in memory so raw MACs never hit the database.
+var unknownHosts = struct {
+	sync.RWMutex
+	byIP map[netip.Addr]net.HardwareAddr
+}{byIP: map[netip.Addr]net.HardwareAddr{}}
+
+func rememberUnknownHosts(hosts map[netip.Addr]net.HardwareAddr, unknown []net.HardwareAddr) {
+	isUnknown := make(map[string]bool, len(unknown))
+	for _, mac := range unknown {
+		isUnknown[CanonicalMAC(mac)] = true
+	}
+	byIP := make(map[netip.Addr]net.HardwareAddr)
+	for ip, mac := range hosts {
+		if isUnknown[CanonicalMAC(mac)] {
+			byIP[ip] = mac
+		}
+	}
+	unknownHosts.Lock()
+	unknownHosts.byIP = byIP
+	unknownHosts.Unlock()
+}
+
+// UnknownMACForIP returns the MAC of the unregistered device that answered
+// on ip during the last scan.
+func UnknownMACForIP(ip netip.Addr) (net.HardwareAddr, bool) {
+	unknownHosts.RLock()
+	defer unknownHosts.RUnlock()
+	mac, ok := unknownHosts.byIP[ip.Unmap()]
+	return mac, ok
+}
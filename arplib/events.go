@@ -0,0 +1,48 @@
+package arplib
+
+import "sync"
+
+// Change lists the users that came or left with one update of the online set.
+type Change struct {
+	Online  []int `json:"online"`
+	Offline []int `json:"offline"`
+}
+
+// changeBuffer is how many changes a subscriber may fall behind before it
+// misses some. Scans are minutes apart, a reader that far behind is stuck.
+const changeBuffer = 8
+
+var subscribers = struct {
+	sync.Mutex
+	chans map[chan Change]struct{}
+}{chans: make(map[chan Change]struct{})}
+
+// Subscribe returns a channel that receives every change of the online set
+// and a function to call when done listening, which closes the channel.
+func Subscribe() (<-chan Change, func()) {
+	ch := make(chan Change, changeBuffer)
+	subscribers.Lock()
+	subscribers.chans[ch] = struct{}{}
+	subscribers.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			subscribers.Lock()
+			delete(subscribers.chans, ch)
+			subscribers.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// publish hands c to all subscribers without waiting for slow ones.
+func publish(c Change) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+	for ch := range subscribers.chans {
+		select {
+		case ch <- c:
+		default:
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package arplib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// CurrentHashScheme is the MAC hash construction new and re-hashed devices
+// use. Bump it together with a new entry in hashSchemes.
+const CurrentHashScheme = 1
+
+// DefaultHashIterations is the iteration count of devices stored before the
+// count was configurable, and of the unknown device hashes, which have to
+// stay comparable across restarts.
+const DefaultHashIterations = 1000
+
+// hashIterations is used for new and re-hashed devices, from the
+// HashIterations setting. Every device stores the count it was hashed with.
+var hashIterations = DefaultHashIterations
+
+func SetHashIterations(n int) {
+	hashIterations = n
+}
+
+// HashIterations returns the iteration count HashMAC uses.
+func HashIterations() int {
+	return hashIterations
+}
+
+// hashSchemes maps a DEVICES.HASH_SCHEME version to its construction. Old
+// versions stay so their devices keep matching until they are upgraded.
+// None of them is reversible: raw MACs are never stored, so an old hash can
+// only be upgraded when its device shows up in a scan.
+var hashSchemes = map[int]func(mac net.HardwareAddr, salt string, iterations int) string{
+	1: hashMACv1,
+}
+
+// hashMACv1 is iterated SHA-256 over salt and MAC.
+func hashMACv1(mac net.HardwareAddr, salt string, iterations int) string {
+	hash := salt + CanonicalMAC(mac)
+	for i := 0; i < iterations; i++ {
+		hasher := sha256.New()
+		hasher.Write([]byte(hash))
+		hash = hex.EncodeToString(hasher.Sum(nil))
+	}
+	return hash
+}
+
+// HashMAC hashes a MAC with the current scheme and iteration count.
+func HashMAC(mac net.HardwareAddr, salt string) string {
+	return hashSchemes[CurrentHashScheme](mac, salt, hashIterations)
+}
+
+// HashMACScheme hashes a MAC with the given scheme and iteration count,
+// falling back to the current scheme for unknown versions.
+func HashMACScheme(mac net.HardwareAddr, salt string, scheme int, iterations int) string {
+	h, ok := hashSchemes[scheme]
+	if !ok {
+		h = hashSchemes[CurrentHashScheme]
+	}
+	return h(mac, salt, iterations)
+}
+
+// hashParams is everything besides the MAC a device hash depends on.
+type hashParams struct {
+	salt       string
+	scheme     int
+	iterations int
+}
+
+// hashCache remembers the hashes of one MAC computed during a scan, so the
+// MAC is hashed once per distinct salt, scheme and iteration count.
+type hashCache map[hashParams]string
+
+func (c hashCache) hash(mac net.HardwareAddr, salt string, scheme int, iterations int) string {
+	p := hashParams{salt, scheme, iterations}
+	h, ok := c[p]
+	if !ok {
+		h = HashMACScheme(mac, salt, scheme, iterations)
+		c[p] = h
+	}
+	return h
+}
+
+// upgradeHashes re-hashes seen devices that still use an old scheme or
+// another iteration count. The scan just saw their MAC, which is the only
+// time we have it.
+func upgradeHashes(seen []db.Device, macs map[int]net.HardwareAddr) {
+	var upgrades []db.DeviceHashUpgrade
+	for _, d := range seen {
+		if d.HashScheme == CurrentHashScheme && d.HashIterations == hashIterations {
+			continue
+		}
+		upgrades = append(upgrades, db.DeviceHashUpgrade{
+			ID:         d.ID,
+			MACAddress: HashMAC(macs[d.ID], d.Salt),
+			Scheme:     CurrentHashScheme,
+			Iterations: hashIterations,
+		})
+	}
+	if len(upgrades) == 0 {
+		return
+	}
+	if err := db.UpgradeDeviceHashes(upgrades); err != nil {
+		log.Println("Error upgrading device hashes:", err)
+		return
+	}
+	log.Printf("Upgraded %d device hashes to scheme %d with %d iterations", len(upgrades), CurrentHashScheme, hashIterations)
+}
@@ -0,0 +1,120 @@
+package arplib
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// setHashIterations changes the configured iteration count until the test
+// ends.
+func setHashIterations(t testing.TB, n int) {
+	orig := hashIterations
+	SetHashIterations(n)
+	t.Cleanup(func() { SetHashIterations(orig) })
+}
+
+func TestMixedHashIterations(t *testing.T) {
+	resetPresence(t)
+	setHashIterations(t, 20)
+	old := createTestUser(t, "olditerations")
+	cheap := createTestUser(t, "cheapiterations")
+	current := createTestUser(t, "curiterations")
+	macs := map[int]net.HardwareAddr{old: testMAC(1), cheap: testMAC(2), current: testMAC(3)}
+	for userID, iterations := range map[int]int{old: DefaultHashIterations, cheap: 10, current: 20} {
+		salt := "salt" + strconv.Itoa(userID)
+		hash := HashMACScheme(macs[userID], salt, CurrentHashScheme, iterations)
+		if _, err := db.AddOrUpdateDevice(userID, hash, "test device", salt, CurrentHashScheme, iterations); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fakeInterfaces(t, 0, map[string]net.HardwareAddr{"eth0": testMAC(1), "eth1": testMAC(2), "eth2": testMAC(3)})
+
+	performMacScan(context.Background(), []string{"eth0", "eth1", "eth2"}, "10.0.0.0/24")
+	for userID := range macs {
+		if !CheckUserIsPresent(userID) {
+			t.Errorf("user %d not present", userID)
+		}
+	}
+	devices, err := db.GetDevicesSparse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range devices {
+		mac, ok := macs[d.UserID]
+		if !ok {
+			continue
+		}
+		if d.HashIterations != 20 || d.MACAddress != HashMACScheme(mac, d.Salt, CurrentHashScheme, 20) {
+			t.Errorf("device of user %d not rehashed to 20 iterations, has %d", d.UserID, d.HashIterations)
+		}
+	}
+
+	// the rehashed devices still match
+	resetPresence(t)
+	performMacScan(context.Background(), []string{"eth0", "eth1", "eth2"}, "10.0.0.0/24")
+	for userID := range macs {
+		if !CheckUserIsPresent(userID) {
+			t.Errorf("user %d not present after the rehash", userID)
+		}
+	}
+}
+
+// BenchmarkHashIterations matches 20 hosts against 20 devices hashed with
+// the given iteration count, the cost a scan pays per device and host.
+func BenchmarkHashIterations(b *testing.B) {
+	for _, iterations := range []int{100, DefaultHashIterations} {
+		b.Run(strconv.Itoa(iterations), func(b *testing.B) {
+			observations, devices := benchmarkDevices(20, 20, 20, iterations)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				matchDevices(observations, devices)
+			}
+		})
+	}
+}
+
+// benchmarkDevices returns hosts observations, every second one of a
+// registered device, and n devices spread over the given number of salts.
+func benchmarkDevices(hosts, n, salts, iterations int) ([]Observation, []db.Device) {
+	var observations []Observation
+	var devices []db.Device
+	for i := 0; i < hosts; i++ {
+		observations = append(observations, Observation{MAC: net.HardwareAddr{0x02, 0, 0, 0, byte(i >> 8), byte(i)}})
+	}
+	for i := 0; i < n; i++ {
+		mac := net.HardwareAddr{0x02, 0, 0, 1, byte(i >> 8), byte(i)}
+		if i < hosts && i%2 == 0 {
+			mac = observations[i].MAC
+		}
+		salt := "salt" + strconv.Itoa(i%salts)
+		devices = append(devices, db.Device{
+			ID:             i + 1,
+			UserID:         i + 1,
+			MACAddress:     HashMACScheme(mac, salt, CurrentHashScheme, iterations),
+			Salt:           salt,
+			HashScheme:     CurrentHashScheme,
+			HashIterations: iterations,
+		})
+	}
+	return observations, devices
+}
+
+// BenchmarkHashCache matches 50 hosts against 200 devices that share 10
+// salts, once hashing per device and once through the per-scan cache.
+func BenchmarkHashCache(b *testing.B) {
+	observations, devices := benchmarkDevices(50, 200, 10, 100)
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			loopMatchDevices(observations, devices)
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			matchDevices(observations, devices)
+		}
+	})
+}
@@ -0,0 +1,25 @@
+package arplib
+
+import (
+	"net"
+	"strings"
+)
+
+// CanonicalMAC formats a MAC the one way it is hashed, compared and shown:
+// lowercase hex octets separated by colons. net.ParseMAC accepts dashes,
+// dots and upper case as well, so anything parsed from user input has to go
+// through here before it is used as a key. The format equals what
+// net.HardwareAddr.String has always returned, so stored hashes stay valid.
+func CanonicalMAC(mac net.HardwareAddr) string {
+	const hexDigits = "0123456789abcdef"
+	var b strings.Builder
+	b.Grow(len(mac) * 3)
+	for i, octet := range mac {
+		if i > 0 {
+			b.WriteByte(':')
+		}
+		b.WriteByte(hexDigits[octet>>4])
+		b.WriteByte(hexDigits[octet&0x0f])
+	}
+	return b.String()
+}
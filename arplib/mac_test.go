@@ -0,0 +1,18 @@
+package arplib
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCanonicalMAC(t *testing.T) {
+	for _, s := range []string{"02:00:00:00:12:8a", "02-00-00-00-12-8A", "0200.0000.128a", "02:00:00:00:12:8A"} {
+		mac, err := net.ParseMAC(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := CanonicalMAC(mac); got != "02:00:00:00:12:8a" {
+			t.Errorf("%s: got %s", s, got)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package arplib
+
+import (
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// testDBPath is the database the tests run against.
+var testDBPath string
+
+// TestMain runs the tests against a fresh database, scans write their
+// results to it.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "fahrmarke-arplib")
+	if err != nil {
+		log.Fatal(err)
+	}
+	testDBPath = filepath.Join(dir, "test.db")
+	if err := db.InitDB(testDBPath); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	db.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// createTestUser creates a user and deletes it when the test ends.
+func createTestUser(t *testing.T, username string) int {
+	t.Helper()
+	id, err := db.CreateUser(username, "hash", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DeleteUser(id) })
+	return id
+}
+
+// addTestDevice registers the MAC for the user with the current hash.
+func addTestDevice(t *testing.T, userID int, mac net.HardwareAddr) {
+	t.Helper()
+	salt := "salt" + strconv.Itoa(userID)
+	_, err := db.AddOrUpdateDevice(userID, HashMAC(mac, salt), "test device", salt, CurrentHashScheme, hashIterations)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
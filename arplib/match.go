@@ -0,0 +1,35 @@
+package arplib
+
+import (
+	"net"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// matchDevices finds the registered devices among the observed MACs. Every
+// device has its own salt, so each MAC is hashed against the devices that
+// have not matched yet until one of them matches, hashes memoizes it for
+// devices that share a salt and iteration count.
+func matchDevices(observations []Observation, devices []db.Device) (seen []db.Device, seenMACs map[int]net.HardwareAddr, unknown []net.HardwareAddr) {
+	matched := make([]bool, len(devices))
+	seenMACs = make(map[int]net.HardwareAddr)
+	hashes := make(hashCache)
+	for _, obs := range observations {
+		clear(hashes)
+		found := false
+		for i, d := range devices {
+			if matched[i] || hashes.hash(obs.MAC, d.Salt, d.HashScheme, d.HashIterations) != d.MACAddress {
+				continue
+			}
+			matched[i] = true
+			found = true
+			seen = append(seen, d)
+			seenMACs[d.ID] = obs.MAC
+			break
+		}
+		if !found {
+			unknown = append(unknown, obs.MAC)
+		}
+	}
+	return seen, seenMACs, unknown
+}
@@ -0,0 +1,97 @@
+package arplib
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// loopMatchDevices is the matching performMacScan did before matchDevices:
+// every MAC hashed against every remaining device in turn.
+func loopMatchDevices(observations []Observation, devices []db.Device) (seen []db.Device, seenMACs map[int]net.HardwareAddr, unknown []net.HardwareAddr) {
+	devices = append([]db.Device(nil), devices...)
+	seenMACs = make(map[int]net.HardwareAddr)
+	for _, obs := range observations {
+		matched := false
+		for i, device := range devices {
+			if HashMACScheme(obs.MAC, device.Salt, device.HashScheme, device.HashIterations) == device.MACAddress {
+				seen = append(seen, device)
+				seenMACs[device.ID] = obs.MAC
+				devices = append(devices[:i], devices[i+1:]...)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			unknown = append(unknown, obs.MAC)
+		}
+	}
+	return seen, seenMACs, unknown
+}
+
+func TestMatchDevicesLikeLoop(t *testing.T) {
+	var observations []Observation
+	var devices []db.Device
+	for i := 0; i < 30; i++ {
+		mac := testMAC(byte(i))
+		if i%3 != 0 {
+			observations = append(observations, Observation{MAC: mac})
+		}
+		if i%2 != 0 {
+			continue
+		}
+		salt := "salt" + strconv.Itoa(i)
+		iterations := 3 + i%4
+		devices = append(devices, db.Device{
+			ID:             i + 1,
+			MACAddress:     HashMACScheme(mac, salt, CurrentHashScheme, iterations),
+			Salt:           salt,
+			HashScheme:     CurrentHashScheme,
+			HashIterations: iterations,
+		})
+	}
+
+	// a MAC registered twice matches the first device only, like before
+	shared := testMAC(2)
+	devices = append(devices, db.Device{
+		ID:             100,
+		MACAddress:     HashMACScheme(shared, "other salt", CurrentHashScheme, 3),
+		Salt:           "other salt",
+		HashScheme:     CurrentHashScheme,
+		HashIterations: 3,
+	})
+
+	seen, seenMACs, unknown := matchDevices(observations, devices)
+	wantSeen, wantMACs, wantUnknown := loopMatchDevices(observations, devices)
+	if len(seen) == 0 || len(unknown) == 0 {
+		t.Fatalf("got %d seen and %d unknown, want some of both", len(seen), len(unknown))
+	}
+	if !reflect.DeepEqual(seen, wantSeen) {
+		t.Errorf("got seen %v, want %v", seen, wantSeen)
+	}
+	if !reflect.DeepEqual(seenMACs, wantMACs) {
+		t.Errorf("got MACs %v, want %v", seenMACs, wantMACs)
+	}
+	if !reflect.DeepEqual(unknown, wantUnknown) {
+		t.Errorf("got unknown %v, want %v", unknown, wantUnknown)
+	}
+}
+
+// BenchmarkMatchDevices matches 200 hosts against 500 devices, each with its
+// own salt like registration gives them.
+func BenchmarkMatchDevices(b *testing.B) {
+	observations, devices := benchmarkDevices(200, 500, 500, 10)
+	b.Run("loop", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			loopMatchDevices(observations, devices)
+		}
+	})
+	b.Run("match", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			matchDevices(observations, devices)
+		}
+	})
+}
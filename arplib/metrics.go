@@ -0,0 +1,43 @@
+package arplib
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scanDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fahrmarke_scan_duration_seconds",
+		Help:    "Duration of presence scans.",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60, 120},
+	})
+	scansFailed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fahrmarke_scans_failed_total",
+		Help: "Scans that failed and left the presence data unchanged.",
+	})
+	devicesMatched = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "fahrmarke_scan_devices_matched",
+		Help: "Registered devices seen by the last successful scan.",
+	})
+	usersOnline = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "fahrmarke_users_online",
+		Help: "Users currently considered present.",
+	}, func() float64 {
+		return float64(len(OnlineSet()))
+	})
+)
+
+// Collectors returns the scanner metrics for registration with Prometheus.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{scanDuration, scansFailed, devicesMatched, usersOnline}
+}
+
+func observeScan(took time.Duration, matched int, failed bool) {
+	scanDuration.Observe(took.Seconds())
+	if failed {
+		scansFailed.Inc()
+		return
+	}
+	devicesMatched.Set(float64(matched))
+}
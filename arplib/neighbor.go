@@ -0,0 +1,94 @@
+package arplib
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// neighborTable is the kernel's IPv4 neighbor table. Reading it needs no
+// privileges, the kernel keeps it filled from the traffic it sees anyway.
+var neighborTable = "/proc/net/arp"
+
+// atfCom is the ATF_COM flag of a resolved entry, entries without it are
+// still waiting for a reply.
+const atfCom = 0x2
+
+// ScanNeighbors reports the hosts of cidr that the kernel has a resolved
+// neighbor entry for on one of the interfaces. It sends nothing, so a device
+// only shows up after it talked to this host or the kernel resolved it for
+// someone else, and it stays until the kernel drops the stale entry.
+func ScanNeighbors(interfaceNames []string, cidr string) (ScanResult, error) {
+	if len(fakeScanMACs) > 0 {
+		return ScanResult{MACs: fakeScanMACs, Targets: len(fakeScanMACs)}, nil
+	}
+	prefixes := parseRanges(cidr)
+	if len(prefixes) == 0 {
+		return ScanResult{}, errors.New("Failed to get hosts from range: no valid CIDR in " + strconv.Quote(cidr))
+	}
+	f, err := os.Open(neighborTable)
+	if err != nil {
+		return ScanResult{}, errors.New("Failed to read neighbor table: " + err.Error())
+	}
+	defer f.Close()
+	return parseNeighborTable(f, interfaceNames, prefixes)
+}
+
+// parseNeighborTable reads the /proc/net/arp format:
+//
+//	IP address       HW type     Flags       HW address            Mask     Device
+//	192.168.1.10     0x1         0x2         aa:bb:cc:dd:ee:ff     *        eth0
+//
+// Entries that are incomplete, on other interfaces or outside the ranges are
+// skipped.
+func parseNeighborTable(r io.Reader, interfaceNames []string, prefixes []netip.Prefix) (ScanResult, error) {
+	result := ScanResult{Hosts: make(map[netip.Addr]net.HardwareAddr)}
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		if !slices.Contains(interfaceNames, fields[5]) {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[2], 0, 32)
+		if err != nil || flags&atfCom == 0 {
+			continue
+		}
+		ip, err := netip.ParseAddr(fields[0])
+		if err != nil || !slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(ip) }) {
+			continue
+		}
+		mac, err := net.ParseMAC(fields[3])
+		if err != nil || isZeroMAC(mac) {
+			continue
+		}
+		if _, dup := result.Hosts[ip]; dup {
+			continue
+		}
+		result.Targets++
+		result.Hosts[ip] = mac
+		result.MACs = append(result.MACs, mac)
+	}
+	if err := scanner.Err(); err != nil {
+		return ScanResult{}, errors.New("Failed to read neighbor table: " + err.Error())
+	}
+	return result, nil
+}
+
+func isZeroMAC(mac net.HardwareAddr) bool {
+	for _, b := range mac {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package arplib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const sampleNeighborTable = `IP address       HW type     Flags       HW address            Mask     Device
+192.168.1.10     0x1         0x2         aa:bb:cc:dd:ee:01     *        eth0
+192.168.1.11     0x1         0x0         00:00:00:00:00:00     *        eth0
+192.168.1.12     0x1         0x2         aa:bb:cc:dd:ee:02     *        wlan0
+192.168.1.13     0x1         0x2         aa:bb:cc:dd:ee:03     *        docker0
+10.0.0.5         0x1         0x2         aa:bb:cc:dd:ee:04     *        eth0
+192.168.1.14     0x1         0x2         00:00:00:00:00:00     *        eth0
+192.168.1.15     0x1         0x6         AA:BB:CC:DD:EE:05     *        eth0
+garbage
+`
+
+func TestScanNeighbors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "arp")
+	if err := os.WriteFile(path, []byte(sampleNeighborTable), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	orig := neighborTable
+	neighborTable = path
+	t.Cleanup(func() { neighborTable = orig })
+
+	result, err := ScanNeighbors([]string{"eth0", "wlan0"}, "192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:05"}
+	if len(result.MACs) != len(want) || result.Targets != len(want) || len(result.Hosts) != len(want) {
+		t.Fatalf("got MACs %v, %d targets, %d hosts, want %v", result.MACs, result.Targets, len(result.Hosts), want)
+	}
+	for i, mac := range result.MACs {
+		if mac.String() != want[i] {
+			t.Errorf("MAC %d: got %s, want %s", i, mac, want[i])
+		}
+	}
+
+	if _, err := ScanNeighbors([]string{"eth0"}, "bogus"); err == nil {
+		t.Error("invalid range accepted")
+	}
+	neighborTable = filepath.Join(t.TempDir(), "missing")
+	if _, err := ScanNeighbors([]string{"eth0"}, "192.168.1.0/24"); err == nil {
+		t.Error("missing table gave no error")
+	}
+}
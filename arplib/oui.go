@@ -0,0 +1,118 @@
+package arplib
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ouiTable holds the current map[string]string of OUI to vendor. Lookups
+// never lock, a reload swaps in a complete new map.
+var ouiTable atomic.Value
+
+// ouiPath is the file LoadOUI read, used again by ReloadOUI.
+var ouiPath string
+
+// ouiReload serializes reloads so two admins can't interleave them.
+var ouiReload sync.Mutex
+
+// defaultOUI is the built-in list used while no oui.txt is on disk. It only
+// covers vendors common on our network.
+//
+//go:embed oui_default.txt
+var defaultOUI []byte
+
+// defaultVendors is defaultOUI parsed once at startup.
+var defaultVendors map[string]string
+
+func init() {
+	vendors, err := parseOUI(bytes.NewReader(defaultOUI))
+	if err != nil {
+		panic("arplib: broken built-in OUI list: " + err.Error())
+	}
+	defaultVendors = vendors
+	ouiTable.Store(defaultVendors)
+}
+
+// parseOUI reads the IEEE OUI list (oui.txt). Only the
+// "XX-XX-XX   (hex)   Vendor" lines are used, everything else is skipped.
+// A list without any such line is rejected.
+func parseOUI(r io.Reader) (map[string]string, error) {
+	vendors := make(map[string]string)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		prefix, vendor, ok := strings.Cut(sc.Text(), "(hex)")
+		if !ok {
+			continue
+		}
+		prefix = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(prefix), "-", ":"))
+		if len(prefix) != 8 {
+			continue
+		}
+		vendors[prefix] = strings.TrimSpace(vendor)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, errors.New("Failed to read OUI file: " + err.Error())
+	}
+	if len(vendors) == 0 {
+		return nil, errors.New("No OUI entries found, is this an IEEE oui.txt?")
+	}
+	return vendors, nil
+}
+
+// LoadOUI reads the OUI list used for vendor lookups and remembers the path
+// for ReloadOUI. The current table is only replaced by a valid list.
+func LoadOUI(path string) error {
+	ouiReload.Lock()
+	ouiPath = path
+	ouiReload.Unlock()
+	_, err := ReloadOUI()
+	return err
+}
+
+// ReloadOUI re-reads the OUI file and returns the number of entries. Without
+// the file the built-in list is used. On any other error the table in use
+// stays as it is.
+func ReloadOUI() (int, error) {
+	ouiReload.Lock()
+	defer ouiReload.Unlock()
+	f, err := os.Open(ouiPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Println("No OUI file at " + ouiPath + ", using the built-in vendor list")
+		ouiTable.Store(defaultVendors)
+		return len(defaultVendors), nil
+	}
+	if err != nil {
+		return 0, errors.New("Failed to open OUI file: " + err.Error())
+	}
+	defer f.Close()
+	vendors, err := parseOUI(f)
+	if err != nil {
+		return 0, err
+	}
+	ouiTable.Store(vendors)
+	return len(vendors), nil
+}
+
+// OUI returns the vendor prefix of a MAC in the form "aa:bb:cc".
+func OUI(mac net.HardwareAddr) string {
+	s := CanonicalMAC(mac)
+	if len(s) < 8 {
+		return s
+	}
+	return s[:8]
+}
+
+// LookupVendor returns the vendor registered for the MAC's OUI, or "".
+func LookupVendor(mac net.HardwareAddr) string {
+	return ouiTable.Load().(map[string]string)[OUI(mac)]
+}
@@ -0,0 +1,54 @@
+package arplib
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOUIFallsBackToBuiltin(t *testing.T) {
+	t.Cleanup(func() { ouiTable.Store(defaultVendors) })
+	pi, _ := net.ParseMAC("b8:27:eb:12:34:56")
+	own, _ := net.ParseMAC("fc:ec:da:12:34:56")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "oui.txt")
+	if err := os.WriteFile(path, []byte("FC-EC-DA   (hex)\t\tTest Vendor\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadOUI(path); err != nil {
+		t.Fatal(err)
+	}
+	if v := LookupVendor(own); v != "Test Vendor" {
+		t.Errorf("got vendor %q from the file", v)
+	}
+	if v := LookupVendor(pi); v != "" {
+		t.Errorf("file without the prefix still gave %q", v)
+	}
+
+	// a broken file keeps the table in use
+	if err := os.WriteFile(path, []byte("not an oui list\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReloadOUI(); err == nil {
+		t.Error("broken file accepted")
+	}
+	if v := LookupVendor(own); v != "Test Vendor" {
+		t.Errorf("broken file replaced the table, got %q", v)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	n, err := ReloadOUI()
+	if err != nil {
+		t.Fatal("missing file:", err)
+	}
+	if n != len(defaultVendors) {
+		t.Errorf("got %d entries, want the %d built-in ones", n, len(defaultVendors))
+	}
+	if v := LookupVendor(pi); v != "Raspberry Pi Foundation" {
+		t.Errorf("got built-in vendor %q", v)
+	}
+}
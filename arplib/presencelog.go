@@ -0,0 +1,67 @@
+package arplib
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// presenceLogFlush is how long samples are buffered before they are written
+// to PRESENCE_LOG in one transaction, instead of once per scan.
+const presenceLogFlush = 5 * time.Minute
+
+// presenceLogRetention is how long PRESENCE_LOG samples are kept, 0 keeps
+// them forever.
+var presenceLogRetention = 30 * 24 * time.Hour
+
+func SetPresenceLogRetention(d time.Duration) {
+	presenceLogRetention = d
+}
+
+var presenceLog = struct {
+	sync.Mutex
+	pending []db.PresenceSample
+	since   time.Time // when the oldest pending sample was buffered
+}{}
+
+// logPresence buffers a sample for every device that made its owner present
+// and writes the buffer once it is older than presenceLogFlush.
+func logPresence(counting []db.Device, now time.Time) {
+	presenceLog.Lock()
+	if len(presenceLog.pending) == 0 {
+		presenceLog.since = now
+	}
+	for _, d := range counting {
+		presenceLog.pending = append(presenceLog.pending, db.PresenceSample{
+			UserID:     d.UserID,
+			DeviceHash: d.MACAddress,
+			SeenAt:     now.Unix(),
+		})
+	}
+	due := now.Sub(presenceLog.since) >= presenceLogFlush
+	presenceLog.Unlock()
+	if due {
+		flushPresenceLog(now)
+	}
+}
+
+// flushPresenceLog writes the buffered samples and prunes the expired ones.
+// Samples that fail to write stay buffered for the next flush.
+func flushPresenceLog(now time.Time) {
+	presenceLog.Lock()
+	err := db.AddPresenceSamples(presenceLog.pending)
+	if err == nil {
+		presenceLog.pending = nil
+	}
+	presenceLog.Unlock()
+	if err != nil {
+		log.Println("Error writing presence log:", err)
+	}
+	if presenceLogRetention > 0 {
+		if err := db.PrunePresenceLog(now.Add(-presenceLogRetention)); err != nil {
+			log.Println("Error pruning presence log:", err)
+		}
+	}
+}
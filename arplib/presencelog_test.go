@@ -0,0 +1,79 @@
+package arplib
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/clock"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+func TestPresenceLogBatchesSamples(t *testing.T) {
+	resetPresence(t)
+	// write what other tests' scans left in the buffer
+	flushPresenceLog(time.Now())
+	userID := createTestUser(t, "logged")
+	addTestDevice(t, userID, testMAC(1))
+	fakeInterfaces(t, 0, map[string]net.HardwareAddr{"eth0": testMAC(1)})
+	clk := clock.NewFake(time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC))
+	SetClock(clk)
+	first := clk.Now()
+	logged := func() []int64 {
+		t.Helper()
+		times, err := db.GetUserPresenceTimes(userID, first.Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return times
+	}
+
+	performMacScan(context.Background(), []string{"eth0"}, "10.0.0.0/24")
+	if times := logged(); len(times) != 0 {
+		t.Fatalf("sample written before the flush interval: %v", times)
+	}
+	clk.Advance(presenceLogFlush)
+	performMacScan(context.Background(), []string{"eth0"}, "10.0.0.0/24")
+	times := logged()
+	if len(times) != 2 || times[0] != first.Unix() || times[1] != clk.Now().Unix() {
+		t.Errorf("got samples %v, want %d and %d", times, first.Unix(), clk.Now().Unix())
+	}
+}
+
+func TestPresenceLogKeptOnFailedFlush(t *testing.T) {
+	userID := createTestUser(t, "presencelog")
+	now := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	// write what earlier scans left in the buffer
+	flushPresenceLog(now)
+	logPresence([]db.Device{{UserID: userID, MACAddress: "hash"}}, now)
+
+	if err := db.CloseDB(); err != nil {
+		t.Fatal(err)
+	}
+	flushPresenceLog(now)
+	if err := db.InitDB(testDBPath); err != nil {
+		t.Fatal(err)
+	}
+	presenceLog.Lock()
+	pending := len(presenceLog.pending)
+	presenceLog.Unlock()
+	if pending != 1 {
+		t.Fatalf("got %d pending samples after the failed flush, want 1", pending)
+	}
+
+	flushPresenceLog(now)
+	times, err := db.GetUserPresenceTimes(userID, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 1 || times[0] != now.Unix() {
+		t.Errorf("got times %v, want %d", times, now.Unix())
+	}
+	presenceLog.Lock()
+	pending = len(presenceLog.pending)
+	presenceLog.Unlock()
+	if pending != 0 {
+		t.Errorf("got %d pending samples after the flush", pending)
+	}
+}
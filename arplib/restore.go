@@ -0,0 +1,82 @@
+package arplib
+
+import (
+	"log"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// savePresenceState persists the presence-counting devices that are online
+// so the state survives a restart.
+func savePresenceState(devices []db.Device) {
+	now := clk.Now().Unix()
+	states := make([]db.PresenceState, 0, len(devices))
+	for _, d := range devices {
+		states = append(states, db.PresenceState{DeviceID: d.ID, UserID: d.UserID, LastSeen: now})
+	}
+	if err := db.SavePresenceState(states); err != nil {
+		log.Println("Error saving presence state:", err)
+	}
+}
+
+// RestorePresence loads the online set persisted before the last shutdown,
+// so the board does not show everyone offline until the first scan is done.
+// Entries older than grace are ignored. The restored set is marked as such
+// and the scan ticker drops it once grace has passed without a scan
+// replacing it.
+func RestorePresence(grace time.Duration) {
+	states, err := db.GetPresenceState(clk.Now().Add(-grace))
+	if err != nil {
+		log.Println("Error restoring presence state:", err)
+		return
+	}
+	if len(states) == 0 {
+		return
+	}
+	users := make(map[int]bool)
+	devices := make(map[int]bool)
+	onlineMap.Lock()
+	for _, s := range states {
+		users[s.UserID] = true
+		devices[s.DeviceID] = true
+		seen := time.Unix(s.LastSeen, 0)
+		if seen.After(onlineMap.lastSeen[s.UserID]) {
+			onlineMap.lastSeen[s.UserID] = seen
+		}
+	}
+	onlineMap.usersOnline = users
+	onlineMap.devicesOnline = devices
+	onlineMap.changed = clk.Now()
+	onlineMap.restored = true
+	onlineMap.restoredUntil = clk.Now().Add(grace)
+	onlineMap.Unlock()
+	log.Printf("Restored presence of %d users, pending first scan", len(users))
+}
+
+// expireRestored drops the restored online set once its grace has passed,
+// in case no scan succeeded since the restart.
+func expireRestored() {
+	onlineMap.Lock()
+	now := clk.Now()
+	if !onlineMap.restored || now.Before(onlineMap.restoredUntil) {
+		onlineMap.Unlock()
+		return
+	}
+	previous := onlineMap.usersOnline
+	onlineMap.usersOnline = make(map[int]bool)
+	onlineMap.devicesOnline = make(map[int]bool)
+	onlineMap.changed = now
+	onlineMap.restored = false
+	onlineMap.Unlock()
+	log.Println("No scan confirmed the restored presence, dropping it")
+	recordTransitions(previous, map[int]bool{})
+}
+
+// PresenceRestored reports whether the online set still comes from before
+// the last restart.
+func PresenceRestored() bool {
+	onlineMap.RLock()
+	defer onlineMap.RUnlock()
+	return onlineMap.restored
+}
@@ -0,0 +1,36 @@
+package arplib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/clock"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+func TestRestoredPresenceDecays(t *testing.T) {
+	resetPresence(t)
+	clk := clock.NewFake(time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC))
+	SetClock(clk)
+	uid := createTestUser(t, "restored")
+	err := db.SavePresenceState([]db.PresenceState{{DeviceID: 1, UserID: uid, LastSeen: clk.Now().Unix()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.SavePresenceState(nil) })
+
+	RestorePresence(10 * time.Minute)
+	if !PresenceRestored() || !CheckUserIsPresent(uid) {
+		t.Fatal("presence not restored")
+	}
+	clk.Advance(9 * time.Minute)
+	expireRestored()
+	if !CheckUserIsPresent(uid) {
+		t.Error("restored presence dropped within grace")
+	}
+	clk.Advance(2 * time.Minute)
+	expireRestored()
+	if PresenceRestored() || CheckUserIsPresent(uid) {
+		t.Error("restored presence kept after grace")
+	}
+}
@@ -0,0 +1,148 @@
+package arplib
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/mdlayher/arp"
+)
+
+// InterfaceCheck is the self-test result for one interface.
+type InterfaceCheck struct {
+	Interface      string   `json:"interface"`
+	Found          bool     `json:"found"`
+	AddressInRange bool     `json:"address_in_range"`
+	Privileged     bool     `json:"privileged"`
+	Targets        int      `json:"targets"`
+	Responded      int      `json:"responded"`
+	Errors         int      `json:"errors"`
+	Pass           bool     `json:"pass"`
+	Hints          []string `json:"hints,omitempty"`
+}
+
+// SelfTestReport tells whether the scanner can actually reach the range.
+type SelfTestReport struct {
+	Range      string           `json:"range"`
+	Interfaces []InterfaceCheck `json:"interfaces"`
+	Pass       bool             `json:"pass"`
+}
+
+// SelfTest checks every interface: does it exist, does it have an address in
+// the range, may we send ARP requests, and how many hosts answer a scan. It
+// waits for a running scan to finish and the ticker skips its scans while
+// the self-test runs, so the two never flood the network at the same time.
+func SelfTest(interfaceNames []string, cidr string) (SelfTestReport, error) {
+	scanRunning.Lock()
+	defer scanRunning.Unlock()
+	report := SelfTestReport{Range: cidr, Pass: len(interfaceNames) > 0}
+	prefixes := parseRanges(cidr)
+	if len(prefixes) == 0 {
+		return report, errors.New("Invalid range: no valid CIDR in " + strconv.Quote(cidr))
+	}
+	for _, name := range interfaceNames {
+		check := checkInterface(name, prefixes, cidr)
+		report.Pass = report.Pass && check.Pass
+		report.Interfaces = append(report.Interfaces, check)
+	}
+	return report, nil
+}
+
+func checkInterface(name string, prefixes []netip.Prefix, cidr string) InterfaceCheck {
+	check := InterfaceCheck{Interface: name}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		check.Hints = append(check.Hints, "Interface not found, check the Interface setting (ip link lists the available ones)")
+		return check
+	}
+	check.Found = true
+
+	addrs, _ := iface.Addrs()
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			ip, ok := netip.AddrFromSlice(ipnet.IP)
+			if !ok {
+				continue
+			}
+			for _, prefix := range prefixes {
+				if prefix.Contains(ip.Unmap()) {
+					check.AddressInRange = true
+				}
+			}
+		}
+	}
+	if !check.AddressInRange {
+		check.Hints = append(check.Hints, "Interface has no address in "+cidr+", ARP only reaches the local segment")
+	}
+
+	c, err := arp.Dial(iface)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			check.Hints = append(check.Hints, "No permission to send ARP requests, run as root or grant CAP_NET_RAW (setcap cap_net_raw+ep fahrmarke)")
+		} else {
+			check.Hints = append(check.Hints, "Failed to open ARP client: "+err.Error())
+		}
+		return check
+	}
+	c.Close()
+	check.Privileged = true
+
+	result, err := Scan(name, cidr)
+	if err != nil {
+		check.Hints = append(check.Hints, "Scan failed: "+err.Error())
+		return check
+	}
+	check.Targets = result.Targets
+	check.Responded = len(result.MACs)
+	check.Errors = result.Errors
+	if check.Responded == 0 {
+		check.Hints = append(check.Hints, "No host answered, is the range right and the network up?")
+	}
+	if result.SuccessRatio() < minScanSuccessRatio {
+		check.Hints = append(check.Hints, strconv.Itoa(check.Errors)+" of "+strconv.Itoa(check.Targets)+" probes failed, scans would be discarded")
+	}
+	check.Pass = check.AddressInRange && check.Responded > 0 && result.SuccessRatio() >= minScanSuccessRatio
+	return check
+}
+
+// String renders the report for the command line.
+func (r SelfTestReport) String() string {
+	var b strings.Builder
+	for _, c := range r.Interfaces {
+		res := "FAIL"
+		if c.Pass {
+			res = "PASS"
+		}
+		b.WriteString(res + " " + c.Interface + ": ")
+		b.WriteString(strconv.Itoa(c.Responded) + "/" + strconv.Itoa(c.Targets) + " hosts responded")
+		b.WriteString(", address in range: " + strconv.FormatBool(c.AddressInRange))
+		b.WriteString(", ARP privileges: " + strconv.FormatBool(c.Privileged) + "\n")
+		for _, h := range c.Hints {
+			b.WriteString("  - " + h + "\n")
+		}
+	}
+	if r.Pass {
+		b.WriteString("Self-test passed for " + r.Range + "\n")
+	} else {
+		b.WriteString("Self-test failed for " + r.Range + "\n")
+	}
+	return b.String()
+}
+
+// scanTargets are the interfaces and range the ticker scans, so the admin
+// self-test can check the same.
+var scanTargets struct {
+	interfaces []string
+	cidr       string
+}
+
+// SelfTestConfigured runs SelfTest against what the scan ticker uses.
+func SelfTestConfigured() (SelfTestReport, error) {
+	if scanTargets.cidr == "" {
+		return SelfTestReport{}, errors.New("Scanner not started")
+	}
+	return SelfTest(scanTargets.interfaces, scanTargets.cidr)
+}
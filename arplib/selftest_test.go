@@ -0,0 +1,25 @@
+package arplib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelfTestWaitsForScan(t *testing.T) {
+	scanRunning.Lock()
+	done := make(chan SelfTestReport)
+	go func() {
+		report, _ := SelfTest([]string{"fahrmarke-none0"}, "10.0.0.0/24")
+		done <- report
+	}()
+	select {
+	case <-done:
+		t.Fatal("self-test ran during a scan")
+	case <-time.After(50 * time.Millisecond):
+	}
+	scanRunning.Unlock()
+	report := <-done
+	if report.Pass || len(report.Interfaces) != 1 || report.Interfaces[0].Found {
+		t.Errorf("got %+v, want a failed check of a missing interface", report)
+	}
+}
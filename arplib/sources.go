@@ -0,0 +1,75 @@
+package arplib
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+// A source gathers the MAC addresses currently seen on the network by one
+// detection method.
+type source func(interfaceNames []string, cidr string) (ScanResult, error)
+
+var sources = map[string]source{
+	"arp": func(interfaceNames []string, cidr string) (ScanResult, error) {
+		return ScanInterfaces(interfaceNames, cidr), nil
+	},
+	"neighbor": ScanNeighbors,
+}
+
+// presenceMethods are the enabled sources in priority order.
+var presenceMethods = []string{"arp"}
+
+// SetPresenceMethods enables the given comma separated list of sources.
+func SetPresenceMethods(list string) error {
+	var methods []string
+	for _, m := range strings.Split(list, ",") {
+		m = strings.ToLower(strings.TrimSpace(m))
+		if m == "" {
+			continue
+		}
+		if _, ok := sources[m]; !ok {
+			return errors.New("unknown presence method: " + m)
+		}
+		methods = append(methods, m)
+	}
+	if len(methods) == 0 {
+		return errors.New("no presence method configured")
+	}
+	presenceMethods = methods
+	return nil
+}
+
+// Observation is a MAC seen during a scan cycle and the sources that saw it.
+type Observation struct {
+	MAC     net.HardwareAddr
+	Sources []string
+}
+
+// gatherObservations queries every enabled source and merges the results,
+// a MAC reported by several sources shows up once. The returned ScanResult
+// sums up targets and errors of all sources.
+func gatherObservations(interfaceNames []string, cidr string) ([]Observation, ScanResult) {
+	index := make(map[string]int)
+	var observations []Observation
+	var total ScanResult
+	for _, method := range presenceMethods {
+		result, err := sources[method](interfaceNames, cidr)
+		total.merge(ScanResult{Hosts: result.Hosts, Targets: result.Targets, Errors: result.Errors})
+		if err != nil {
+			log.Println("Error gathering presence from "+method+":", err)
+			continue
+		}
+		for _, mac := range result.MACs {
+			key := CanonicalMAC(mac)
+			if i, ok := index[key]; ok {
+				observations[i].Sources = append(observations[i].Sources, method)
+				continue
+			}
+			index[key] = len(observations)
+			observations = append(observations, Observation{MAC: mac, Sources: []string{method}})
+		}
+	}
+	return observations, total
+}
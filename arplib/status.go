@@ -0,0 +1,95 @@
+package arplib
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/clock"
+)
+
+type scannerStatus struct {
+	sync.RWMutex
+	lastScan    time.Time
+	lastSuccess time.Time
+	lastOK      bool
+	lastError   string
+	privileged  *bool // nil until the first ARP client was opened
+}
+
+var status scannerStatus
+
+// clk is the clock presence and status timestamps are taken from.
+var clk clock.Clock = clock.Real{}
+
+// SetClock replaces the clock, e.g. with a clock.Fake in tests.
+func SetClock(c clock.Clock) {
+	clk = c
+}
+
+func (s *scannerStatus) finish(ok bool, errMsg string) {
+	s.Lock()
+	defer s.Unlock()
+	s.lastScan = clk.Now()
+	s.lastOK = ok
+	s.lastError = errMsg
+	if ok {
+		s.lastSuccess = s.lastScan
+	}
+}
+
+func (s *scannerStatus) setPrivileged(p bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.privileged = &p
+}
+
+// Status is a snapshot of the scanner state for health reporting.
+type Status struct {
+	LastScan    time.Time `json:"last_scan"`
+	LastSuccess time.Time `json:"last_success"`
+	LastOK      bool      `json:"last_ok"`
+	LastError   string    `json:"last_error,omitempty"`
+	Privileged  *bool     `json:"privileged"`
+	Restored    bool      `json:"restored"` // presence still from before the restart
+}
+
+func GetStatus() Status {
+	restored := PresenceRestored()
+	status.RLock()
+	defer status.RUnlock()
+	return Status{
+		LastScan:    status.lastScan,
+		LastSuccess: status.lastSuccess,
+		LastOK:      status.lastOK,
+		LastError:   status.lastError,
+		Privileged:  status.privileged,
+		Restored:    restored,
+	}
+}
+
+// scanEvery is the interval the ticker runs at.
+var scanEvery time.Duration
+
+// ScanInterval returns the interval the ticker runs at, 0 before it started.
+func ScanInterval() time.Duration {
+	return scanEvery
+}
+
+// ScannerHealthy reports whether the last scan succeeded and scans are not
+// overdue, i.e. whether "not seen" can be trusted.
+func ScannerHealthy() bool {
+	status.RLock()
+	defer status.RUnlock()
+	if !status.lastOK || status.lastSuccess.IsZero() {
+		return false
+	}
+	return scanEvery == 0 || clk.Now().Sub(status.lastSuccess) < 3*scanEvery
+}
+
+// LastScanTime returns when the last scan completed successfully, the zero
+// time if none has yet.
+func LastScanTime() time.Time {
+	status.RLock()
+	defer status.RUnlock()
+	return status.lastSuccess
+}
@@ -0,0 +1,130 @@
+package arplib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// wolPort is the UDP port magic packets are sent to, the discard port most
+// network cards listen on.
+var wolPort uint16 = 9
+
+// SendWOL sends a Wake-on-LAN magic packet for mac to the broadcast address:
+// six 0xff bytes followed by the MAC repeated sixteen times.
+func SendWOL(mac net.HardwareAddr, broadcast netip.Addr) error {
+	if len(mac) != 6 {
+		return errors.New("Wake-on-LAN needs a 48 bit MAC, got " + CanonicalMAC(mac))
+	}
+	packet := make([]byte, 0, 6+16*len(mac))
+	for i := 0; i < 6; i++ {
+		packet = append(packet, 0xff)
+	}
+	for i := 0; i < 16; i++ {
+		packet = append(packet, mac...)
+	}
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(netip.AddrPortFrom(broadcast, wolPort)))
+	if err != nil {
+		return errors.New("Failed to open UDP socket: " + err.Error())
+	}
+	defer conn.Close()
+	if _, err := conn.Write(packet); err != nil {
+		return errors.New("Failed to send magic packet: " + err.Error())
+	}
+	return nil
+}
+
+// wakeDevices enables waking known devices before every scan, so phones and
+// laptops that put their Wi-Fi to sleep answer ARP again.
+var wakeDevices bool
+
+func SetWakeDevices(enabled bool) {
+	wakeDevices = enabled
+}
+
+// wakeSettle is how long a scan waits after the magic packets, a device
+// needs a moment to bring its network card back up.
+var wakeSettle = 2 * time.Second
+
+// wakeTargets are the MACs of the registered devices seen since startup, by
+// device id. Only the salted hashes are stored, so a device can only be woken
+// after a scan saw its MAC once. It only lives in memory so raw MACs never
+// hit the database.
+var wakeTargets = struct {
+	sync.Mutex
+	byDevice map[int]net.HardwareAddr
+}{byDevice: map[int]net.HardwareAddr{}}
+
+// rememberWakeTargets adds the devices seen by a scan and forgets the ones
+// that are no longer registered.
+func rememberWakeTargets(seenMACs map[int]net.HardwareAddr, devices []db.Device) {
+	registered := make(map[int]bool, len(devices))
+	for _, d := range devices {
+		registered[d.ID] = true
+	}
+	wakeTargets.Lock()
+	defer wakeTargets.Unlock()
+	for id := range wakeTargets.byDevice {
+		if !registered[id] {
+			delete(wakeTargets.byDevice, id)
+		}
+	}
+	for id, mac := range seenMACs {
+		wakeTargets.byDevice[id] = mac
+	}
+}
+
+// wakeKnownDevices sends a magic packet for every remembered device to the
+// broadcast address of every IPv4 range, then gives them time to wake up.
+// It returns false if ctx was cancelled in the meantime.
+func wakeKnownDevices(ctx context.Context, cidr string) bool {
+	wakeTargets.Lock()
+	macs := make([]net.HardwareAddr, 0, len(wakeTargets.byDevice))
+	for _, mac := range wakeTargets.byDevice {
+		macs = append(macs, mac)
+	}
+	wakeTargets.Unlock()
+	if len(macs) == 0 {
+		return true
+	}
+	var failed int
+	var lastErr error
+	for _, prefix := range parseRanges(cidr) {
+		if !prefix.Addr().Is4() {
+			continue
+		}
+		broadcast := broadcastAddr(prefix)
+		for _, mac := range macs {
+			if err := SendWOL(mac, broadcast); err != nil {
+				failed++
+				lastErr = err
+			}
+		}
+	}
+	if failed > 0 {
+		log.Println("Failed to send", failed, "Wake-on-LAN packets:", lastErr)
+	}
+	select {
+	case <-time.After(wakeSettle):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// broadcastAddr returns the last address of an IPv4 prefix.
+func broadcastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Masked().Addr().As4()
+	bits := prefix.Bits()
+	for i := range b {
+		hostBits := min(max(32-bits-8*(3-i), 0), 8)
+		b[i] |= byte(1<<hostBits - 1)
+	}
+	return netip.AddrFrom4(b)
+}
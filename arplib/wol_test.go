@@ -0,0 +1,106 @@
+package arplib
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+func TestSendWOL(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	orig := wolPort
+	wolPort = uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	t.Cleanup(func() { wolPort = orig })
+
+	mac := testMAC(0x84)
+	if err := SendWOL(mac, netip.MustParseAddr("127.0.0.1")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 256)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bytes.Repeat([]byte{0xff}, 6)
+	for i := 0; i < 16; i++ {
+		want = append(want, mac...)
+	}
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("got packet % x, want % x", buf[:n], want)
+	}
+
+	if err := SendWOL(net.HardwareAddr{1, 2, 3, 4, 5, 6, 7, 8}, netip.MustParseAddr("127.0.0.1")); err == nil {
+		t.Error("64 bit MAC accepted")
+	}
+}
+
+func TestBroadcastAddr(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"192.168.1.0/24": "192.168.1.255",
+		"10.0.0.0/8":     "10.255.255.255",
+		"10.1.2.3/30":    "10.1.2.3",
+		"172.16.0.0/12":  "172.31.255.255",
+	} {
+		if got := broadcastAddr(netip.MustParsePrefix(prefix)); got.String() != want {
+			t.Errorf("%s: got %s, want %s", prefix, got, want)
+		}
+	}
+}
+
+func TestWakeStopsOnCancel(t *testing.T) {
+	resetPresence(t)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	origPort, origSettle := wolPort, wakeSettle
+	wolPort = uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	wakeSettle = time.Minute
+	SetWakeDevices(true)
+	rememberWakeTargets(map[int]net.HardwareAddr{1: testMAC(0x84)}, []db.Device{{ID: 1}})
+	t.Cleanup(func() {
+		wolPort, wakeSettle = origPort, origSettle
+		SetWakeDevices(false)
+		rememberWakeTargets(nil, nil)
+	})
+	var scans atomic.Int32
+	orig := scanInterface
+	scanInterface = func(name string, cidr string) (ScanResult, error) {
+		scans.Add(1)
+		return ScanResult{}, nil
+	}
+	t.Cleanup(func() { scanInterface = orig })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		performMacScan(ctx, []string{"eth0"}, "127.0.0.1/32")
+		close(done)
+	}()
+	// the magic packet went out, the scan now waits for the devices
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := conn.ReadFromUDP(make([]byte, 256)); err != nil {
+		t.Fatal("no magic packet:", err)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("scan kept waiting for the devices after cancel")
+	}
+	if n := scans.Load(); n != 0 {
+		t.Errorf("cancelled scan still scanned %d interfaces", n)
+	}
+}
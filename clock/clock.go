@@ -0,0 +1,47 @@
+// Package clock abstracts the current time so expiry and presence logic can
+// run against a controllable clock.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+// Real is the wall clock.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// Fake is a clock that only moves when told to.
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) Set(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+}
+
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
@@ -0,0 +1,19 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	var c Clock = NewFake(start)
+	c.(*Fake).Advance(time.Hour)
+	if got := c.Now(); !got.Equal(start.Add(time.Hour)) {
+		t.Errorf("got %v after Advance, want %v", got, start.Add(time.Hour))
+	}
+	c.(*Fake).Set(start)
+	if got := c.Now(); !got.Equal(start) {
+		t.Errorf("got %v after Set, want %v", got, start)
+	}
+}
@@ -1,22 +1,74 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Nerdberg/fahrmarke/arplib"
+	"github.com/Nerdberg/fahrmarke/config"
 	db "github.com/Nerdberg/fahrmarke/dblib"
+	"github.com/Nerdberg/fahrmarke/gpio"
 	"github.com/Nerdberg/fahrmarke/web"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/spf13/pflag"
 )
 
+// requestLogger logs requests like middleware.Logger, except for the paths
+// the web package marks as quiet.
+func requestLogger(next http.Handler) http.Handler {
+	logged := middleware.Logger(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if web.QuietPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		logged.ServeHTTP(w, r)
+	})
+}
+
+func newRouter() *chi.Mux {
+	r := chi.NewRouter()
+
+	r.Use(middleware.RequestID)
+	r.Use(web.KeepPeerAddr)
+	r.Use(middleware.RealIP)
+	r.Use(requestLogger)
+	r.Use(web.CountRequests)
+	r.Use(middleware.Recoverer)
+
+	r.Use(requestTimeout(60 * time.Second))
+	return r
+}
+
+// requestTimeout is middleware.Timeout, except for the streams the web
+// package lists in StreamPaths.
+func requestTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		limited := middleware.Timeout(d)(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if web.StreamPaths[r.URL.Path] {
+				next.ServeHTTP(w, r)
+				return
+			}
+			limited.ServeHTTP(w, r)
+		})
+	}
+}
+
 func main() {
 	datapath := pflag.String("datapath", "./", "Path for database and themes")
+	configFile := pflag.String("config", "", "JSON file whose settings override the database")
 	pflag.Parse()
 	absPath, err := filepath.Abs(*datapath)
 	log.Println("Using datapath: ", absPath)
@@ -28,52 +80,118 @@ func main() {
 	if err != nil {
 		log.Fatal("Error initializing database:", err)
 	}
-
-	scantime, err := db.GetSetting("Scantime")
-	if err != nil {
-		log.Fatal("Error retrieving Scantime setting:", err)
+	if pflag.Arg(0) == "db" {
+		runDBCommand(pflag.Arg(1))
+		return
 	}
-	log.Println("Scantime setting value:", scantime)
 
-	interfacename, err := db.GetSetting("Interface")
-	if err != nil {
-		log.Fatal("Error retrieving Interface setting:", err)
+	if *configFile != "" {
+		if err := config.ApplyFile(*configFile); err != nil {
+			log.Fatal("Error applying config file:\n", err)
+		}
 	}
-	log.Println("Interface setting value:", interfacename)
-
-	rangepref, err := db.GetSetting("Range")
+	cfg, err := config.Load(absPath)
 	if err != nil {
-		log.Fatal("Error retrieving Range setting:", err)
+		log.Fatal("Invalid configuration:\n", err)
 	}
-	log.Println("Range setting value:", rangepref)
+	log.Println("Scan interval:", cfg.ScanInterval)
+	log.Println("Interfaces:", strings.Join(cfg.Interfaces, ", "))
+	log.Println("Range:", cfg.Range)
+	log.Println("Presence method:", cfg.PresenceMethod)
 
-	scantimeInt, err := strconv.Atoi(scantime)
-	if err != nil {
-		log.Fatal("Error converting Scantime setting to int:", err)
+	if err := arplib.SetPresenceMethods(cfg.PresenceMethod); err != nil {
+		log.Fatal("Invalid PresenceMethod setting:", err)
 	}
-	arplib.StartScanTicker(interfacename, rangepref, time.Duration(scantimeInt)*time.Minute)
-
-	listenPort, err := db.GetSetting("Port")
-	if err != nil {
-		log.Fatal("Error retrieving Port setting:", err)
+	arplib.SetEventRetention(cfg.EventRetention)
+	arplib.SetScanLogRetention(cfg.ScanLogRetention)
+	arplib.SetPresenceLogRetention(cfg.PresenceLogRetention)
+	arplib.SetScanPacing(cfg.ScanRate, cfg.ScanShuffle)
+	arplib.SetScanWorkers(cfg.ScanWorkers)
+	arplib.SetHashIterations(cfg.HashIterations)
+	arplib.SetMinScanSuccessRatio(cfg.MinScanSuccessRatio)
+	arplib.SetTrackUnknown(cfg.TrackUnknownDevices)
+	arplib.SetWakeDevices(cfg.WakeDevices)
+	arplib.SetMinScanInterval(cfg.MinScanInterval)
+	arplib.SetFakeScan(cfg.FakeScanMACs)
+	arplib.SetAwayPolicy(cfg.AwayThreshold, cfg.AwayCountsOnline)
+	arplib.SetMissedScanGrace(cfg.MissedScanGrace)
+	if err := arplib.LoadOUI(cfg.OUIFile); err != nil {
+		log.Println("Keeping the built-in vendor list:", err)
 	}
-	log.Println("Port setting value:", listenPort)
-
-	r := chi.NewRouter()
+	if pflag.Arg(0) == "selftest" {
+		report, err := arplib.SelfTest(cfg.Interfaces, cfg.Range)
+		if err != nil {
+			log.Fatal("Self-test failed:", err)
+		}
+		fmt.Print(report)
+		if !report.Pass {
+			os.Exit(1)
+		}
+		return
+	}
+	if cfg.VacuumAt != "" {
+		scheduleVacuum(cfg.VacuumAt)
+	}
+	arplib.RestorePresence(cfg.PresenceGrace)
+	light := gpio.Open(cfg.GPIOPin)
+	light.Set(len(arplib.OnlineSet()) > 0)
+	arplib.SetOpenHook(light.Set)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	scanDone := arplib.StartScanTicker(ctx, cfg.Interfaces, cfg.Range, cfg.ScanInterval)
 
-	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
+	r := newRouter()
+	web.GetRouter(r, cfg, cfg.AdminPort == "")
+	web.StartSessionReaper()
 
-	r.Use(middleware.Timeout(60 * time.Second))
+	var servers []*http.Server
+	if cfg.AdminPort != "" {
+		ar := newRouter()
+		web.GetAdminRouter(ar)
+		adminAddr := net.JoinHostPort(cfg.AdminAddress, cfg.AdminPort)
+		log.Println("Starting admin server on " + adminAddr)
+		servers = append(servers, serve("admin server", &http.Server{Addr: adminAddr, Handler: ar}, cfg))
+	}
 
-	web.GetRouter(r, absPath)
+	if cfg.TLSCert != "" {
+		log.Println("Serving HTTPS with certificate " + cfg.TLSCert)
+	}
+	log.Println("Starting server on port " + cfg.Port)
+	servers = append(servers, serve("server", &http.Server{Addr: ":" + cfg.Port, Handler: r}, cfg))
 
-	log.Println("Starting server on port " + listenPort)
-	err = http.ListenAndServe(":"+listenPort, r)
-	if err != nil {
-		log.Fatal("Error starting server:", err)
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down, finishing requests for up to", cfg.ShutdownTimeout)
+	web.StopStreams()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Println("Error shutting down server on "+srv.Addr+":", err)
+		}
 	}
+	log.Println("Waiting for the scanner")
+	scanDone()
+	if err := db.CloseDB(); err != nil {
+		log.Println(err)
+	}
+	log.Println("Shutdown complete")
+}
 
+// serve runs srv in the background, over HTTPS when a certificate is
+// configured. Shutdown makes it return http.ErrServerClosed, anything else
+// is fatal.
+func serve(name string, srv *http.Server, cfg *config.Config) *http.Server {
+	go func() {
+		var err error
+		if cfg.TLSCert != "" {
+			err = srv.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal("Error starting "+name+":", err)
+		}
+	}()
+	return srv
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// runDBCommand handles "fahrmarke db vacuum" and "fahrmarke db check".
+func runDBCommand(cmd string) {
+	switch cmd {
+	case "vacuum":
+		start := time.Now()
+		if err := db.Vacuum(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("VACUUM done in", time.Since(start).Round(time.Millisecond))
+	case "check":
+		problems, err := db.IntegrityCheck()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(problems) == 0 {
+			fmt.Println("Integrity check: ok")
+			return
+		}
+		for _, p := range problems {
+			fmt.Println(p)
+		}
+		os.Exit(1)
+	default:
+		log.Fatal("Usage: fahrmarke db vacuum|check")
+	}
+}
+
+// scheduleVacuum runs VACUUM every day at the given "15:04" local time, which
+// should be a time when the space is usually empty.
+func scheduleVacuum(at string) {
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		log.Println("Invalid VacuumAt, not scheduling VACUUM:", err)
+		return
+	}
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			time.Sleep(time.Until(next))
+			start := time.Now()
+			if err := db.Vacuum(); err != nil {
+				log.Println("Scheduled VACUUM failed:", err)
+				continue
+			}
+			log.Println("Scheduled VACUUM done in", time.Since(start).Round(time.Millisecond))
+		}
+	}()
+}
@@ -0,0 +1,228 @@
+// Package config reads the bootstrap settings from the database in one pass.
+package config
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// Config holds everything main needs to start the scanner and web server.
+type Config struct {
+	DataPath             string
+	Port                 string
+	AdminPort            string // empty serves the admin routes on Port
+	AdminAddress         string
+	Interfaces           []string
+	Range                string
+	ScanInterval         time.Duration
+	MinScanInterval      time.Duration
+	ScanRate             int
+	ScanWorkers          int
+	HashIterations       int // for new device hashes, stored devices keep theirs
+	ScanShuffle          bool
+	ScanMode             string // active or neighbor, picks the default PresenceMethod
+	PresenceMethod       string
+	MinScanSuccessRatio  float64
+	TrackUnknownDevices  bool
+	WakeDevices          bool
+	EventRetention       time.Duration
+	ScanLogRetention     time.Duration
+	PresenceLogRetention time.Duration
+	PresenceGrace        time.Duration
+	MissedScanGrace      time.Duration // 0 means twice the scan interval
+	AwayThreshold        time.Duration
+	AwayCountsOnline     bool
+	OUIFile              string
+	GPIOPin              int    // pin driven high while the space is open, -1 disables it
+	TLSCert              string // empty TLSCert and TLSKey serve plain HTTP
+	TLSKey               string
+	ShutdownTimeout      time.Duration      // how long running requests may take on shutdown
+	VacuumAt             string             // daily "15:04" time for VACUUM, empty disables it
+	FakeScanMACs         []net.HardwareAddr // only set with DevFakeScan
+	Web                  Web
+}
+
+// loader collects every problem it finds instead of stopping at the first,
+// so a broken setup is reported in one go.
+type loader struct {
+	errs []error
+}
+
+func (l *loader) fail(key, msg string) {
+	l.errs = append(l.errs, errors.New(key+": "+msg))
+}
+
+func (l *loader) required(key string) string {
+	v, err := db.GetSetting(key)
+	if err != nil {
+		l.fail(key, err.Error())
+		return ""
+	}
+	if v == "" {
+		l.fail(key, "not set")
+	}
+	return v
+}
+
+func (l *loader) optional(key, fallback string) string {
+	v, err := db.GetSettingDefault(key, fallback)
+	if err != nil {
+		l.fail(key, err.Error())
+		return fallback
+	}
+	return v
+}
+
+func (l *loader) integer(key, v string, min int) int {
+	i, err := strconv.Atoi(v)
+	if err != nil || i < min {
+		l.fail(key, "expected an integer >= "+strconv.Itoa(min)+", got "+strconv.Quote(v))
+	}
+	return i
+}
+
+func (l *loader) boolean(key, v string) bool {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		l.fail(key, "expected true or false, got "+strconv.Quote(v))
+	}
+	return b
+}
+
+func (l *loader) duration(key, v string) time.Duration {
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		l.fail(key, "expected a duration like 15s, got "+strconv.Quote(v))
+	}
+	return d
+}
+
+// Load reads the configuration. The database has to be initialized already.
+// The returned error lists every invalid setting.
+func Load(datapath string) (*Config, error) {
+	l := &loader{}
+	c := &Config{DataPath: datapath}
+
+	c.Port = l.required("Port")
+	c.AdminPort = l.optional("AdminPort", "")
+	c.AdminAddress = l.optional("AdminAddress", "localhost")
+	if c.AdminPort != "" && c.AdminPort == c.Port {
+		l.fail("AdminPort", "must differ from Port")
+	}
+	c.Range = l.required("Range")
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(l.required("Interface"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			// scanning it twice would only double the ARP traffic
+			l.fail("Interface", "listed twice: "+strconv.Quote(name))
+			continue
+		}
+		seen[name] = true
+		c.Interfaces = append(c.Interfaces, name)
+	}
+	if scantime := l.required("Scantime"); scantime != "" {
+		c.ScanInterval = time.Duration(l.integer("Scantime", scantime, 0)) * time.Minute
+	}
+	c.MinScanInterval = l.duration("MinScanInterval", l.optional("MinScanInterval", "15s"))
+	c.ScanRate = l.integer("ScanRate", l.optional("ScanRate", "0"), 0)
+	c.ScanWorkers = l.integer("ScanWorkers", l.optional("ScanWorkers", "64"), 1)
+	c.HashIterations = l.integer("HashIterations", l.optional("HashIterations", "1000"), 1)
+	c.ScanShuffle = l.boolean("ScanShuffle", l.optional("ScanShuffle", "false"))
+	c.ScanMode = strings.ToLower(l.optional("ScanMode", "active"))
+	method := "arp"
+	switch c.ScanMode {
+	case "active":
+	case "neighbor":
+		// reads the kernel's ARP cache, works without raw socket privileges
+		method = "neighbor"
+	default:
+		l.fail("ScanMode", "expected active or neighbor, got "+strconv.Quote(c.ScanMode))
+	}
+	c.PresenceMethod = l.optional("PresenceMethod", method)
+
+	ratio := l.optional("MinScanSuccessRatio", "0.5")
+	r, err := strconv.ParseFloat(ratio, 64)
+	if err != nil || r < 0 || r > 1 {
+		l.fail("MinScanSuccessRatio", "expected a value between 0 and 1, got "+strconv.Quote(ratio))
+	}
+	c.MinScanSuccessRatio = r
+
+	c.TrackUnknownDevices = l.boolean("TrackUnknownDevices", l.optional("TrackUnknownDevices", "false"))
+	c.WakeDevices = l.boolean("WakeDevices", l.optional("WakeDevices", "false"))
+	days := l.integer("PresenceEventRetentionDays", l.optional("PresenceEventRetentionDays", "30"), 0)
+	c.EventRetention = time.Duration(days) * 24 * time.Hour
+	days = l.integer("ScanLogRetentionDays", l.optional("ScanLogRetentionDays", "7"), 0)
+	c.ScanLogRetention = time.Duration(days) * 24 * time.Hour
+	days = l.integer("PresenceLogRetentionDays", l.optional("PresenceLogRetentionDays", "30"), 0)
+	c.PresenceLogRetention = time.Duration(days) * 24 * time.Hour
+
+	c.AwayThreshold = l.duration("AwayThreshold", l.optional("AwayThreshold", "30m"))
+	c.AwayCountsOnline = l.boolean("AwayCountsOnline", l.optional("AwayCountsOnline", "false"))
+	c.PresenceGrace = l.duration("PresenceRestoreGrace", l.optional("PresenceRestoreGrace", "10m"))
+	if grace := l.optional("MissedScanGrace", ""); grace != "" {
+		c.MissedScanGrace = l.duration("MissedScanGrace", grace)
+	}
+
+	c.TLSCert = l.optional("TLSCert", "")
+	c.TLSKey = l.optional("TLSKey", "")
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		l.fail("TLSCert", "TLSCert and TLSKey must be set together")
+	} else if c.TLSCert != "" {
+		if !filepath.IsAbs(c.TLSCert) {
+			c.TLSCert = filepath.Join(datapath, c.TLSCert)
+		}
+		if !filepath.IsAbs(c.TLSKey) {
+			c.TLSKey = filepath.Join(datapath, c.TLSKey)
+		}
+		if _, err := tls.LoadX509KeyPair(c.TLSCert, c.TLSKey); err != nil {
+			l.fail("TLSCert", err.Error())
+		}
+	}
+
+	c.Web = l.web(c)
+
+	c.ShutdownTimeout = l.duration("ShutdownTimeout", l.optional("ShutdownTimeout", "10s"))
+
+	if c.VacuumAt = l.optional("VacuumAt", ""); c.VacuumAt != "" {
+		if _, err := time.Parse("15:04", c.VacuumAt); err != nil {
+			l.fail("VacuumAt", "expected a time like 04:00, got "+strconv.Quote(c.VacuumAt))
+		}
+	}
+
+	c.GPIOPin = -1
+	if pin := l.optional("GPIOPin", ""); pin != "" {
+		c.GPIOPin = l.integer("GPIOPin", pin, 0)
+	}
+
+	c.OUIFile = l.optional("OUIFile", "oui.txt")
+	if !filepath.IsAbs(c.OUIFile) {
+		c.OUIFile = filepath.Join(datapath, c.OUIFile)
+	}
+
+	if l.boolean("DevFakeScan", l.optional("DevFakeScan", "false")) {
+		for _, s := range strings.Split(l.optional("DevFakeScanMACs", "de:ad:be:ef:de:ad,ab:cd:ef:01:23:45"), ",") {
+			mac, err := net.ParseMAC(strings.TrimSpace(s))
+			if err != nil {
+				l.fail("DevFakeScanMACs", "invalid MAC "+strconv.Quote(s))
+				continue
+			}
+			c.FakeScanMACs = append(c.FakeScanMACs, mac)
+		}
+	}
+
+	if len(l.errs) > 0 {
+		return nil, errors.Join(l.errs...)
+	}
+	return c, nil
+}
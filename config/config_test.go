@@ -0,0 +1,87 @@
+package config
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// setupDB initializes a fresh database with the settings Load requires.
+func setupDB(t *testing.T, settings map[string]string) {
+	t.Helper()
+	if err := db.InitDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.CloseDB() })
+	required := map[string]string{
+		"SessionHMACKey": "hmac",
+		"CSRFKey":        "0123456789abcdef0123456789abcdef",
+	}
+	for k, v := range required {
+		if err := db.SetSetting(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k, v := range settings {
+		if err := db.SetSetting(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadWebDefaults(t *testing.T) {
+	setupDB(t, map[string]string{"SpaceAPIRooms": `[{"tag": " Werkstatt ", "name": "Werkstatt"}]`})
+	c, err := Load(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := c.Web
+	if w.SessionLifetime != 24*time.Hour || w.CookieSameSite != http.SameSiteLaxMode || w.NightStart != 22*60 {
+		t.Errorf("unexpected defaults: %+v", w)
+	}
+	if len(w.SpaceAPIRooms) != 1 || w.SpaceAPIRooms[0].Tag != "werkstatt" {
+		t.Errorf("got rooms %+v, want the tag normalized", w.SpaceAPIRooms)
+	}
+}
+
+func TestLoadReportsEveryWebError(t *testing.T) {
+	setupDB(t, map[string]string{
+		"BoardVisibility": "everyone",
+		"LogoutRedirect":  "//example.org",
+		"CookieSameSite":  "none",
+		"BaseURL":         "example.org",
+	})
+	_, err := Load(t.TempDir())
+	if err == nil {
+		t.Fatal("invalid settings were accepted")
+	}
+	for _, key := range []string{"BoardVisibility", "LogoutRedirect", "CookieSameSite", "BaseURL"} {
+		if !strings.Contains(err.Error(), key+":") {
+			t.Errorf("error does not mention %s: %v", key, err)
+		}
+	}
+}
+
+func TestLoadTrustedProxies(t *testing.T) {
+	setupDB(t, map[string]string{"TrustedProxies": "10.0.0.1, 192.168.1.7/24,::1"})
+	c, err := Load(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range c.Web.TrustedProxies {
+		got = append(got, p.String())
+	}
+	if strings.Join(got, " ") != "10.0.0.1/32 192.168.1.0/24 ::1/128" {
+		t.Errorf("got %v", got)
+	}
+
+	db.SetSetting("TrustedProxies", "10.0.0.1,proxy")
+	if _, err := Load(t.TempDir()); err == nil || !strings.Contains(err.Error(), "TrustedProxies:") {
+		t.Errorf("invalid proxy accepted: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// ApplyFile writes the settings from a JSON file into SETTINGS, so a
+// deployment can keep its configuration in version control. Keys in the file
+// override the database, everything else stays as it is. The file is a flat
+// object, e.g. {"Port": "8080", "Scantime": 5, "ScanShuffle": true}.
+func ApplyFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return errors.New("Failed to read config file: " + err.Error())
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return errors.New("Failed to parse config file " + path + ": " + err.Error())
+	}
+	keys := make([]string, 0, len(raw))
+	for k := range raw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make(map[string]string, len(raw))
+	var errs []error
+	for _, k := range keys {
+		v, err := settingValue(raw[k])
+		if err != nil {
+			errs = append(errs, errors.New(k+": "+err.Error()))
+			continue
+		}
+		values[k] = v
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	for _, k := range keys {
+		if err := db.SetSetting(k, values[k]); err != nil {
+			return err
+		}
+		log.Println("Setting", k, "from", path)
+	}
+	return nil
+}
+
+// settingValue turns a JSON scalar into the string form SETTINGS stores.
+func settingValue(raw json.RawMessage) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		// keep the literal so 0.5 and 5 come out as written
+		return string(raw), nil
+	}
+	return "", errors.New("expected a string, number or boolean")
+}
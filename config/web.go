@@ -0,0 +1,209 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Web holds the settings of the web server, sessions and mails.
+type Web struct {
+	Theme                string
+	SessionHMACKey       []byte
+	CSRFKey              []byte
+	AssetsDir            string // absolute, empty serves no /assets
+	FaviconPath          string // absolute, empty uses the theme's favicon
+	BcryptCost           int
+	BcryptConcurrency    int
+	StaleDeviceWarning   time.Duration
+	ScanStaleAfter       time.Duration
+	SecureCookies        bool
+	CookieSameSite       http.SameSite
+	SessionLifetime      time.Duration
+	ClockSkewLeeway      time.Duration
+	InactivityTimeout    time.Duration // 0 disables it
+	SessionSweepInterval time.Duration
+	MaxSessionsPerUser   int // 0 means unlimited
+	LogoutRedirect       string
+	TrustedProxies       []netip.Prefix // peers allowed to name the client in proxy headers
+	AllowGetLogout       bool
+	LoginMaxFailures     int // 0 disables the limit
+	LoginFailureWindow   time.Duration
+	MaxEventStreams      int
+	SpaceAPIRooms        []SpaceAPIRoom
+	NightStart           int // minutes after midnight
+	NightEnd             int
+	ShownamePolicy       string
+	BoardVisibility      string
+	SMTPHost             string // empty only logs mails
+	SMTPPort             string
+	SMTPUser             string
+	SMTPPassword         string
+	SMTPFrom             string
+	BaseURL              string // empty refuses to mail token links
+	Metrics              bool
+}
+
+// SpaceAPIRoom maps a user tag to a people_now_present entry. Rooms come
+// from the SpaceAPIRooms setting, a JSON list like
+// [{"tag": "werkstatt", "name": "Werkstatt", "location": "EG"}].
+type SpaceAPIRoom struct {
+	Tag         string `json:"tag"`
+	Location    string `json:"location"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// nonNegativeDuration is like duration but accepts 0.
+func (l *loader) nonNegativeDuration(key, v string) time.Duration {
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		l.fail(key, "expected a duration like 15m or 0, got "+strconv.Quote(v))
+	}
+	return d
+}
+
+// oneOf checks v against the allowed values.
+func (l *loader) oneOf(key, v string, allowed ...string) string {
+	for _, a := range allowed {
+		if v == a {
+			return v
+		}
+	}
+	l.fail(key, "expected one of "+strings.Join(allowed, ", ")+", got "+strconv.Quote(v))
+	return v
+}
+
+// clockTime parses a "15:04" time into minutes after midnight.
+func (l *loader) clockTime(key, v string) int {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		l.fail(key, "expected a time like 22:00, got "+strconv.Quote(v))
+		return 0
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+// dataFile makes a configured path absolute relative to the data path.
+func dataFile(datapath, p string) string {
+	if p != "" && !filepath.IsAbs(p) {
+		return filepath.Join(datapath, p)
+	}
+	return p
+}
+
+// isLocalPath accepts absolute paths on this host only, no "//host" or
+// "/\host" tricks.
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
+
+func (l *loader) web(c *Config) Web {
+	w := Web{}
+	w.Theme = l.required("Theme")
+	w.SessionHMACKey = []byte(l.required("SessionHMACKey"))
+	w.CSRFKey = []byte(l.required("CSRFKey"))
+
+	w.AssetsDir = dataFile(c.DataPath, l.optional("AssetsDir", ""))
+	if w.AssetsDir != "" {
+		if fi, err := os.Stat(w.AssetsDir); err != nil || !fi.IsDir() {
+			l.fail("AssetsDir", "not a directory: "+w.AssetsDir)
+		}
+	}
+	w.FaviconPath = dataFile(c.DataPath, l.optional("FaviconPath", ""))
+
+	w.BcryptCost = l.integer("BcryptCost", l.optional("BcryptCost", "12"), bcrypt.MinCost)
+	if w.BcryptCost > bcrypt.MaxCost {
+		l.fail("BcryptCost", "must be at most "+strconv.Itoa(bcrypt.MaxCost))
+	}
+	w.BcryptConcurrency = l.integer("BcryptConcurrency", l.optional("BcryptConcurrency", strconv.Itoa(runtime.GOMAXPROCS(0))), 1)
+	w.StaleDeviceWarning = l.duration("StaleDeviceWarning", l.optional("StaleDeviceWarning", "72h"))
+	w.ScanStaleAfter = l.duration("ScanStaleAfter", l.optional("ScanStaleAfter", "20m"))
+
+	w.SecureCookies = l.boolean("SecureCookies", l.optional("SecureCookies", "false")) || c.TLSCert != ""
+	switch mode := strings.ToLower(l.optional("CookieSameSite", "lax")); mode {
+	case "lax":
+		w.CookieSameSite = http.SameSiteLaxMode
+	case "strict":
+		w.CookieSameSite = http.SameSiteStrictMode
+	case "none":
+		// browsers drop SameSite=None cookies that aren't Secure
+		if !w.SecureCookies {
+			l.fail("CookieSameSite", "none needs HTTPS or SecureCookies")
+		}
+		w.CookieSameSite = http.SameSiteNoneMode
+	default:
+		l.fail("CookieSameSite", "expected lax, strict or none, got "+strconv.Quote(mode))
+	}
+
+	w.SessionLifetime = l.duration("SessionLifetime", l.optional("SessionLifetime", "24h"))
+	w.ClockSkewLeeway = l.nonNegativeDuration("ClockSkewLeeway", l.optional("ClockSkewLeeway", "30s"))
+	w.InactivityTimeout = l.nonNegativeDuration("InactivityTimeout", l.optional("InactivityTimeout", "0"))
+	w.SessionSweepInterval = l.duration("SessionSweepInterval", l.optional("SessionSweepInterval", "10m"))
+	w.MaxSessionsPerUser = l.integer("MaxSessionsPerUser", l.optional("MaxSessionsPerUser", "0"), 0)
+	if w.LogoutRedirect = l.optional("LogoutRedirect", "/login"); !isLocalPath(w.LogoutRedirect) {
+		l.fail("LogoutRedirect", "must be a local path like /login, got "+strconv.Quote(w.LogoutRedirect))
+	}
+	for _, v := range strings.Split(l.optional("TrustedProxies", ""), ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(v)
+			if aerr != nil {
+				l.fail("TrustedProxies", "expected an IP or CIDR, got "+strconv.Quote(v))
+				continue
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		w.TrustedProxies = append(w.TrustedProxies, p.Masked())
+	}
+	w.AllowGetLogout = l.boolean("AllowGetLogout", l.optional("AllowGetLogout", "false"))
+	w.LoginMaxFailures = l.integer("LoginMaxFailures", l.optional("LoginMaxFailures", "10"), 0)
+	w.LoginFailureWindow = l.duration("LoginFailureWindow", l.optional("LoginFailureWindow", "15m"))
+	w.MaxEventStreams = l.integer("MaxEventStreams", l.optional("MaxEventStreams", "100"), 0)
+
+	if rooms := l.optional("SpaceAPIRooms", ""); rooms != "" {
+		if err := json.Unmarshal([]byte(rooms), &w.SpaceAPIRooms); err != nil {
+			l.fail("SpaceAPIRooms", err.Error())
+		}
+		for i := range w.SpaceAPIRooms {
+			tag, err := db.NormalizeTag(w.SpaceAPIRooms[i].Tag)
+			if err != nil {
+				l.fail("SpaceAPIRooms", err.Error())
+			}
+			w.SpaceAPIRooms[i].Tag = tag
+		}
+	}
+	w.NightStart = l.clockTime("NightStart", l.optional("NightStart", "22:00"))
+	w.NightEnd = l.clockTime("NightEnd", l.optional("NightEnd", "07:00"))
+	w.ShownamePolicy = l.oneOf("ShownamePolicy", l.optional("ShownamePolicy", "showname_then_username"),
+		"showname_then_username", "showname", "username", "short")
+	w.BoardVisibility = l.oneOf("BoardVisibility", l.optional("BoardVisibility", "public"),
+		"public", "members", "private")
+
+	w.SMTPHost = l.optional("SMTPHost", "")
+	w.SMTPPort = l.optional("SMTPPort", "587")
+	w.SMTPUser = l.optional("SMTPUser", "")
+	w.SMTPPassword = l.optional("SMTPPassword", "")
+	w.SMTPFrom = l.optional("SMTPFrom", "fahrmarke@localhost")
+	if w.BaseURL = l.optional("BaseURL", ""); w.BaseURL != "" {
+		u, err := url.Parse(w.BaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			l.fail("BaseURL", "expected a URL like https://fahrmarke.example.org, got "+strconv.Quote(w.BaseURL))
+		}
+	}
+	w.Metrics = l.boolean("Metrics", l.optional("Metrics", "false"))
+	return w
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const createAPITokensTable = `
+	CREATE TABLE IF NOT EXISTS API_TOKENS (
+		ID         INTEGER PRIMARY KEY AUTOINCREMENT
+						   NOT NULL,
+		TOKEN_HASH TEXT    UNIQUE
+						   NOT NULL,
+		USER_ID    INTEGER REFERENCES USERS (ID) ON DELETE CASCADE
+						   NOT NULL,
+		NAME       TEXT    NOT NULL DEFAULT (''),
+		CREATED    INTEGER NOT NULL,
+		LAST_USED  INTEGER NOT NULL DEFAULT (0)
+	);
+`
+
+// APIToken authenticates scripts as a user. Only a hash of the token is
+// stored, the plaintext is shown once when it is created.
+type APIToken struct {
+	ID       int    `db:"ID"`
+	UserID   int    `db:"USER_ID"`
+	Name     string `db:"NAME"`
+	Created  int64  `db:"CREATED"`
+	LastUsed int64  `db:"LAST_USED"`
+}
+
+func CreateAPIToken(userid int, name string, tokenHash string) (APIToken, error) {
+	token := APIToken{UserID: userid, Name: name, Created: time.Now().Unix()}
+	result, err := db.Exec("INSERT INTO API_TOKENS (TOKEN_HASH, USER_ID, NAME, CREATED) VALUES (?, ?, ?, ?)",
+		tokenHash, token.UserID, token.Name, token.Created)
+	if err != nil {
+		return token, errors.New("Failed to create API token: " + err.Error())
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return token, errors.New("Failed to create API token: " + err.Error())
+	}
+	token.ID = int(id)
+	return token, nil
+}
+
+// ValidateAPIToken returns the owner of the token with the given hash and
+// records the use. It returns ErrNotFound for unknown or revoked tokens.
+func ValidateAPIToken(tokenHash string, now time.Time) (int, error) {
+	var userid int
+	err := db.Get(&userid, "UPDATE API_TOKENS SET LAST_USED = ? WHERE TOKEN_HASH = ? RETURNING USER_ID", now.Unix(), tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, errors.New("Failed to validate API token: " + err.Error())
+	}
+	return userid, nil
+}
+
+// GetUserAPITokens returns the tokens of the user, newest first.
+func GetUserAPITokens(userid int) ([]APIToken, error) {
+	tokens := []APIToken{}
+	err := db.Select(&tokens, "SELECT ID, USER_ID, NAME, CREATED, LAST_USED FROM API_TOKENS WHERE USER_ID = ? ORDER BY ID DESC", userid)
+	if err != nil {
+		return nil, errors.New("Failed to get API tokens: " + err.Error())
+	}
+	return tokens, nil
+}
+
+// DeleteAPIToken revokes a token of the user. It returns ErrNotFound if the
+// user has no token with that ID.
+func DeleteAPIToken(userid int, id int) error {
+	result, err := db.Exec("DELETE FROM API_TOKENS WHERE ID = ? AND USER_ID = ?", id, userid)
+	if err != nil {
+		return errors.New("Failed to delete API token: " + err.Error())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.New("Failed to delete API token: " + err.Error())
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAPITokenLifecycle(t *testing.T) {
+	openTestDB(t)
+	userID, err := CreateUser("alice", "hash", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := CreateAPIToken(userID, "script", "tokenhash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := time.Unix(1700000000, 0)
+	if owner, err := ValidateAPIToken("tokenhash", used); err != nil || owner != userID {
+		t.Fatalf("validate: got user %d, %v", owner, err)
+	}
+	if _, err := ValidateAPIToken("otherhash", used); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown token: got %v, want ErrNotFound", err)
+	}
+	tokens, err := GetUserAPITokens(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].ID != token.ID || tokens[0].Name != "script" || tokens[0].LastUsed != used.Unix() {
+		t.Fatalf("got tokens %+v", tokens)
+	}
+
+	if err := DeleteAPIToken(userID+1, token.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoking another user's token: got %v, want ErrNotFound", err)
+	}
+	if err := DeleteAPIToken(userID, token.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ValidateAPIToken("tokenhash", used); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoked token: got %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Attribute is a definition in the shared attribute vocabulary. Admins
+// define which attributes exist, members only fill in their values;
+// SetUserAttribute does not create unknown names.
+type Attribute struct {
+	ID   int    `db:"ID" json:"-"`
+	Name string `db:"Name" json:"name"`
+	// Required attributes must be filled in at registration
+	Required bool `db:"REQUIRED" json:"required"`
+}
+
+func GetAttributes() ([]Attribute, error) {
+	attributes := []Attribute{}
+	err := db.Select(&attributes, "SELECT ID, Name, REQUIRED FROM USER_ATTRIBUTES ORDER BY Name")
+	if err != nil {
+		return nil, errors.New("Failed to get attributes: " + err.Error())
+	}
+	return attributes, nil
+}
+
+// ErrUnknownAttribute is returned when setting an attribute that has not been
+// created.
+var ErrUnknownAttribute = errors.New("unknown attribute")
+
+func CreateAttribute(name string) (int, error) {
+	if name == "" {
+		return 0, errors.New("attribute name must not be empty")
+	}
+	result, err := db.Exec("INSERT INTO USER_ATTRIBUTES (Name) VALUES (?)", name)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, ErrDuplicate
+		}
+		return 0, errors.New("Failed to create attribute: " + err.Error())
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, errors.New("Failed to retrieve new attribute ID: " + err.Error())
+	}
+	return int(id), nil
+}
+
+func GetRequiredAttributes() ([]string, error) {
+	var names []string
+	err := db.Select(&names, "SELECT Name FROM USER_ATTRIBUTES WHERE REQUIRED = 1 ORDER BY Name")
+	if err != nil {
+		return nil, errors.New("Failed to get required attributes: " + err.Error())
+	}
+	return names, nil
+}
+
+func SetAttributeRequired(name string, required bool) error {
+	result, err := db.Exec("UPDATE USER_ATTRIBUTES SET REQUIRED = ? WHERE Name = ?", required, name)
+	if err != nil {
+		return errors.New("Failed to set attribute required: " + err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// MissingRequiredAttributes returns the required attributes the user has no
+// non-empty value for.
+func MissingRequiredAttributes(userid int) ([]string, error) {
+	var names []string
+	err := db.Select(&names, `SELECT UA.Name FROM USER_ATTRIBUTES UA
+		LEFT JOIN USER_HAS_ATTRIBUTES UHA ON UHA.ATTRIBUTE_ID = UA.ID AND UHA.USER_ID = ?
+		WHERE UA.REQUIRED = 1 AND COALESCE(UHA.VALUE, '') = ''
+		ORDER BY UA.Name`, userid)
+	if err != nil {
+		return nil, errors.New("Failed to get missing attributes: " + err.Error())
+	}
+	return names, nil
+}
+
+// CreateUserWithAttributes creates the user and sets its attributes in one
+// transaction, so no account exists without them.
+func CreateUserWithAttributes(username string, password string, admin int, attributes map[string]string) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	id, err := createUser(tx, username, password, admin)
+	if err != nil {
+		return 0, err
+	}
+	for name, value := range attributes {
+		if err := setUserAttribute(tx, id, name, value); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.New("Failed to commit user: " + err.Error())
+	}
+	return id, nil
+}
+
+func setUserAttribute(ex sqlx.Ext, userid int, name string, value string) error {
+	var attributeID int
+	err := sqlx.Get(ex, &attributeID, "SELECT ID FROM USER_ATTRIBUTES WHERE Name = ?", name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUnknownAttribute
+	}
+	if err != nil {
+		return errors.New("Failed to get attribute: " + err.Error())
+	}
+	_, err = ex.Exec("INSERT OR REPLACE INTO USER_HAS_ATTRIBUTES (ATTRIBUTE_ID, USER_ID, VALUE) VALUES (?, ?, ?)", attributeID, userid, value)
+	if err != nil {
+		return errors.New("Failed to set user attribute: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCreateAttributeThenSet(t *testing.T) {
+	openTestDB(t)
+	userID, err := CreateUser("alice", "hash", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserAttribute(userID, "Member number", "42"); !errors.Is(err, ErrUnknownAttribute) {
+		t.Errorf("setting an unknown attribute: got %v, want ErrUnknownAttribute", err)
+	}
+
+	if _, err := CreateAttribute("Member number"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateAttribute("Member number"); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("second create: got %v, want ErrDuplicate", err)
+	}
+	for _, v := range []string{"42", "43"} {
+		if err := SetUserAttribute(userID, "Member number", v); err != nil {
+			t.Fatal(err)
+		}
+		attrs, err := GetUserAttributes(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs["Member number"] != v {
+			t.Errorf("got attributes %v, want Member number %s", attrs, v)
+		}
+	}
+}
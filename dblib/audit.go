@@ -0,0 +1,38 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+const createAuditLogTable = `
+	CREATE TABLE IF NOT EXISTS AUDIT_LOG (
+		ID        INTEGER PRIMARY KEY AUTOINCREMENT
+						  NOT NULL,
+		TS        INTEGER NOT NULL,
+		ACTOR_ID  INTEGER NOT NULL,
+		TARGET_ID INTEGER,
+		ACTION    TEXT    NOT NULL,
+		DETAIL    TEXT
+	);
+`
+
+// AuditEntry is a single security relevant action, e.g. an admin acting on
+// behalf of another user.
+type AuditEntry struct {
+	ID       int    `db:"ID" json:"id"`
+	TS       int64  `db:"TS" json:"ts"`
+	ActorID  int    `db:"ACTOR_ID" json:"actor_id"`
+	TargetID int    `db:"TARGET_ID" json:"target_id"`
+	Action   string `db:"ACTION" json:"action"`
+	Detail   string `db:"DETAIL" json:"detail"`
+}
+
+func AddAuditLog(actorID int, targetID int, action string, detail string) error {
+	_, err := db.Exec("INSERT INTO AUDIT_LOG (TS, ACTOR_ID, TARGET_ID, ACTION, DETAIL) VALUES (?, ?, ?, ?, ?)",
+		time.Now().Unix(), actorID, targetID, action, detail)
+	if err != nil {
+		return errors.New("Failed to write audit log: " + err.Error())
+	}
+	return nil
+}
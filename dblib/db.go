@@ -4,29 +4,63 @@ import (
 	"database/sql"
 	"errors"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
-
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 var db *sqlx.DB
 
+// ErrDuplicate is returned when an insert collides with a unique constraint,
+// e.g. a username that has been taken by a concurrent registration.
+var ErrDuplicate = errors.New("duplicate entry")
+
+// ErrNotFound is returned when an update or delete did not match any row.
+var ErrNotFound = errors.New("not found")
+
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+		sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
+
 func InitDB(dbpath string) error {
 	var err error
 
-	db, err = sqlx.Open("sqlite3", dbpath)
+	// foreign keys are a per-connection setting in SQLite, only the DSN
+	// enables them on every connection of the pool
+	dsn := dbpath + "?_foreign_keys=on"
+	if strings.Contains(dbpath, "?") {
+		dsn = dbpath + "&_foreign_keys=on"
+	}
+	db, err = sqlx.Open("sqlite3", dsn)
 	if err != nil {
 		return errors.New("Failed to open database: " + err.Error())
 	}
+	var foreignKeys int
+	if err := db.Get(&foreignKeys, "PRAGMA foreign_keys"); err != nil {
+		return errors.New("Failed to check foreign keys: " + err.Error())
+	}
+	if foreignKeys != 1 {
+		// e.g. a driver ignoring the DSN option, deletes would leave orphans
+		return errors.New("Foreign keys are not enforced on the database connection")
+	}
 
 	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type='table' AND name='SETTINGS';", nil)
 	if err != nil {
 		return errors.New("Failed to query database: " + err.Error())
 	}
-	defer rows.Close()
+	// close right away, an open cursor keeps the database locked for the
+	// migrations below
+	exists := rows.Next()
+	rows.Close()
 
-	if !rows.Next() {
+	if !exists {
 		log.Println("Settings table not found, creating database")
 		err = createSchema()
 		if err != nil {
@@ -34,7 +68,7 @@ func InitDB(dbpath string) error {
 		}
 	}
 
-	return nil
+	return migrate()
 }
 
 func createSchema() error {
@@ -118,8 +152,8 @@ func createSchema() error {
 										''
 									);
 
-				-- Table: USER
-				CREATE TABLE USER (
+				-- Table: USERS
+				CREATE TABLE USERS (
 					ID       INTEGER     PRIMARY KEY AUTOINCREMENT
 										NOT NULL,
 					USERNAME TEXT        NOT NULL
@@ -129,7 +163,7 @@ func createSchema() error {
 					ADMIN    INTEGER (1) NOT NULL DEFAULT (0) 
 				);
 
-				INSERT INTO USER (
+				INSERT INTO USERS (
 									ID,
 									USERNAME,
 									PASSWORD,
@@ -157,7 +191,7 @@ func createSchema() error {
 					ATTRIBUTE_ID INTEGER REFERENCES USER_ATTRIBUTES (ID) ON DELETE CASCADE
 																		ON UPDATE CASCADE
 										NOT NULL,
-					USER_ID      INTEGER REFERENCES USER (ID) ON DELETE CASCADE
+					USER_ID      INTEGER REFERENCES USERS (ID) ON DELETE CASCADE
 															ON UPDATE CASCADE
 										NOT NULL,
 					VALUE        TEXT    NOT NULL,
@@ -169,8 +203,9 @@ func createSchema() error {
 
 				-- Table: DEVICES
 				CREATE TABLE DEVICES (
-					MACADDRESS TEXT (64) PRIMARY KEY
+					ID         INTEGER   PRIMARY KEY AUTOINCREMENT
 										NOT NULL,
+					MACADDRESS TEXT (64) NOT NULL,
 					SALT       TEXT (16) NOT NULL,
 					DEVICENAME,
 					USER_ID              REFERENCES USERS (ID) ON DELETE CASCADE
@@ -178,10 +213,10 @@ func createSchema() error {
 										NOT NULL
 				);
 
-
-				-- Index: sqlite_autoindex_DEVICES_1
-				CREATE UNIQUE INDEX sqlite_autoindex_DEVICES_1 ON DEVICES (
-					MACADDRESS COLLATE BINARY
+				-- Index: DEVICES_USER_MAC
+				CREATE UNIQUE INDEX DEVICES_USER_MAC ON DEVICES (
+					USER_ID,
+					MACADDRESS
 				);
 
 				COMMIT TRANSACTION;
@@ -202,6 +237,15 @@ func CloseDB() error {
 	return nil
 }
 
+// Ping checks that the database is reachable.
+func Ping() error {
+	var one int
+	if err := db.Get(&one, "SELECT 1"); err != nil {
+		return errors.New("Failed to ping database: " + err.Error())
+	}
+	return nil
+}
+
 func GetSetting(key string) (string, error) {
 	var value string
 	err := db.Get(&value, "SELECT VALUE FROM SETTINGS WHERE KEY = ?", key)
@@ -211,12 +255,66 @@ func GetSetting(key string) (string, error) {
 	return value, nil
 }
 
+// GetSettingDefault behaves like GetSetting but returns fallback if the key
+// does not exist, so optional settings don't need a row in older databases.
+func GetSettingDefault(key string, fallback string) (string, error) {
+	var value string
+	err := db.Get(&value, "SELECT VALUE FROM SETTINGS WHERE KEY = ?", key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fallback, nil
+	}
+	if err != nil {
+		return "", errors.New("Failed to get setting: " + err.Error())
+	}
+	return value, nil
+}
+
+// GetAllSettings returns every row of SETTINGS.
+func GetAllSettings() (map[string]string, error) {
+	var rows []struct {
+		Key   string `db:"KEY"`
+		Value string `db:"VALUE"`
+	}
+	if err := db.Select(&rows, "SELECT KEY, VALUE FROM SETTINGS"); err != nil {
+		return nil, errors.New("Failed to get settings: " + err.Error())
+	}
+	settings := make(map[string]string, len(rows))
+	for _, r := range rows {
+		settings[r.Key] = r.Value
+	}
+	return settings, nil
+}
+
+// ErrEmptyKey is returned when writing a setting without a key.
+var ErrEmptyKey = errors.New("setting key must not be empty")
+
+func SetSetting(key string, value string) error {
+	if strings.TrimSpace(key) == "" {
+		return ErrEmptyKey
+	}
+	_, err := db.Exec("INSERT INTO SETTINGS (KEY, VALUE) VALUES (?, ?) ON CONFLICT(KEY) DO UPDATE SET VALUE = excluded.VALUE", key, value)
+	if err != nil {
+		return errors.New("Failed to set setting: " + err.Error())
+	}
+	return nil
+}
+
+func DeleteSetting(key string) error {
+	_, err := db.Exec("DELETE FROM SETTINGS WHERE KEY = ?", key)
+	if err != nil {
+		return errors.New("Failed to delete setting: " + err.Error())
+	}
+	return nil
+}
+
 type User struct {
 	ID       int            `db:"ID" json:"id"`
 	Username string         `db:"USERNAME" json:"username"`
 	Showname sql.NullString `db:"SHOWNAME" json:"showname"`
 	Password string         `db:"PASSWORD" json:"-"`
 	Admin    int            `db:"ADMIN" json:"-"`
+	// Hidden users are left out of the board and name lists
+	Hidden bool `db:"HIDDEN" json:"-"`
 }
 
 func (u *User) GetShowname() string {
@@ -230,8 +328,15 @@ func (u *User) GetShowname() string {
 }
 
 func CreateUser(username string, password string, admin int) (int, error) {
-	result, err := db.Exec("INSERT INTO USERS (USERNAME, PASSWORD, ADMIN) VALUES (?, ?, ?)", username, password, admin)
+	return createUser(db, username, password, admin)
+}
+
+func createUser(ex sqlx.Execer, username string, password string, admin int) (int, error) {
+	result, err := ex.Exec("INSERT INTO USERS (USERNAME, PASSWORD, ADMIN) VALUES (?, ?, ?)", username, password, admin)
 	if err != nil {
+		if isUniqueViolation(err) {
+			return 0, ErrDuplicate
+		}
 		return 0, errors.New("Failed to create user: " + err.Error())
 	}
 	id, err := result.LastInsertId()
@@ -243,16 +348,51 @@ func CreateUser(username string, password string, admin int) (int, error) {
 
 func GetUsers() ([]User, error) {
 	var users []User
-	err := db.Select(&users, "SELECT ID, USERNAME, SHOWNAME FROM USERS")
+	err := db.Select(&users, "SELECT ID, USERNAME, SHOWNAME, HIDDEN FROM USERS")
 	if err != nil {
 		return nil, errors.New("Failed to get users: " + err.Error())
 	}
 	return users, nil
 }
 
+// GetUsersAfter returns up to limit users with an ID above after, ordered by
+// ID, for stable paging while users come and go.
+func GetUsersAfter(after int, limit int) ([]User, error) {
+	var users []User
+	err := db.Select(&users, "SELECT ID, USERNAME, SHOWNAME, HIDDEN FROM USERS WHERE ID > ? ORDER BY ID LIMIT ?", after, limit)
+	if err != nil {
+		return nil, errors.New("Failed to get users: " + err.Error())
+	}
+	return users, nil
+}
+
+// GetUsersPage returns up to limit users ordered by ID, skipping offset.
+func GetUsersPage(offset int, limit int) ([]User, error) {
+	var users []User
+	err := db.Select(&users, "SELECT ID, USERNAME, SHOWNAME, HIDDEN FROM USERS ORDER BY ID LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, errors.New("Failed to get users: " + err.Error())
+	}
+	return users, nil
+}
+
+// GetUsersByAttribute returns the users whose attribute name has the given
+// value.
+func GetUsersByAttribute(name string, value string) ([]User, error) {
+	var users []User
+	err := db.Select(&users, `SELECT U.ID, U.USERNAME, U.SHOWNAME, U.HIDDEN FROM USERS U
+		JOIN USER_HAS_ATTRIBUTES UHA ON UHA.USER_ID = U.ID
+		JOIN USER_ATTRIBUTES UA ON UHA.ATTRIBUTE_ID = UA.ID
+		WHERE UA.Name = ? AND UHA.VALUE = ?`, name, value)
+	if err != nil {
+		return nil, errors.New("Failed to get users by attribute: " + err.Error())
+	}
+	return users, nil
+}
+
 func GetUserByID(userid int) (User, error) {
 	var user User
-	err := db.Get(&user, "SELECT ID, USERNAME, SHOWNAME FROM USERS WHERE ID = ?", userid)
+	err := db.Get(&user, "SELECT ID, USERNAME, SHOWNAME, ADMIN, HIDDEN FROM USERS WHERE ID = ?", userid)
 	if err != nil {
 		return User{}, errors.New("Failed to get user by ID: " + err.Error())
 	}
@@ -261,7 +401,7 @@ func GetUserByID(userid int) (User, error) {
 
 func GetUserByUsername(username string) (User, error) {
 	var user User
-	err := db.Get(&user, "SELECT * FROM USERS WHERE USERNAME = ?", username)
+	err := db.Get(&user, "SELECT ID, USERNAME, SHOWNAME, PASSWORD, ADMIN FROM USERS WHERE USERNAME = ?", username)
 	if err != nil {
 		return User{}, errors.New("Failed to get user by username: " + err.Error())
 	}
@@ -295,6 +435,14 @@ func GetUserAttributes(userid int) (map[string]string, error) {
 	return attributes, nil
 }
 
+func SetUserHidden(userid int, hidden bool) error {
+	_, err := db.Exec("UPDATE USERS SET HIDDEN = ? WHERE ID = ?", hidden, userid)
+	if err != nil {
+		return errors.New("Failed to set hidden: " + err.Error())
+	}
+	return nil
+}
+
 func SetUserShowname(userid int, showname string) error {
 	_, err := db.Exec("UPDATE USERS SET SHOWNAME = ? WHERE ID = ?", showname, userid)
 	if err != nil {
@@ -304,29 +452,33 @@ func SetUserShowname(userid int, showname string) error {
 }
 
 func SetUserAttribute(userid int, name string, value string) error {
-	var attributeID int
-	err := db.Get(&attributeID, "SELECT ID FROM USER_ATTRIBUTES WHERE Name = ?", name)
-	if err != nil {
-		return errors.New("Attribute not found: " + err.Error())
-	}
-	_, err = db.Exec("INSERT OR REPLACE INTO USER_HAS_ATTRIBUTES (ATTRIBUTE_ID, USER_ID, VALUE) VALUES (?, ?, ?)", attributeID, userid, value)
-	if err != nil {
-		return errors.New("Failed to set user attribute: " + err.Error())
-	}
-	return nil
+	return setUserAttribute(db, userid, name, value)
 }
 
 type Device struct {
+	ID           int            `db:"ID" json:"id"`
 	UserID       int            `db:"USER_ID" json:"-"`
 	MACAddress   string         `db:"MACADDRESS" json:"macaddress"`
 	DeviceNameDB sql.NullString `db:"DEVICENAME" json:"-"`
 	DeviceName   string         `json:"devicename"`
 	Salt         string         `db:"SALT" json:"-"`
+	Added        sql.NullInt64  `db:"ADDED" json:"-"`
+	LastSeen     sql.NullInt64  `db:"LAST_SEEN" json:"-"`
+	// CountsPresence is false for always-on devices that should not make
+	// their owner appear present
+	CountsPresence bool `db:"COUNTS_PRESENCE" json:"counts_presence"`
+	// HashScheme is the MAC hash construction MACADDRESS was made with
+	HashScheme int `db:"HASH_SCHEME" json:"-"`
+	// HashIterations is the iteration count MACADDRESS was made with
+	HashIterations int `db:"HASH_ITERATIONS" json:"-"`
+	// NeedsReregister is set when the hash is outdated and the owner was asked
+	// to add the device again
+	NeedsReregister bool `db:"NEEDS_REREGISTER" json:"needs_reregister"`
 }
 
 func GetUserDevices(userid int) ([]Device, error) {
 	var devices []Device
-	err := db.Select(&devices, "SELECT MACAddress, DeviceName FROM DEVICES WHERE USER_ID = ?", userid)
+	err := db.Select(&devices, "SELECT ID, MACADDRESS, DEVICENAME, SALT, ADDED, LAST_SEEN, COUNTS_PRESENCE, HASH_SCHEME, HASH_ITERATIONS, NEEDS_REREGISTER FROM DEVICES WHERE USER_ID = ?", userid)
 	if err != nil {
 		return nil, errors.New("Failed to get user devices: " + err.Error())
 	}
@@ -340,36 +492,135 @@ func GetUserDevices(userid int) ([]Device, error) {
 
 func GetDevicesSparse() ([]Device, error) {
 	var devices []Device
-	err := db.Select(&devices, "SELECT USER_ID, MACAddress, SALT FROM DEVICES")
+	err := db.Select(&devices, "SELECT ID, USER_ID, MACADDRESS, SALT, COUNTS_PRESENCE, HASH_SCHEME, HASH_ITERATIONS FROM DEVICES")
 	if err != nil {
 		return nil, errors.New("Failed to get devices: " + err.Error())
 	}
 	return devices, nil
 }
 
-func AddOrUpdateDevice(userid int, macaddress string, devicename string, salt string) error {
-	var deviceID int
-	err := db.Get(&deviceID, "SELECT ID FROM DEVICES WHERE MACADDRESS = ? AND USER_ID = ?", macaddress, userid)
+// AddOrUpdateDevice adds the device, or renames it if the user already has
+// one with that hash. It reports whether a new device was added.
+func AddOrUpdateDevice(userid int, macaddress string, devicename string, salt string, scheme int, iterations int) (bool, error) {
+	tx, err := db.Beginx()
 	if err != nil {
-		// Device does not exist, insert new
-		_, err = db.Exec("INSERT INTO DEVICES (USER_ID, MACADDRESS, DEVICENAME, SALT) VALUES (?, ?, ?, ?)", userid, macaddress, devicename, salt)
+		return false, errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("UPDATE DEVICES SET DEVICENAME = ? WHERE USER_ID = ? AND MACADDRESS = ?", devicename, userid, macaddress)
+	if err != nil {
+		return false, errors.New("Failed to update device: " + err.Error())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.New("Failed to update device: " + err.Error())
+	}
+	created := n == 0
+	if created {
+		_, err = tx.Exec("INSERT INTO DEVICES (USER_ID, MACADDRESS, DEVICENAME, SALT, ADDED, HASH_SCHEME, HASH_ITERATIONS) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			userid, macaddress, devicename, salt, time.Now().Unix(), scheme, iterations)
 		if err != nil {
-			return errors.New("Failed to add device: " + err.Error())
+			return false, errors.New("Failed to add device: " + err.Error())
 		}
-	} else {
-		// Device exists, update
-		_, err = db.Exec("UPDATE DEVICES SET DEVICENAME = ? WHERE ID = ?", devicename, deviceID)
-		if err != nil {
-			return errors.New("Failed to update device: " + err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return false, errors.New("Failed to commit device: " + err.Error())
+	}
+	return created, nil
+}
+
+// RenameDevice only changes the display name, the hashed MAC and salt stay untouched.
+func RenameDevice(userid int, deviceid int, devicename string) error {
+	result, err := db.Exec("UPDATE DEVICES SET DEVICENAME = ? WHERE ID = ? AND USER_ID = ?", devicename, deviceid, userid)
+	if err != nil {
+		return errors.New("Failed to rename device: " + err.Error())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.New("Failed to rename device: " + err.Error())
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func GetUserDevice(userid int, deviceid int) (Device, error) {
+	var device Device
+	err := db.Get(&device, "SELECT ID, USER_ID, MACADDRESS, DEVICENAME, SALT, ADDED, LAST_SEEN, COUNTS_PRESENCE, HASH_SCHEME, HASH_ITERATIONS, NEEDS_REREGISTER FROM DEVICES WHERE ID = ? AND USER_ID = ?", deviceid, userid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return device, ErrNotFound
+	}
+	if err != nil {
+		return device, errors.New("Failed to get device: " + err.Error())
+	}
+	if device.DeviceNameDB.Valid {
+		device.DeviceName = device.DeviceNameDB.String
+	}
+	return device, nil
+}
+
+// UpdateDeviceHash replaces the stored hash and salt of a device.
+func UpdateDeviceHash(userid int, deviceid int, macaddress string, salt string, scheme int, iterations int) error {
+	result, err := db.Exec("UPDATE DEVICES SET MACADDRESS = ?, SALT = ?, HASH_SCHEME = ?, HASH_ITERATIONS = ?, NEEDS_REREGISTER = 0 WHERE ID = ? AND USER_ID = ?", macaddress, salt, scheme, iterations, deviceid, userid)
+	if err != nil {
+		return errors.New("Failed to update device hash: " + err.Error())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.New("Failed to update device hash: " + err.Error())
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func SetDeviceCountsPresence(userid int, deviceid int, counts bool) error {
+	result, err := db.Exec("UPDATE DEVICES SET COUNTS_PRESENCE = ? WHERE ID = ? AND USER_ID = ?", counts, deviceid, userid)
+	if err != nil {
+		return errors.New("Failed to update device: " + err.Error())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return errors.New("Failed to update device: " + err.Error())
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// TouchDevices sets the last seen time of the given devices.
+func TouchDevices(deviceIDs []int, seen time.Time) error {
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+	defer beginBatch()()
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	for _, id := range deviceIDs {
+		if _, err := tx.Exec("UPDATE DEVICES SET LAST_SEEN = ? WHERE ID = ?", seen.Unix(), id); err != nil {
+			return errors.New("Failed to update device last seen: " + err.Error())
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to commit device last seen: " + err.Error())
+	}
 	return nil
 }
 
-func DeleteDevice(userid int, macaddress string) error {
-	_, err := db.Exec("DELETE FROM DEVICES WHERE MACADDRESS = ? AND USER_ID = ?", macaddress, userid)
+// DeleteUserDevice deletes a device by ID, only if it belongs to the user.
+func DeleteUserDevice(userid int, deviceid int) error {
+	result, err := db.Exec("DELETE FROM DEVICES WHERE ID = ? AND USER_ID = ?", deviceid, userid)
 	if err != nil {
 		return errors.New("Failed to delete device: " + err.Error())
 	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
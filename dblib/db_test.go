@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestCreateUserDuplicate(t *testing.T) {
+	openTestDB(t)
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = CreateUser("racer", "hash", 0)
+		}()
+	}
+	wg.Wait()
+	var created, duplicates int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case errors.Is(err, ErrDuplicate):
+			duplicates++
+		default:
+			t.Fatal(err)
+		}
+	}
+	if created != 1 || duplicates != 1 {
+		t.Errorf("got errors %v, want one success and one ErrDuplicate", errs)
+	}
+}
+
+func TestCreateUserRoundTrip(t *testing.T) {
+	openTestDB(t)
+	id, err := CreateUser("alice", "hash", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != id || u.Username != "alice" || u.Password != "hash" || u.Admin != 1 {
+		t.Errorf("got %+v, want user %d alice", u, id)
+	}
+	users, err := GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, u := range users {
+		found = found || u.ID == id
+	}
+	if !found {
+		t.Errorf("user %d missing from GetUsers %+v", id, users)
+	}
+}
+
+func TestAddOrUpdateDeviceRenames(t *testing.T) {
+	openTestDB(t)
+	userID, err := CreateUser("alice", "hash", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := AddOrUpdateDevice(userID, "machash", "laptop", "salt", 1, 1000)
+	if err != nil || !created {
+		t.Fatalf("first add: created %v, err %v", created, err)
+	}
+	created, err = AddOrUpdateDevice(userID, "machash", "work laptop", "salt", 1, 1000)
+	if err != nil || created {
+		t.Fatalf("second add: created %v, err %v", created, err)
+	}
+	devices, err := GetUserDevices(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("got %d devices, want 1", len(devices))
+	}
+	if devices[0].DeviceName != "work laptop" {
+		t.Errorf("got name %q, want the new one", devices[0].DeviceName)
+	}
+}
+
+func TestSetSetting(t *testing.T) {
+	openTestDB(t)
+	for _, v := range []string{"eth1", "eth2"} {
+		if err := SetSetting("Interface", v); err != nil {
+			t.Fatal(err)
+		}
+		got, err := GetSetting("Interface")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != v {
+			t.Errorf("got %q, want %q", got, v)
+		}
+	}
+	all, err := GetAllSettings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all["Interface"] != "eth2" {
+		t.Errorf("GetAllSettings has Interface %q", all["Interface"])
+	}
+	if err := SetSetting(" ", "x"); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("empty key: got %v, want ErrEmptyKey", err)
+	}
+}
+
+func TestForeignKeysCascade(t *testing.T) {
+	openTestDB(t)
+	userID, err := CreateUser("alice", "hash", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddOrUpdateDevice(userID, "machash", "phone", "salt", 1, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddOrUpdateDevice(userID+1, "otherhash", "phone", "salt", 1, 1000); err == nil {
+		t.Error("added a device for a user that doesn't exist")
+	}
+
+	// delete the row itself, not through DeleteUser, to see what SQLite does
+	if _, err := db.Exec("DELETE FROM USERS WHERE ID = ?", userID); err != nil {
+		t.Fatal(err)
+	}
+	var devices int
+	if err := db.Get(&devices, "SELECT COUNT(*) FROM DEVICES WHERE USER_ID = ?", userID); err != nil {
+		t.Fatal(err)
+	}
+	if devices != 0 {
+		t.Errorf("%d device rows left after deleting their user", devices)
+	}
+}
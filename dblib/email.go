@@ -0,0 +1,115 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const createEmailVerificationsTable = `
+	CREATE TABLE IF NOT EXISTS EMAIL_VERIFICATIONS (
+		TOKEN_HASH TEXT    PRIMARY KEY
+						   NOT NULL,
+		USER_ID    INTEGER REFERENCES USERS (ID) ON DELETE CASCADE
+						   NOT NULL,
+		EMAIL      TEXT    NOT NULL,
+		EXPIRES    INTEGER NOT NULL
+	);
+`
+
+// ErrNotVerified is returned for users whose email is missing or unconfirmed.
+var ErrNotVerified = errors.New("email not verified")
+
+// GetUserEmail returns the stored email of the user and whether it has been
+// verified. The email is empty if none is set.
+func GetUserEmail(userid int) (string, bool, error) {
+	var row struct {
+		Email    sql.NullString `db:"EMAIL"`
+		Verified bool           `db:"EMAIL_VERIFIED"`
+	}
+	err := db.Get(&row, "SELECT EMAIL, EMAIL_VERIFIED FROM USERS WHERE ID = ?", userid)
+	if err != nil {
+		return "", false, errors.New("Failed to get email: " + err.Error())
+	}
+	return row.Email.String, row.Verified, nil
+}
+
+// GetVerifiedEmail returns the email of the user for features that may only
+// use confirmed addresses.
+func GetVerifiedEmail(userid int) (string, error) {
+	email, verified, err := GetUserEmail(userid)
+	if err != nil {
+		return "", err
+	}
+	if email == "" || !verified {
+		return "", ErrNotVerified
+	}
+	return email, nil
+}
+
+// SetUserEmail stores a new, unverified email and drops pending verifications.
+func SetUserEmail(userid int, email string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE USERS SET EMAIL = NULLIF(?, ''), EMAIL_VERIFIED = 0 WHERE ID = ?", email, userid); err != nil {
+		return errors.New("Failed to set email: " + err.Error())
+	}
+	if _, err := tx.Exec("DELETE FROM EMAIL_VERIFICATIONS WHERE USER_ID = ?", userid); err != nil {
+		return errors.New("Failed to drop pending verifications: " + err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to set email: " + err.Error())
+	}
+	return nil
+}
+
+func AddEmailVerification(userid int, email string, tokenHash string, expires time.Time) error {
+	_, err := db.Exec("INSERT INTO EMAIL_VERIFICATIONS (TOKEN_HASH, USER_ID, EMAIL, EXPIRES) VALUES (?, ?, ?, ?)",
+		tokenHash, userid, email, expires.Unix())
+	if err != nil {
+		return errors.New("Failed to store email verification: " + err.Error())
+	}
+	return nil
+}
+
+// VerifyEmail confirms the email the token was issued for, provided the token
+// has not expired and the user has not changed the address since.
+func VerifyEmail(tokenHash string) (int, error) {
+	var row struct {
+		UserID  int    `db:"USER_ID"`
+		Email   string `db:"EMAIL"`
+		Expires int64  `db:"EXPIRES"`
+	}
+	err := db.Get(&row, "SELECT USER_ID, EMAIL, EXPIRES FROM EMAIL_VERIFICATIONS WHERE TOKEN_HASH = ?", tokenHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, errors.New("Failed to get email verification: " + err.Error())
+	}
+	if time.Now().Unix() > row.Expires {
+		return 0, ErrNotFound
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec("UPDATE USERS SET EMAIL_VERIFIED = 1 WHERE ID = ? AND EMAIL = ?", row.UserID, row.Email)
+	if err != nil {
+		return 0, errors.New("Failed to verify email: " + err.Error())
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return 0, ErrNotFound
+	}
+	if _, err := tx.Exec("DELETE FROM EMAIL_VERIFICATIONS WHERE USER_ID = ?", row.UserID); err != nil {
+		return 0, errors.New("Failed to drop verifications: " + err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.New("Failed to verify email: " + err.Error())
+	}
+	return row.UserID, nil
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"errors"
+)
+
+// DeviceHashUpgrade is a device hash re-computed under a newer scheme or
+// iteration count.
+type DeviceHashUpgrade struct {
+	ID         int
+	MACAddress string
+	Scheme     int
+	Iterations int
+}
+
+// UpgradeDeviceHashes stores re-computed hashes in one transaction and clears
+// the re-registration flag of the upgraded devices.
+func UpgradeDeviceHashes(upgrades []DeviceHashUpgrade) error {
+	defer beginBatch()()
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	for _, u := range upgrades {
+		_, err := tx.Exec("UPDATE DEVICES SET MACADDRESS = ?, HASH_SCHEME = ?, HASH_ITERATIONS = ?, NEEDS_REREGISTER = 0 WHERE ID = ?", u.MACAddress, u.Scheme, u.Iterations, u.ID)
+		if err != nil {
+			return errors.New("Failed to upgrade device hash: " + err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to commit device hashes: " + err.Error())
+	}
+	return nil
+}
+
+// GetOutdatedDevices returns the devices hashed with a scheme older than
+// scheme.
+func GetOutdatedDevices(scheme int) ([]Device, error) {
+	var devices []Device
+	err := db.Select(&devices, "SELECT ID, USER_ID, HASH_SCHEME, NEEDS_REREGISTER FROM DEVICES WHERE HASH_SCHEME < ?", scheme)
+	if err != nil {
+		return nil, errors.New("Failed to get outdated devices: " + err.Error())
+	}
+	return devices, nil
+}
+
+// MarkDevicesForReregistration flags the devices in one transaction so their
+// owners are asked to add them again.
+func MarkDevicesForReregistration(deviceIDs []int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	for _, id := range deviceIDs {
+		if _, err := tx.Exec("UPDATE DEVICES SET NEEDS_REREGISTER = 1 WHERE ID = ?", id); err != nil {
+			return errors.New("Failed to mark device: " + err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to commit device marks: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+const createOccupancyTable = `
+	CREATE TABLE IF NOT EXISTS OCCUPANCY (
+		TS      INTEGER PRIMARY KEY
+						NOT NULL,
+		PRESENT INTEGER NOT NULL
+	);
+`
+
+// AddOccupancy records how many users were present at a successful scan.
+func AddOccupancy(ts time.Time, present int) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO OCCUPANCY (TS, PRESENT) VALUES (?, ?)", ts.Unix(), present)
+	if err != nil {
+		return errors.New("Failed to add occupancy: " + err.Error())
+	}
+	return nil
+}
+
+// PruneOccupancy deletes all samples older than the given time.
+func PruneOccupancy(before time.Time) error {
+	_, err := db.Exec("DELETE FROM OCCUPANCY WHERE TS < ?", before.Unix())
+	if err != nil {
+		return errors.New("Failed to prune occupancy: " + err.Error())
+	}
+	return nil
+}
+
+// OccupancyBucket aggregates the samples of one time bucket.
+type OccupancyBucket struct {
+	Start   int64   `db:"BUCKET" json:"start"`
+	Max     int     `db:"MAX_PRESENT" json:"max"`
+	Avg     float64 `db:"AVG_PRESENT" json:"avg"`
+	Samples int     `db:"SAMPLES" json:"samples"`
+}
+
+// GetOccupancyBuckets groups the samples in [from, to) into buckets of the
+// given width in seconds, starting at the bucket after, oldest first.
+func GetOccupancyBuckets(from, to, width, after int64, limit int) ([]OccupancyBucket, error) {
+	buckets := []OccupancyBucket{}
+	err := db.Select(&buckets, `SELECT (TS / ?) * ? AS BUCKET, MAX(PRESENT) AS MAX_PRESENT,
+		AVG(PRESENT) AS AVG_PRESENT, COUNT(*) AS SAMPLES
+		FROM OCCUPANCY WHERE TS >= ? AND TS < ?
+		GROUP BY BUCKET HAVING BUCKET > ? ORDER BY BUCKET LIMIT ?`,
+		width, width, from, to, after, limit)
+	if err != nil {
+		return nil, errors.New("Failed to get occupancy history: " + err.Error())
+	}
+	return buckets, nil
+}
+
+// GetOccupancyHighWater returns the time of the newest sample, 0 if none.
+func GetOccupancyHighWater() (int64, error) {
+	var ts int64
+	err := db.Get(&ts, "SELECT COALESCE(MAX(TS), 0) FROM OCCUPANCY")
+	if err != nil {
+		return 0, errors.New("Failed to get occupancy high water mark: " + err.Error())
+	}
+	return ts, nil
+}
@@ -0,0 +1,16 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB initializes a fresh database in a temporary directory and
+// closes it when the test ends.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	if err := InitDB(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { CloseDB() })
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"errors"
+	"sync"
+)
+
+// batchGate lets the per-scan batch writes run alongside each other but not
+// alongside VACUUM, which rewrites the whole file and would stall them.
+var batchGate sync.RWMutex
+
+// beginBatch is taken by batch writers and returns the matching release.
+func beginBatch() func() {
+	batchGate.RLock()
+	return batchGate.RUnlock
+}
+
+// Vacuum rebuilds the database file to reclaim space. It waits for running
+// batch writes and holds new ones back until it is done.
+func Vacuum() error {
+	batchGate.Lock()
+	defer batchGate.Unlock()
+	if _, err := db.Exec("VACUUM"); err != nil {
+		return errors.New("Failed to vacuum database: " + err.Error())
+	}
+	return nil
+}
+
+// IntegrityCheck runs PRAGMA integrity_check and returns the problems found,
+// none for a healthy database.
+func IntegrityCheck() ([]string, error) {
+	var rows []string
+	if err := db.Select(&rows, "PRAGMA integrity_check"); err != nil {
+		return nil, errors.New("Failed to check database: " + err.Error())
+	}
+	if len(rows) == 1 && rows[0] == "ok" {
+		return nil, nil
+	}
+	return rows, nil
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migration upgrades the schema to version. Migrations should be idempotent
+// where possible: databases from before SchemaVersion existed start at 0
+// and run all of them, whatever state they are in.
+type migration struct {
+	version int
+	name    string
+	apply   func(tx *sqlx.Tx) error
+}
+
+// migrations are applied in order on every start, each in its own
+// transaction, skipping those at or below the stored SchemaVersion. Never
+// change a released migration, append a new one instead.
+var migrations = []migration{
+	{1, "rename USER to USERS", renameLegacyUserTable},
+	{2, "create tables added after the initial schema", createExtraTables},
+	{3, "add columns added after the initial schema", addExtraColumns},
+	{4, "add DEVICES.ID", addDeviceIDColumn},
+	{5, "add SESSIONS", createTable(createSessionsTable)},
+	{6, "add USER_ATTRIBUTES.REQUIRED", func(tx *sqlx.Tx) error {
+		return addColumnIfMissing(tx, "USER_ATTRIBUTES", "REQUIRED", "INTEGER NOT NULL DEFAULT (0)")
+	}},
+	{7, "add SCAN_LOG", createTable(createScanLogTable)},
+	{8, "add API_TOKENS", createTable(createAPITokensTable)},
+	{9, "add DEVICES.HASH_ITERATIONS", func(tx *sqlx.Tx) error {
+		// every device hashed so far used the former fixed count
+		return addColumnIfMissing(tx, "DEVICES", "HASH_ITERATIONS", "INTEGER NOT NULL DEFAULT (1000)")
+	}},
+	{10, "add PRESENCE_LOG", createTable(createPresenceLogTable)},
+}
+
+// createTable returns a migration running a CREATE TABLE IF NOT EXISTS.
+func createTable(stmt string) func(tx *sqlx.Tx) error {
+	return func(tx *sqlx.Tx) error {
+		if _, err := tx.Exec(stmt); err != nil {
+			return errors.New("Error creating table: " + err.Error())
+		}
+		return nil
+	}
+}
+
+// SchemaVersion returns the version the database was migrated to.
+func SchemaVersion() (int, error) {
+	v, err := GetSettingDefault("SchemaVersion", "0")
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.New("Invalid SchemaVersion setting: " + v)
+	}
+	return n, nil
+}
+
+// migrate applies the pending migrations. Table rebuilds copy rows that may
+// predate foreign key enforcement, so they run with foreign keys off, as the
+// SQLite docs recommend for schema changes.
+func migrate() error {
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return errors.New("Failed to get connection for migrations: " + err.Error())
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return errors.New("Failed to disable foreign keys: " + err.Error())
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := conn.BeginTxx(ctx, nil)
+		if err != nil {
+			return errors.New("Failed to begin migration: " + err.Error())
+		}
+		if err := m.apply(tx); err != nil {
+			tx.Rollback()
+			return errors.New("Migration " + strconv.Itoa(m.version) + " (" + m.name + ") failed: " + err.Error())
+		}
+		_, err = tx.Exec("INSERT INTO SETTINGS (KEY, VALUE) VALUES ('SchemaVersion', ?) ON CONFLICT(KEY) DO UPDATE SET VALUE = excluded.VALUE", strconv.Itoa(m.version))
+		if err != nil {
+			tx.Rollback()
+			return errors.New("Failed to store SchemaVersion: " + err.Error())
+		}
+		if err := tx.Commit(); err != nil {
+			return errors.New("Failed to commit migration: " + err.Error())
+		}
+		log.Println("Migrated database to schema version", m.version, "("+m.name+")")
+		current = m.version
+	}
+	return nil
+}
+
+// renameLegacyUserTable renames the USER table older schemas created to the
+// USERS every query uses. SQLite rewrites the foreign keys pointing at it.
+func renameLegacyUserTable(tx *sqlx.Tx) error {
+	var tables []string
+	err := tx.Select(&tables, "SELECT name FROM sqlite_master WHERE type='table' AND name IN ('USER', 'USERS')")
+	if err != nil {
+		return errors.New("Failed to check user table: " + err.Error())
+	}
+	if len(tables) != 1 || tables[0] != "USER" {
+		return nil
+	}
+	log.Println("Renaming table USER to USERS")
+	if _, err := tx.Exec("ALTER TABLE USER RENAME TO USERS"); err != nil {
+		return errors.New("Failed to rename USER table: " + err.Error())
+	}
+	return nil
+}
+
+// extraTables holds tables added after the initial schema, created with IF
+// NOT EXISTS by migration 2. New tables need a migration of their own.
+var extraTables = []string{
+	createPresenceEventsTable,
+	createTOTPTable,
+	createBackupCodesTable,
+	createAuditLogTable,
+	createUnknownDevicesTable,
+	createEmailVerificationsTable,
+	createPasswordResetsTable,
+	createTagsTable,
+	createUserTagsTable,
+	createPresenceStateTable,
+	createSpaceMetaTable,
+	createOccupancyTable,
+	createShareLinksTable,
+}
+
+func createExtraTables(tx *sqlx.Tx) error {
+	for _, stmt := range extraTables {
+		if _, err := tx.Exec(stmt); err != nil {
+			return errors.New("Error creating table: " + err.Error())
+		}
+	}
+	return nil
+}
+
+type column struct {
+	table      string
+	column     string
+	definition string
+}
+
+// extraColumns are columns added to existing tables after the initial
+// schema, by migration 3. New columns need a migration of their own.
+var extraColumns = []column{
+	{"USERS", "EMAIL", "TEXT"},
+	{"USERS", "EMAIL_VERIFIED", "INTEGER (1) NOT NULL DEFAULT (0)"},
+	{"USERS", "HIDDEN", "INTEGER (1) NOT NULL DEFAULT (0)"},
+	{"DEVICES", "ADDED", "INTEGER"},
+	{"DEVICES", "LAST_SEEN", "INTEGER"},
+	{"DEVICES", "COUNTS_PRESENCE", "INTEGER (1) NOT NULL DEFAULT (1)"},
+	{"DEVICES", "HASH_SCHEME", "INTEGER NOT NULL DEFAULT (1)"},
+	{"DEVICES", "NEEDS_REREGISTER", "INTEGER (1) NOT NULL DEFAULT (0)"},
+}
+
+func addExtraColumns(tx *sqlx.Tx) error {
+	for _, c := range extraColumns {
+		if err := addColumnIfMissing(tx, c.table, c.column, c.definition); err != nil {
+			return errors.New("Error adding column: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing adds the column unless it already exists. Tables that
+// don't exist are left alone.
+func addColumnIfMissing(tx *sqlx.Tx, table string, name string, definition string) error {
+	columns, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return nil
+	}
+	for _, c := range columns {
+		if strings.EqualFold(c, name) {
+			return nil
+		}
+	}
+	log.Println("Adding column " + name + " to " + table)
+	_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + name + " " + definition)
+	return err
+}
+
+// tableColumns returns the column names of table, none if it doesn't exist.
+func tableColumns(tx *sqlx.Tx, table string) ([]string, error) {
+	var columns []string
+	if err := tx.Select(&columns, "SELECT name FROM pragma_table_info(?)", table); err != nil {
+		return nil, errors.New("Failed to get columns of " + table + ": " + err.Error())
+	}
+	return columns, nil
+}
+
+// addDeviceIDColumn rebuilds a DEVICES table keyed by MACADDRESS into one
+// with an ID primary key. The IDs handed out so far were rowids, they are
+// kept so links and presence state stay valid.
+func addDeviceIDColumn(tx *sqlx.Tx) error {
+	columns, err := tableColumns(tx, "DEVICES")
+	if err != nil {
+		return err
+	}
+	for _, c := range columns {
+		if c == "ID" {
+			return nil
+		}
+	}
+	log.Println("Adding column ID to DEVICES")
+	stmts := []string{`CREATE TABLE DEVICES_NEW (
+		ID         INTEGER   PRIMARY KEY AUTOINCREMENT
+							NOT NULL,
+		MACADDRESS TEXT (64) NOT NULL,
+		SALT       TEXT (16) NOT NULL,
+		DEVICENAME,
+		USER_ID              REFERENCES USERS (ID) ON DELETE CASCADE
+												ON UPDATE CASCADE
+							NOT NULL
+	)`}
+	for _, c := range extraColumns {
+		if c.table == "DEVICES" {
+			stmts = append(stmts, "ALTER TABLE DEVICES_NEW ADD COLUMN "+c.column+" "+c.definition)
+		}
+	}
+	list := strings.Join(columns, ", ")
+	stmts = append(stmts,
+		"INSERT INTO DEVICES_NEW (ID, "+list+") SELECT rowid, "+list+" FROM DEVICES",
+		"DROP TABLE DEVICES",
+		"ALTER TABLE DEVICES_NEW RENAME TO DEVICES",
+		"CREATE UNIQUE INDEX DEVICES_USER_MAC ON DEVICES (USER_ID, MACADDRESS)",
+	)
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return errors.New("Failed to add device IDs: " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// v1Schema is the schema the first release created, before SchemaVersion.
+const v1Schema = `
+	CREATE TABLE SETTINGS (
+		KEY   TEXT PRIMARY KEY UNIQUE NOT NULL,
+		VALUE TEXT NOT NULL
+	);
+	INSERT INTO SETTINGS (KEY, VALUE) VALUES ('Range', '192.168.2.0/24'), ('Theme', 'fahrmarke');
+
+	CREATE TABLE USER (
+		ID       INTEGER     PRIMARY KEY AUTOINCREMENT NOT NULL,
+		USERNAME TEXT        NOT NULL UNIQUE,
+		SHOWNAME TEXT,
+		PASSWORD TEXT        NOT NULL,
+		ADMIN    INTEGER (1) NOT NULL DEFAULT (0)
+	);
+
+	CREATE TABLE USER_ATTRIBUTES (
+		ID   INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+		Name TEXT    NOT NULL UNIQUE
+	);
+
+	CREATE TABLE USER_HAS_ATTRIBUTES (
+		ATTRIBUTE_ID INTEGER REFERENCES USER_ATTRIBUTES (ID) ON DELETE CASCADE ON UPDATE CASCADE NOT NULL,
+		USER_ID      INTEGER REFERENCES USER (ID) ON DELETE CASCADE ON UPDATE CASCADE NOT NULL,
+		VALUE        TEXT    NOT NULL,
+		PRIMARY KEY (ATTRIBUTE_ID, USER_ID)
+	);
+
+	CREATE TABLE DEVICES (
+		MACADDRESS TEXT (64) PRIMARY KEY NOT NULL,
+		SALT       TEXT (16) NOT NULL,
+		DEVICENAME,
+		USER_ID              REFERENCES USERS (ID) ON DELETE CASCADE ON UPDATE CASCADE NOT NULL
+	);
+
+	INSERT INTO USER (ID, USERNAME, SHOWNAME, PASSWORD, ADMIN) VALUES (1, 'admin', NULL, 'adminhash', 1), (2, 'alice', 'Alice', 'alicehash', 0);
+	INSERT INTO USER_ATTRIBUTES (ID, Name) VALUES (1, 'Member number');
+	INSERT INTO USER_HAS_ATTRIBUTES (ATTRIBUTE_ID, USER_ID, VALUE) VALUES (1, 2, '42');
+	INSERT INTO DEVICES (MACADDRESS, SALT, DEVICENAME, USER_ID) VALUES ('machash', 'salt', 'phone', 2);
+`
+
+func TestMigrateFromV1(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v1.db")
+	old, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec(v1Schema); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	if err := InitDB(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { CloseDB() })
+
+	v, err := SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := migrations[len(migrations)-1].version; v != want {
+		t.Errorf("got schema version %d, want %d", v, want)
+	}
+	if r, _ := GetSetting("Range"); r != "192.168.2.0/24" {
+		t.Errorf("got Range %q", r)
+	}
+	alice, err := GetUserByUsername("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.ID != 2 || alice.Password != "alicehash" || alice.GetShowname() != "Alice" {
+		t.Errorf("alice changed: %+v", alice)
+	}
+	if admin, err := GetUserByUsername("admin"); err != nil || admin.Admin != 1 {
+		t.Errorf("admin lost: %+v, %v", admin, err)
+	}
+	attrs, err := GetUserAttributes(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs["Member number"] != "42" {
+		t.Errorf("got attributes %v", attrs)
+	}
+	devices, err := GetUserDevices(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].MACAddress != "machash" || devices[0].DeviceName != "phone" || devices[0].ID == 0 {
+		t.Fatalf("got devices %+v", devices)
+	}
+
+	// the migrated foreign keys point at USERS
+	if err := DeleteUser(2); err != nil {
+		t.Fatal(err)
+	}
+	if devices, _ := GetUserDevices(2); len(devices) != 0 {
+		t.Errorf("devices of a deleted user left: %+v", devices)
+	}
+}
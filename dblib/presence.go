@@ -0,0 +1,130 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+const createPresenceEventsTable = `
+	CREATE TABLE IF NOT EXISTS PRESENCE_EVENTS (
+		SEQ     INTEGER PRIMARY KEY AUTOINCREMENT
+						NOT NULL,
+		USER_ID INTEGER NOT NULL,
+		ONLINE  INTEGER (1) NOT NULL,
+		TS      INTEGER NOT NULL
+	);
+`
+
+// PresenceEvent records a single online/offline transition of a user.
+type PresenceEvent struct {
+	Seq    int64 `db:"SEQ" json:"seq"`
+	UserID int   `db:"USER_ID" json:"user_id"`
+	Online bool  `db:"ONLINE" json:"online"`
+	TS     int64 `db:"TS" json:"ts"`
+}
+
+// AddPresenceEvents appends the given transitions in a single transaction.
+func AddPresenceEvents(events []PresenceEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	defer beginBatch()()
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	for _, e := range events {
+		_, err := tx.Exec("INSERT INTO PRESENCE_EVENTS (USER_ID, ONLINE, TS) VALUES (?, ?, ?)", e.UserID, e.Online, e.TS)
+		if err != nil {
+			return errors.New("Failed to add presence event: " + err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to commit presence events: " + err.Error())
+	}
+	return nil
+}
+
+// GetPresenceEventsSince returns up to limit events with a sequence number
+// greater than since, oldest first. Events of hidden users are left out
+// unless they belong to viewerID or includeHidden is set.
+func GetPresenceEventsSince(since int64, limit int, viewerID int, includeHidden bool) ([]PresenceEvent, error) {
+	events := []PresenceEvent{}
+	err := db.Select(&events, `SELECT E.SEQ, E.USER_ID, E.ONLINE, E.TS FROM PRESENCE_EVENTS E
+		JOIN USERS U ON U.ID = E.USER_ID
+		WHERE E.SEQ > ? AND (U.HIDDEN = 0 OR U.ID = ? OR ?)
+		ORDER BY E.SEQ LIMIT ?`, since, viewerID, includeHidden, limit)
+	if err != nil {
+		return nil, errors.New("Failed to get presence events: " + err.Error())
+	}
+	return events, nil
+}
+
+// GetPresenceEventsHighWater returns the highest sequence number written so far.
+func GetPresenceEventsHighWater() (int64, error) {
+	var seq int64
+	err := db.Get(&seq, "SELECT COALESCE(MAX(SEQ), 0) FROM PRESENCE_EVENTS")
+	if err != nil {
+		return 0, errors.New("Failed to get presence event sequence: " + err.Error())
+	}
+	return seq, nil
+}
+
+// PrunePresenceEvents deletes all events older than the given time.
+func PrunePresenceEvents(before time.Time) error {
+	_, err := db.Exec("DELETE FROM PRESENCE_EVENTS WHERE TS < ?", before.Unix())
+	if err != nil {
+		return errors.New("Failed to prune presence events: " + err.Error())
+	}
+	return nil
+}
+
+const createPresenceStateTable = `
+	CREATE TABLE IF NOT EXISTS PRESENCE_STATE (
+		DEVICE_ID INTEGER PRIMARY KEY
+						NOT NULL,
+		USER_ID   INTEGER NOT NULL,
+		LAST_SEEN INTEGER NOT NULL
+	);
+`
+
+// PresenceState is a device that was online in the last successful scan.
+type PresenceState struct {
+	DeviceID int   `db:"DEVICE_ID"`
+	UserID   int   `db:"USER_ID"`
+	LastSeen int64 `db:"LAST_SEEN"`
+}
+
+// SavePresenceState replaces the persisted online set.
+func SavePresenceState(states []PresenceState) error {
+	defer beginBatch()()
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM PRESENCE_STATE"); err != nil {
+		return errors.New("Failed to clear presence state: " + err.Error())
+	}
+	for _, s := range states {
+		_, err := tx.Exec("INSERT INTO PRESENCE_STATE (DEVICE_ID, USER_ID, LAST_SEEN) VALUES (?, ?, ?)", s.DeviceID, s.UserID, s.LastSeen)
+		if err != nil {
+			return errors.New("Failed to save presence state: " + err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to commit presence state: " + err.Error())
+	}
+	return nil
+}
+
+// GetPresenceState returns the persisted devices last seen after since.
+func GetPresenceState(since time.Time) ([]PresenceState, error) {
+	states := []PresenceState{}
+	err := db.Select(&states, "SELECT DEVICE_ID, USER_ID, LAST_SEEN FROM PRESENCE_STATE WHERE LAST_SEEN > ?", since.Unix())
+	if err != nil {
+		return nil, errors.New("Failed to get presence state: " + err.Error())
+	}
+	return states, nil
+}
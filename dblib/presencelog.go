@@ -0,0 +1,69 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+const createPresenceLogTable = `
+	CREATE TABLE IF NOT EXISTS PRESENCE_LOG (
+		USER_ID     INTEGER REFERENCES USERS (ID) ON DELETE CASCADE
+							NOT NULL,
+		DEVICE_HASH TEXT    NOT NULL,
+		SEEN_AT     INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS PRESENCE_LOG_USER_SEEN ON PRESENCE_LOG (USER_ID, SEEN_AT);
+`
+
+// PresenceSample records that a device of a user was seen by a scan.
+// DeviceHash is the stored MAC hash of the device at that time.
+type PresenceSample struct {
+	UserID     int    `db:"USER_ID"`
+	DeviceHash string `db:"DEVICE_HASH"`
+	SeenAt     int64  `db:"SEEN_AT"`
+}
+
+// AddPresenceSamples appends the given samples in a single transaction.
+// Samples of users deleted in the meantime are skipped, so a buffered batch
+// can always be written.
+func AddPresenceSamples(samples []PresenceSample) error {
+	if len(samples) == 0 {
+		return nil
+	}
+	defer beginBatch()()
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	for _, s := range samples {
+		_, err := tx.Exec("INSERT INTO PRESENCE_LOG (USER_ID, DEVICE_HASH, SEEN_AT) SELECT ?, ?, ? WHERE EXISTS (SELECT 1 FROM USERS WHERE ID = ?)", s.UserID, s.DeviceHash, s.SeenAt, s.UserID)
+		if err != nil {
+			return errors.New("Failed to add presence sample: " + err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to commit presence samples: " + err.Error())
+	}
+	return nil
+}
+
+// PrunePresenceLog deletes all samples older than the given time.
+func PrunePresenceLog(before time.Time) error {
+	_, err := db.Exec("DELETE FROM PRESENCE_LOG WHERE SEEN_AT < ?", before.Unix())
+	if err != nil {
+		return errors.New("Failed to prune presence log: " + err.Error())
+	}
+	return nil
+}
+
+// GetUserPresenceTimes returns the distinct times at which any device of the
+// user was seen since the given time, oldest first.
+func GetUserPresenceTimes(userid int, since time.Time) ([]int64, error) {
+	times := []int64{}
+	err := db.Select(&times, "SELECT DISTINCT SEEN_AT FROM PRESENCE_LOG WHERE USER_ID = ? AND SEEN_AT >= ? ORDER BY SEEN_AT", userid, since.Unix())
+	if err != nil {
+		return nil, errors.New("Failed to get presence log: " + err.Error())
+	}
+	return times, nil
+}
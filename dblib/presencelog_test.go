@@ -0,0 +1,52 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresenceSamplesOfDeletedUsers(t *testing.T) {
+	openTestDB(t)
+	alice, err := CreateUser("alice", "hash", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gone, err := CreateUser("gone", "hash", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(gone); err != nil {
+		t.Fatal(err)
+	}
+
+	err = AddPresenceSamples([]PresenceSample{
+		{UserID: alice, DeviceHash: "a", SeenAt: 100},
+		{UserID: gone, DeviceHash: "b", SeenAt: 100},
+		{UserID: alice, DeviceHash: "c", SeenAt: 100},
+		{UserID: alice, DeviceHash: "a", SeenAt: 200},
+	})
+	if err != nil {
+		t.Fatal("a deleted user failed the batch:", err)
+	}
+	times, err := GetUserPresenceTimes(alice, time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(times) != 2 || times[0] != 100 || times[1] != 200 {
+		t.Errorf("got times %v, want [100 200]", times)
+	}
+	var rows int
+	if err := db.Get(&rows, "SELECT COUNT(*) FROM PRESENCE_LOG WHERE USER_ID = ?", gone); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 0 {
+		t.Errorf("got %d samples of the deleted user", rows)
+	}
+
+	if err := PrunePresenceLog(time.Unix(150, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if times, _ := GetUserPresenceTimes(alice, time.Unix(0, 0)); len(times) != 1 || times[0] != 200 {
+		t.Errorf("got times %v after pruning, want [200]", times)
+	}
+}
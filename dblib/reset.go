@@ -0,0 +1,94 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const createPasswordResetsTable = `
+	CREATE TABLE IF NOT EXISTS PASSWORD_RESETS (
+		TOKEN_HASH TEXT    PRIMARY KEY
+						   NOT NULL,
+		USER_ID    INTEGER REFERENCES USERS (ID) ON DELETE CASCADE
+						   NOT NULL,
+		EXPIRES    INTEGER NOT NULL
+	);
+`
+
+// GetUserByEmail looks up a user by verified email only, unconfirmed
+// addresses must not be usable to take over an account.
+func GetUserByEmail(email string) (User, error) {
+	var user User
+	err := db.Get(&user, "SELECT ID, USERNAME, SHOWNAME FROM USERS WHERE EMAIL = ? AND EMAIL_VERIFIED = 1", email)
+	if err != nil {
+		return User{}, errors.New("Failed to get user by email: " + err.Error())
+	}
+	return user, nil
+}
+
+func SetUserPassword(userid int, password string) error {
+	_, err := db.Exec("UPDATE USERS SET PASSWORD = ? WHERE ID = ?", password, userid)
+	if err != nil {
+		return errors.New("Failed to set password: " + err.Error())
+	}
+	return nil
+}
+
+func AddPasswordReset(userid int, tokenHash string, expires time.Time) error {
+	_, err := db.Exec("DELETE FROM PASSWORD_RESETS WHERE EXPIRES < ?", time.Now().Unix())
+	if err != nil {
+		return errors.New("Failed to prune password resets: " + err.Error())
+	}
+	_, err = db.Exec("INSERT INTO PASSWORD_RESETS (TOKEN_HASH, USER_ID, EXPIRES) VALUES (?, ?, ?)", tokenHash, userid, expires.Unix())
+	if err != nil {
+		return errors.New("Failed to store password reset: " + err.Error())
+	}
+	return nil
+}
+
+// CheckPasswordReset returns the user a valid reset token belongs to.
+func CheckPasswordReset(tokenHash string) (int, error) {
+	var userID int
+	err := db.Get(&userID, "SELECT USER_ID FROM PASSWORD_RESETS WHERE TOKEN_HASH = ? AND EXPIRES >= ?", tokenHash, time.Now().Unix())
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, errors.New("Failed to get password reset: " + err.Error())
+	}
+	return userID, nil
+}
+
+// ResetPassword sets the new password hash if the token is valid and removes
+// all reset tokens of the user, so every token works only once. The API
+// tokens of the user are revoked as well, they may have leaked along with
+// the old password.
+func ResetPassword(tokenHash string, password string) (int, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return 0, errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	var userID int
+	err = tx.Get(&userID, "SELECT USER_ID FROM PASSWORD_RESETS WHERE TOKEN_HASH = ? AND EXPIRES >= ?", tokenHash, time.Now().Unix())
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	if err != nil {
+		return 0, errors.New("Failed to get password reset: " + err.Error())
+	}
+	if _, err := tx.Exec("UPDATE USERS SET PASSWORD = ? WHERE ID = ?", password, userID); err != nil {
+		return 0, errors.New("Failed to set password: " + err.Error())
+	}
+	if _, err := tx.Exec("DELETE FROM PASSWORD_RESETS WHERE USER_ID = ?", userID); err != nil {
+		return 0, errors.New("Failed to invalidate password resets: " + err.Error())
+	}
+	if _, err := tx.Exec("DELETE FROM API_TOKENS WHERE USER_ID = ?", userID); err != nil {
+		return 0, errors.New("Failed to revoke API tokens: " + err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.New("Failed to reset password: " + err.Error())
+	}
+	return userID, nil
+}
@@ -0,0 +1,65 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+const createScanLogTable = `
+	CREATE TABLE IF NOT EXISTS SCAN_LOG (
+		ID          INTEGER PRIMARY KEY AUTOINCREMENT
+							NOT NULL,
+		TS          INTEGER NOT NULL,
+		DURATION_MS INTEGER NOT NULL,
+		TARGETS     INTEGER NOT NULL,
+		RESPONSES   INTEGER NOT NULL,
+		MATCHED     INTEGER NOT NULL,
+		ERRORS      INTEGER NOT NULL,
+		OK          INTEGER NOT NULL,
+		ERROR       TEXT    NOT NULL DEFAULT ('')
+	);
+	CREATE INDEX IF NOT EXISTS SCAN_LOG_TS ON SCAN_LOG (TS);
+`
+
+// ScanLogEntry describes one scan run, successful or not.
+type ScanLogEntry struct {
+	ID         int64  `db:"ID" json:"id"`
+	TS         int64  `db:"TS" json:"ts"`
+	DurationMS int64  `db:"DURATION_MS" json:"duration_ms"`
+	Targets    int    `db:"TARGETS" json:"targets"`
+	Responses  int    `db:"RESPONSES" json:"responses"`
+	Matched    int    `db:"MATCHED" json:"matched"`
+	Errors     int    `db:"ERRORS" json:"errors"`
+	OK         bool   `db:"OK" json:"ok"`
+	Error      string `db:"ERROR" json:"error,omitempty"`
+}
+
+func AddScanLog(e ScanLogEntry) error {
+	_, err := db.Exec(`INSERT INTO SCAN_LOG (TS, DURATION_MS, TARGETS, RESPONSES, MATCHED, ERRORS, OK, ERROR)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.TS, e.DurationMS, e.Targets, e.Responses, e.Matched, e.Errors, e.OK, e.Error)
+	if err != nil {
+		return errors.New("Failed to add scan log: " + err.Error())
+	}
+	return nil
+}
+
+// PruneScanLog deletes all entries older than the given time.
+func PruneScanLog(before time.Time) error {
+	_, err := db.Exec("DELETE FROM SCAN_LOG WHERE TS < ?", before.Unix())
+	if err != nil {
+		return errors.New("Failed to prune scan log: " + err.Error())
+	}
+	return nil
+}
+
+// GetScanLog returns the entries in [from, to), newest first.
+func GetScanLog(from, to int64, limit int) ([]ScanLogEntry, error) {
+	entries := []ScanLogEntry{}
+	err := db.Select(&entries, `SELECT ID, TS, DURATION_MS, TARGETS, RESPONSES, MATCHED, ERRORS, OK, ERROR
+		FROM SCAN_LOG WHERE TS >= ? AND TS < ? ORDER BY TS DESC, ID DESC LIMIT ?`, from, to, limit)
+	if err != nil {
+		return nil, errors.New("Failed to get scan log: " + err.Error())
+	}
+	return entries, nil
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+const createSessionsTable = `
+	CREATE TABLE IF NOT EXISTS SESSIONS (
+		SID_HASH        TEXT    PRIMARY KEY
+								NOT NULL,
+		USER_ID         INTEGER REFERENCES USERS (ID) ON DELETE CASCADE
+								NOT NULL,
+		IMPERSONATOR_ID INTEGER NOT NULL DEFAULT (0),
+		CREATED         INTEGER NOT NULL,
+		EXPIRES         INTEGER NOT NULL,
+		LAST_SEEN       INTEGER NOT NULL
+	);
+`
+
+// Session is a persisted login session. Only a hash of the session id is
+// stored, so the table is useless for taking over sessions.
+type Session struct {
+	SIDHash        string `db:"SID_HASH"`
+	UserID         int    `db:"USER_ID"`
+	ImpersonatorID int    `db:"IMPERSONATOR_ID"`
+	Created        int64  `db:"CREATED"`
+	Expires        int64  `db:"EXPIRES"`
+	LastSeen       int64  `db:"LAST_SEEN"`
+}
+
+func SaveSession(s Session) error {
+	_, err := db.Exec(`INSERT INTO SESSIONS (SID_HASH, USER_ID, IMPERSONATOR_ID, CREATED, EXPIRES, LAST_SEEN) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(SID_HASH) DO UPDATE SET USER_ID = excluded.USER_ID, IMPERSONATOR_ID = excluded.IMPERSONATOR_ID,
+		EXPIRES = excluded.EXPIRES, LAST_SEEN = excluded.LAST_SEEN`,
+		s.SIDHash, s.UserID, s.ImpersonatorID, s.Created, s.Expires, s.LastSeen)
+	if err != nil {
+		return errors.New("Failed to save session: " + err.Error())
+	}
+	return nil
+}
+
+func TouchSession(sidHash string, lastSeen time.Time) error {
+	_, err := db.Exec("UPDATE SESSIONS SET LAST_SEEN = ? WHERE SID_HASH = ?", lastSeen.Unix(), sidHash)
+	if err != nil {
+		return errors.New("Failed to touch session: " + err.Error())
+	}
+	return nil
+}
+
+func DeleteSession(sidHash string) error {
+	_, err := db.Exec("DELETE FROM SESSIONS WHERE SID_HASH = ?", sidHash)
+	if err != nil {
+		return errors.New("Failed to delete session: " + err.Error())
+	}
+	return nil
+}
+
+// DeleteExpiredSessions deletes the sessions that expired before t.
+func DeleteExpiredSessions(t time.Time) error {
+	if _, err := db.Exec("DELETE FROM SESSIONS WHERE EXPIRES < ?", t.Unix()); err != nil {
+		return errors.New("Failed to delete expired sessions: " + err.Error())
+	}
+	return nil
+}
+
+// LoadSessions deletes the sessions expired at now and returns the rest,
+// oldest first.
+func LoadSessions(now time.Time) ([]Session, error) {
+	if _, err := db.Exec("DELETE FROM SESSIONS WHERE EXPIRES <= ?", now.Unix()); err != nil {
+		return nil, errors.New("Failed to prune sessions: " + err.Error())
+	}
+	sessions := []Session{}
+	err := db.Select(&sessions, "SELECT SID_HASH, USER_ID, IMPERSONATOR_ID, CREATED, EXPIRES, LAST_SEEN FROM SESSIONS ORDER BY CREATED")
+	if err != nil {
+		return nil, errors.New("Failed to load sessions: " + err.Error())
+	}
+	return sessions, nil
+}
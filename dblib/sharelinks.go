@@ -0,0 +1,72 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const createShareLinksTable = `
+	CREATE TABLE IF NOT EXISTS SHARE_LINKS (
+		ID      INTEGER PRIMARY KEY AUTOINCREMENT
+						NOT NULL,
+		USER_ID INTEGER REFERENCES USERS (ID) ON DELETE CASCADE
+						NOT NULL,
+		CREATED INTEGER NOT NULL,
+		EXPIRES INTEGER NOT NULL
+	);
+`
+
+// ShareLink is a revocable read-only presence link handed out by a member.
+type ShareLink struct {
+	ID      int   `db:"ID"`
+	UserID  int   `db:"USER_ID"`
+	Created int64 `db:"CREATED"`
+	Expires int64 `db:"EXPIRES"`
+}
+
+func AddShareLink(userid int, expires time.Time) (ShareLink, error) {
+	link := ShareLink{UserID: userid, Created: time.Now().Unix(), Expires: expires.Unix()}
+	result, err := db.Exec("INSERT INTO SHARE_LINKS (USER_ID, CREATED, EXPIRES) VALUES (?, ?, ?)", link.UserID, link.Created, link.Expires)
+	if err != nil {
+		return link, errors.New("Failed to add share link: " + err.Error())
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return link, errors.New("Failed to add share link: " + err.Error())
+	}
+	link.ID = int(id)
+	return link, nil
+}
+
+// GetUserShareLinks returns the unexpired links of the user, newest first.
+func GetUserShareLinks(userid int) ([]ShareLink, error) {
+	links := []ShareLink{}
+	err := db.Select(&links, "SELECT ID, USER_ID, CREATED, EXPIRES FROM SHARE_LINKS WHERE USER_ID = ? AND EXPIRES > ? ORDER BY ID DESC", userid, time.Now().Unix())
+	if err != nil {
+		return nil, errors.New("Failed to get share links: " + err.Error())
+	}
+	return links, nil
+}
+
+func GetShareLink(id int) (ShareLink, error) {
+	var link ShareLink
+	err := db.Get(&link, "SELECT ID, USER_ID, CREATED, EXPIRES FROM SHARE_LINKS WHERE ID = ?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return link, ErrNotFound
+	}
+	if err != nil {
+		return link, errors.New("Failed to get share link: " + err.Error())
+	}
+	return link, nil
+}
+
+// DeleteShareLink revokes a link of the user. Expired links are removed
+// along the way.
+func DeleteShareLink(userid int, id int) error {
+	_, err := db.Exec("DELETE FROM SHARE_LINKS WHERE (ID = ? AND USER_ID = ?) OR EXPIRES <= ?", id, userid, time.Now().Unix())
+	if err != nil {
+		return errors.New("Failed to delete share link: " + err.Error())
+	}
+	return nil
+}
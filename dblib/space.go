@@ -0,0 +1,126 @@
+package db
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+const createSpaceMetaTable = `
+	CREATE TABLE IF NOT EXISTS SPACE_META (
+		KEY   TEXT PRIMARY KEY
+					NOT NULL,
+		VALUE TEXT NOT NULL
+	);
+`
+
+// SpaceMeta describes the space for the board and the SpaceAPI document.
+type SpaceMeta struct {
+	Name         string  `json:"name"`
+	URL          string  `json:"url"`
+	Logo         string  `json:"logo"`
+	Address      string  `json:"address"`
+	Lat          float64 `json:"lat"`
+	Lon          float64 `json:"lon"`
+	Email        string  `json:"email"`
+	Phone        string  `json:"phone"`
+	Matrix       string  `json:"matrix"`
+	Mastodon     string  `json:"mastodon"`
+	OpeningHours string  `json:"opening_hours"`
+}
+
+// DefaultSpaceMeta is used for every key that has not been configured yet.
+var DefaultSpaceMeta = SpaceMeta{
+	Name: "Hackerspace",
+}
+
+func (m *SpaceMeta) fields() map[string]*string {
+	return map[string]*string{
+		"name":          &m.Name,
+		"url":           &m.URL,
+		"logo":          &m.Logo,
+		"address":       &m.Address,
+		"email":         &m.Email,
+		"phone":         &m.Phone,
+		"matrix":        &m.Matrix,
+		"mastodon":      &m.Mastodon,
+		"opening_hours": &m.OpeningHours,
+	}
+}
+
+// Validate checks the fields the SpaceAPI requires.
+func (m SpaceMeta) Validate() error {
+	if m.Name == "" {
+		return errors.New("Space name is required")
+	}
+	if m.URL == "" {
+		return errors.New("Space URL is required")
+	}
+	for _, u := range []string{m.URL, m.Logo} {
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errors.New("Invalid URL: " + u)
+		}
+	}
+	if m.Lat < -90 || m.Lat > 90 || m.Lon < -180 || m.Lon > 180 {
+		return errors.New("Invalid coordinates")
+	}
+	return nil
+}
+
+func GetSpaceMeta() (SpaceMeta, error) {
+	meta := DefaultSpaceMeta
+	var rows []struct {
+		Key   string `db:"KEY"`
+		Value string `db:"VALUE"`
+	}
+	if err := db.Select(&rows, "SELECT KEY, VALUE FROM SPACE_META"); err != nil {
+		return meta, errors.New("Failed to get space meta: " + err.Error())
+	}
+	fields := meta.fields()
+	for _, row := range rows {
+		switch row.Key {
+		case "lat":
+			meta.Lat, _ = strconv.ParseFloat(row.Value, 64)
+		case "lon":
+			meta.Lon, _ = strconv.ParseFloat(row.Value, 64)
+		default:
+			if dst, ok := fields[row.Key]; ok && row.Value != "" {
+				*dst = row.Value
+			}
+		}
+	}
+	return meta, nil
+}
+
+// SetSpaceMeta validates and stores all fields of meta.
+func SetSpaceMeta(meta SpaceMeta) error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	values := map[string]string{
+		"lat": strconv.FormatFloat(meta.Lat, 'f', -1, 64),
+		"lon": strconv.FormatFloat(meta.Lon, 'f', -1, 64),
+	}
+	for key, v := range meta.fields() {
+		values[key] = *v
+	}
+	for key, value := range values {
+		_, err := tx.Exec("INSERT INTO SPACE_META (KEY, VALUE) VALUES (?, ?) ON CONFLICT(KEY) DO UPDATE SET VALUE = excluded.VALUE", key, value)
+		if err != nil {
+			return errors.New("Failed to set space meta: " + err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to commit space meta: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package db
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// NormalizeTag lower-cases and trims the tag and checks it is a valid name.
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if !tagPattern.MatchString(tag) {
+		return "", errors.New("Invalid tag, use up to 32 letters, digits, - or _")
+	}
+	return tag, nil
+}
+
+const createTagsTable = `
+	CREATE TABLE IF NOT EXISTS TAGS (
+		ID   INTEGER PRIMARY KEY AUTOINCREMENT
+					 NOT NULL,
+		NAME TEXT    NOT NULL
+					 UNIQUE
+	);
+`
+
+const createUserTagsTable = `
+	CREATE TABLE IF NOT EXISTS USER_TAGS (
+		TAG_ID  INTEGER REFERENCES TAGS (ID) ON DELETE CASCADE
+						NOT NULL,
+		USER_ID INTEGER REFERENCES USERS (ID) ON DELETE CASCADE
+						NOT NULL,
+		PRIMARY KEY (
+			TAG_ID,
+			USER_ID
+		)
+	);
+`
+
+func GetUserTags(userid int) ([]string, error) {
+	tags := []string{}
+	err := db.Select(&tags, "SELECT T.NAME FROM USER_TAGS UT JOIN TAGS T ON UT.TAG_ID = T.ID WHERE UT.USER_ID = ? ORDER BY T.NAME", userid)
+	if err != nil {
+		return nil, errors.New("Failed to get user tags: " + err.Error())
+	}
+	return tags, nil
+}
+
+// AddUserTag tags the user, creating the tag on first use.
+func AddUserTag(userid int, name string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("INSERT OR IGNORE INTO TAGS (NAME) VALUES (?)", name); err != nil {
+		return errors.New("Failed to create tag: " + err.Error())
+	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO USER_TAGS (TAG_ID, USER_ID) SELECT ID, ? FROM TAGS WHERE NAME = ?", userid, name)
+	if err != nil {
+		return errors.New("Failed to add user tag: " + err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to add user tag: " + err.Error())
+	}
+	return nil
+}
+
+func RemoveUserTag(userid int, name string) error {
+	_, err := db.Exec("DELETE FROM USER_TAGS WHERE USER_ID = ? AND TAG_ID = (SELECT ID FROM TAGS WHERE NAME = ?)", userid, name)
+	if err != nil {
+		return errors.New("Failed to remove user tag: " + err.Error())
+	}
+	return nil
+}
+
+func GetUserIDsByTag(name string) ([]int, error) {
+	var ids []int
+	err := db.Select(&ids, "SELECT UT.USER_ID FROM USER_TAGS UT JOIN TAGS T ON UT.TAG_ID = T.ID WHERE T.NAME = ?", name)
+	if err != nil {
+		return nil, errors.New("Failed to get users by tag: " + err.Error())
+	}
+	return ids, nil
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+const createTOTPTable = `
+	CREATE TABLE IF NOT EXISTS USER_TOTP (
+		USER_ID INTEGER PRIMARY KEY
+						REFERENCES USERS (ID) ON DELETE CASCADE
+						NOT NULL,
+		SECRET  TEXT    NOT NULL,
+		ENABLED INTEGER (1) NOT NULL DEFAULT (0)
+	);
+`
+
+const createBackupCodesTable = `
+	CREATE TABLE IF NOT EXISTS BACKUP_CODES (
+		ID        INTEGER PRIMARY KEY AUTOINCREMENT
+						  NOT NULL,
+		USER_ID   INTEGER REFERENCES USERS (ID) ON DELETE CASCADE
+						  NOT NULL,
+		CODE_HASH TEXT    NOT NULL,
+		USED      INTEGER (1) NOT NULL DEFAULT (0)
+	);
+`
+
+// GetTOTP returns the TOTP secret of a user and whether 2FA is active.
+// An empty secret means the user never started enrollment.
+func GetTOTP(userid int) (string, bool, error) {
+	var row struct {
+		Secret  string `db:"SECRET"`
+		Enabled bool   `db:"ENABLED"`
+	}
+	err := db.Get(&row, "SELECT SECRET, ENABLED FROM USER_TOTP WHERE USER_ID = ?", userid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, errors.New("Failed to get TOTP secret: " + err.Error())
+	}
+	return row.Secret, row.Enabled, nil
+}
+
+// SetTOTPSecret stores a new, not yet enabled secret for the user.
+func SetTOTPSecret(userid int, secret string) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO USER_TOTP (USER_ID, SECRET, ENABLED) VALUES (?, ?, 0)", userid, secret)
+	if err != nil {
+		return errors.New("Failed to set TOTP secret: " + err.Error())
+	}
+	return nil
+}
+
+func EnableTOTP(userid int) error {
+	_, err := db.Exec("UPDATE USER_TOTP SET ENABLED = 1 WHERE USER_ID = ?", userid)
+	if err != nil {
+		return errors.New("Failed to enable TOTP: " + err.Error())
+	}
+	return nil
+}
+
+// DisableTOTP removes the secret and all backup codes of the user.
+func DisableTOTP(userid int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM USER_TOTP WHERE USER_ID = ?", userid); err != nil {
+		return errors.New("Failed to disable TOTP: " + err.Error())
+	}
+	if _, err := tx.Exec("DELETE FROM BACKUP_CODES WHERE USER_ID = ?", userid); err != nil {
+		return errors.New("Failed to delete backup codes: " + err.Error())
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to disable TOTP: " + err.Error())
+	}
+	return nil
+}
+
+// ReplaceBackupCodes drops all existing backup codes of the user and stores
+// the given hashes as the new set.
+func ReplaceBackupCodes(userid int, hashes []string) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM BACKUP_CODES WHERE USER_ID = ?", userid); err != nil {
+		return errors.New("Failed to delete backup codes: " + err.Error())
+	}
+	for _, h := range hashes {
+		if _, err := tx.Exec("INSERT INTO BACKUP_CODES (USER_ID, CODE_HASH) VALUES (?, ?)", userid, h); err != nil {
+			return errors.New("Failed to store backup code: " + err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to store backup codes: " + err.Error())
+	}
+	return nil
+}
+
+// UseBackupCode marks the matching unused code as used. It returns false if
+// no unused code with that hash exists.
+func UseBackupCode(userid int, hash string) (bool, error) {
+	result, err := db.Exec("UPDATE BACKUP_CODES SET USED = 1 WHERE USER_ID = ? AND CODE_HASH = ? AND USED = 0", userid, hash)
+	if err != nil {
+		return false, errors.New("Failed to use backup code: " + err.Error())
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.New("Failed to use backup code: " + err.Error())
+	}
+	return n > 0, nil
+}
+
+func CountBackupCodes(userid int) (int, error) {
+	var count int
+	err := db.Get(&count, "SELECT COUNT(*) FROM BACKUP_CODES WHERE USER_ID = ? AND USED = 0", userid)
+	if err != nil {
+		return 0, errors.New("Failed to count backup codes: " + err.Error())
+	}
+	return count, nil
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const createUnknownDevicesTable = `
+	CREATE TABLE IF NOT EXISTS UNKNOWN_DEVICES (
+		MACHASH    TEXT    PRIMARY KEY
+						   NOT NULL,
+		OUI        TEXT    NOT NULL,
+		VENDOR     TEXT,
+		FIRST_SEEN INTEGER NOT NULL,
+		LAST_SEEN  INTEGER NOT NULL,
+		SEEN_COUNT INTEGER NOT NULL DEFAULT (1)
+	);
+`
+
+// UnknownDevice aggregates sightings of a MAC that belongs to no registered
+// device. Only a salted hash and the vendor prefix are kept.
+type UnknownDevice struct {
+	MACHash   string         `db:"MACHASH" json:"machash"`
+	OUI       string         `db:"OUI" json:"oui"`
+	VendorDB  sql.NullString `db:"VENDOR" json:"-"`
+	Vendor    string         `json:"vendor"`
+	FirstSeen int64          `db:"FIRST_SEEN" json:"first_seen"`
+	LastSeen  int64          `db:"LAST_SEEN" json:"last_seen"`
+	SeenCount int            `db:"SEEN_COUNT" json:"seen_count"`
+}
+
+// UnknownDeviceSalt returns the server wide salt for hashing unknown MACs and
+// creates it on first use. A fixed salt is needed to recognize a device
+// across scans.
+func UnknownDeviceSalt() (string, error) {
+	var salt string
+	err := db.Get(&salt, "SELECT VALUE FROM SETTINGS WHERE KEY = 'UnknownDeviceSalt'")
+	if err == nil && salt != "" {
+		return salt, nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return "", errors.New("Failed to get unknown device salt: " + err.Error())
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.New("Failed to generate unknown device salt: " + err.Error())
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO SETTINGS (KEY, VALUE) VALUES ('UnknownDeviceSalt', ?)", hex.EncodeToString(b))
+	if err != nil {
+		return "", errors.New("Failed to store unknown device salt: " + err.Error())
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// RecordUnknownDevices counts one sighting for each of the given devices.
+func RecordUnknownDevices(devices []UnknownDevice) error {
+	if len(devices) == 0 {
+		return nil
+	}
+	now := time.Now().Unix()
+	defer beginBatch()()
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+	for _, d := range devices {
+		_, err := tx.Exec(`INSERT INTO UNKNOWN_DEVICES (MACHASH, OUI, VENDOR, FIRST_SEEN, LAST_SEEN, SEEN_COUNT)
+			VALUES (?, ?, ?, ?, ?, 1)
+			ON CONFLICT (MACHASH) DO UPDATE SET LAST_SEEN = excluded.LAST_SEEN, SEEN_COUNT = SEEN_COUNT + 1`,
+			d.MACHash, d.OUI, d.Vendor, now, now)
+		if err != nil {
+			return errors.New("Failed to record unknown device: " + err.Error())
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to record unknown devices: " + err.Error())
+	}
+	return nil
+}
+
+// GetUnknownDevices returns the tracked devices, most frequently seen first.
+func GetUnknownDevices() ([]UnknownDevice, error) {
+	devices := []UnknownDevice{}
+	err := db.Select(&devices, "SELECT MACHASH, OUI, VENDOR, FIRST_SEEN, LAST_SEEN, SEEN_COUNT FROM UNKNOWN_DEVICES ORDER BY SEEN_COUNT DESC, LAST_SEEN DESC")
+	if err != nil {
+		return nil, errors.New("Failed to get unknown devices: " + err.Error())
+	}
+	for i := range devices {
+		if devices[i].VendorDB.Valid {
+			devices[i].Vendor = devices[i].VendorDB.String
+		}
+	}
+	return devices, nil
+}
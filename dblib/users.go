@@ -0,0 +1,50 @@
+package db
+
+import (
+	"errors"
+)
+
+// GetAllUsers returns every user including the admin flag, for the admin
+// user list.
+func GetAllUsers() ([]User, error) {
+	users := []User{}
+	err := db.Select(&users, "SELECT ID, USERNAME, SHOWNAME, ADMIN, HIDDEN FROM USERS ORDER BY USERNAME")
+	if err != nil {
+		return nil, errors.New("Failed to get users: " + err.Error())
+	}
+	return users, nil
+}
+
+// DeleteUser deletes the user. Devices, attributes and everything else with
+// a foreign key on USERS go with it through ON DELETE CASCADE.
+func DeleteUser(userid int) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.New("Failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	// no foreign key, but the restored presence would bring the user back
+	if _, err := tx.Exec("DELETE FROM PRESENCE_STATE WHERE USER_ID = ?", userid); err != nil {
+		return errors.New("Failed to delete presence state: " + err.Error())
+	}
+	result, err := tx.Exec("DELETE FROM USERS WHERE ID = ?", userid)
+	if err != nil {
+		return errors.New("Failed to delete user: " + err.Error())
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.New("Failed to commit user deletion: " + err.Error())
+	}
+	return nil
+}
+
+func CountAdmins() (int, error) {
+	var n int
+	if err := db.Get(&n, "SELECT COUNT(*) FROM USERS WHERE ADMIN = 1"); err != nil {
+		return 0, errors.New("Failed to count admins: " + err.Error())
+	}
+	return n, nil
+}
@@ -0,0 +1,40 @@
+// Package gpio drives a single output pin, e.g. an "open" light next to the
+// door. Only Linux sysfs GPIO is supported, everywhere else the pin is a
+// no-op.
+package gpio
+
+import "log"
+
+// Pin is an output pin. The zero value and a nil *Pin do nothing.
+type Pin struct {
+	number int
+	set    func(high bool) error
+}
+
+// Open configures pin number as an output, driven low. A negative number
+// means no pin is configured. When the pin can not be used the returned Pin
+// does nothing and the reason is logged, fahrmarke keeps running.
+func Open(number int) *Pin {
+	if number < 0 {
+		log.Println("No GPIOPin set, open light disabled")
+		return &Pin{number: number}
+	}
+	set, err := openPin(number)
+	if err != nil {
+		log.Println("GPIO pin", number, "not available, open light disabled:", err)
+		return &Pin{number: number}
+	}
+	p := &Pin{number: number, set: set}
+	p.Set(false)
+	return p
+}
+
+// Set drives the pin high or low. Errors are logged.
+func (p *Pin) Set(high bool) {
+	if p == nil || p.set == nil {
+		return
+	}
+	if err := p.set(high); err != nil {
+		log.Println("Error setting GPIO pin", p.number, ":", err)
+	}
+}
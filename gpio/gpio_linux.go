@@ -0,0 +1,46 @@
+//go:build linux
+
+package gpio
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const sysfsGPIO = "/sys/class/gpio"
+
+// openPin exports the pin through sysfs and sets it up as an output.
+func openPin(number int) (func(high bool) error, error) {
+	if _, err := os.Stat(sysfsGPIO); err != nil {
+		return nil, errors.New("no sysfs GPIO on this host: " + err.Error())
+	}
+	n := strconv.Itoa(number)
+	dir := filepath.Join(sysfsGPIO, "gpio"+n)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.WriteFile(filepath.Join(sysfsGPIO, "export"), []byte(n), 0); err != nil {
+			return nil, errors.New("Failed to export pin: " + err.Error())
+		}
+	}
+	// udev needs a moment to hand the new files to the gpio group
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.WriteFile(filepath.Join(dir, "direction"), []byte("out"), 0); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		return nil, errors.New("Failed to set pin direction: " + err.Error())
+	}
+	value := filepath.Join(dir, "value")
+	return func(high bool) error {
+		v := []byte("0")
+		if high {
+			v = []byte("1")
+		}
+		return os.WriteFile(value, v, 0)
+	}, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package gpio
+
+import "errors"
+
+func openPin(number int) (func(high bool) error, error) {
+	return nil, errors.New("GPIO is only supported on Linux")
+}
@@ -0,0 +1,306 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+	"github.com/go-chi/chi"
+)
+
+// impersonateHandler swaps the admin's session for one of the target user
+// that remembers the admin, so the admin can later switch back.
+func impersonateHandler(w http.ResponseWriter, r *http.Request) {
+	adminID := r.Context().Value(ctxUserID).(int)
+	if r.Context().Value(ctxImpersonatorID) != nil {
+		webError(w, r, "Already impersonating", "", http.StatusBadRequest)
+		return
+	}
+	targetID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		webError(w, r, "Invalid user id", "", http.StatusBadRequest)
+		return
+	}
+	target, err := db.GetUserByID(targetID)
+	if err != nil {
+		webError(w, r, "Failed to get user: "+err.Error(), "User not found", http.StatusNotFound)
+		return
+	}
+	if err := db.AddAuditLog(adminID, target.ID, "impersonate_start", target.Username); err != nil {
+		webError(w, r, "Refusing to impersonate without audit log: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	log.Println("Admin", adminID, "starts impersonating user", target.ID)
+
+	sid, s, err := newSession(target.ID)
+	if err != nil {
+		webError(w, r, "Error creating session: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	s.ImpersonatorID = adminID
+	session.Set(sid, s)
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		destroySession(c.Value)
+	}
+	setSessionCookie(w, sid)
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+func stopImpersonatingHandler(w http.ResponseWriter, r *http.Request) {
+	adminVal := r.Context().Value(ctxImpersonatorID)
+	if adminVal == nil {
+		webError(w, r, "Not impersonating", "", http.StatusBadRequest)
+		return
+	}
+	adminID := adminVal.(int)
+	targetID := r.Context().Value(ctxUserID).(int)
+	if err := db.AddAuditLog(adminID, targetID, "impersonate_stop", ""); err != nil {
+		log.Println(err)
+	}
+	log.Println("Admin", adminID, "stops impersonating user", targetID)
+
+	sid, _, err := newSession(adminID)
+	if err != nil {
+		webError(w, r, "Error creating session: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		destroySession(c.Value)
+	}
+	setSessionCookie(w, sid)
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+type statusResponse struct {
+	Database struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error,omitempty"`
+	} `json:"database"`
+	Scanner  arplib.Status `json:"scanner"`
+	Sessions int           `json:"sessions"`
+}
+
+// adminStatusHandler aggregates the state of all subsystems in one document.
+func adminStatusHandler(w http.ResponseWriter, r *http.Request) {
+	var resp statusResponse
+	if err := db.Ping(); err != nil {
+		resp.Database.Error = err.Error()
+	} else {
+		resp.Database.OK = true
+	}
+	resp.Scanner = arplib.GetStatus()
+	resp.Sessions = session.Count()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func adminSelfTestHandler(w http.ResponseWriter, r *http.Request) {
+	report, err := arplib.SelfTestConfigured()
+	if err != nil {
+		apierror(w, r, "Self-test failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+type themesResponse struct {
+	Active string   `json:"active"`
+	Themes []string `json:"themes"`
+}
+
+func adminThemesHandler(w http.ResponseWriter, r *http.Request) {
+	themes, err := ListThemes(datadir)
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(themesResponse{Active: getActiveTheme().Name, Themes: themes})
+}
+
+func adminUnknownDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	devices, err := db.GetUnknownDevices()
+	if err != nil {
+		apierror(w, r, "Failed to get unknown devices: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// adminScanLogHandler lists recent scans, newest first. from and to (unix
+// seconds) narrow it down to the time something looked wrong.
+func adminScanLogHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	from, to := int64(0), time.Now().Unix()+1
+	var err error
+	if v := q.Get("from"); v != "" {
+		if from, err = strconv.ParseInt(v, 10, 64); err != nil {
+			apierror(w, r, "Invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if to, err = strconv.ParseInt(v, 10, 64); err != nil {
+			apierror(w, r, "Invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 1000 {
+			apierror(w, r, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := db.GetScanLog(from, to, limit)
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+type rehashResponse struct {
+	Scheme   int `json:"scheme"`
+	Outdated int `json:"outdated"`
+	Notified int `json:"notified"`
+}
+
+// adminRehashHandler migrates devices to the current hash scheme. No scheme
+// is reversible, so outdated devices can't be re-hashed here: they are
+// flagged for re-registration and their owners get a mail. Devices that show
+// up in a scan before that are upgraded by the scanner.
+func adminRehashHandler(w http.ResponseWriter, r *http.Request) {
+	devices, err := db.GetOutdatedDevices(arplib.CurrentHashScheme)
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := rehashResponse{Scheme: arplib.CurrentHashScheme, Outdated: len(devices)}
+	var ids []int
+	owners := map[int]int{}
+	for _, d := range devices {
+		ids = append(ids, d.ID)
+		if !d.NeedsReregister {
+			owners[d.UserID]++
+		}
+	}
+	if err := db.MarkDevicesForReregistration(ids); err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for userID, n := range owners {
+		email, err := db.GetVerifiedEmail(userID)
+		if err != nil {
+			continue
+		}
+		body := "Fahrmarke speichert Geräte jetzt in einem neuen Format. " + strconv.Itoa(n) +
+			" deiner Geräte muss neu eingetragen werden, sofern es nicht vorher im Space gesehen wird:\n\n" +
+			baseURL(r) + "/me\n"
+		if err := sendMail(email, "Fahrmarke: Geräte neu eintragen", body); err != nil {
+			log.Println("Failed to notify user", userID, "about re-registration:", err)
+			continue
+		}
+		resp.Notified++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// adminReloadOUIHandler re-reads the OUI file. A broken file is reported and
+// the previous table kept.
+func adminReloadOUIHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := arplib.ReloadOUI()
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"entries": n})
+}
+
+// secretSettings are never handed out by the settings API.
+var secretSettings = map[string]bool{
+	"SessionHMAC":    true,
+	"SessionHMACKey": true,
+	"CSRFKey":        true,
+	"SMTPPassword":   true,
+}
+
+const maskedSetting = "********"
+
+func adminSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	settings, err := db.GetAllSettings()
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for k := range settings {
+		if secretSettings[k] {
+			settings[k] = maskedSetting
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+type setSettingsResponse struct {
+	Updated []string `json:"updated"`
+	Deleted []string `json:"deleted"`
+	// RestartRequired is always true for now, settings are read at startup
+	RestartRequired bool `json:"restart_required"`
+}
+
+// adminSetSettingsHandler writes the settings of a JSON object, a null value
+// deletes the key. Nothing is written if any key is invalid.
+func adminSetSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	var req map[string]*string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil {
+		apierror(w, r, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	keys := make([]string, 0, len(req))
+	for k, v := range req {
+		if strings.TrimSpace(k) == "" {
+			apierror(w, r, db.ErrEmptyKey.Error(), http.StatusBadRequest)
+			return
+		}
+		if v != nil && *v == maskedSetting && secretSettings[k] {
+			// the masked value came back from a GET, keep the secret
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	resp := setSettingsResponse{Updated: []string{}, Deleted: []string{}, RestartRequired: true}
+	adminID := r.Context().Value(ctxUserID).(int)
+	for _, k := range keys {
+		if req[k] == nil {
+			if err := db.DeleteSetting(k); err != nil {
+				apierror(w, r, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.Deleted = append(resp.Deleted, k)
+		} else {
+			if err := db.SetSetting(k, *req[k]); err != nil {
+				apierror(w, r, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			resp.Updated = append(resp.Updated, k)
+		}
+		if err := db.AddAuditLog(adminID, 0, "setting_changed", k); err != nil {
+			log.Println(err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
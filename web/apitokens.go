@@ -0,0 +1,227 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	csrf "filippo.io/csrf/gorilla"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// apiTokenPrefix makes tokens recognizable, e.g. for secret scanners.
+const apiTokenPrefix = "fm_"
+
+const maxAPITokenName = 64
+
+// ctxAPIToken is set on requests authenticated by an API token.
+const ctxAPIToken ctxKey = "apitoken"
+
+func newAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func apiTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiTokenMiddleware authenticates /api requests carrying an
+// "Authorization: Bearer" token as the token's owner, instead of any session
+// cookie. Browsers never attach that header on their own, so these requests
+// skip the CSRF check. A token that doesn't validate is answered with 401.
+func apiTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(r.URL.Path, "/api/") || auth == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(auth, "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apierror(w, r, "Expected a Bearer token", http.StatusUnauthorized)
+			return
+		}
+		userID, err := db.ValidateAPIToken(apiTokenHash(strings.TrimSpace(token)), time.Now())
+		if err != nil {
+			if !errors.Is(err, db.ErrNotFound) {
+				log.Println(err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			apierror(w, r, "Invalid API token", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), ctxUserID, userID)
+		// a session cookie sent along must not carry over an impersonation
+		ctx = context.WithValue(ctx, ctxImpersonatorID, nil)
+		ctx = context.WithValue(ctx, ctxAPIToken, true)
+		next.ServeHTTP(w, csrf.UnsafeSkipCheck(r.WithContext(ctx)))
+	})
+}
+
+// RequireAPIAuth answers API requests that come with neither a session nor
+// an API token with a JSON 401, where RequireAuth would redirect to the login.
+func RequireAPIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(ctxUserID) == nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			apierror(w, r, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// createAPIToken stores a new token for the user and returns its plaintext.
+func createAPIToken(userID int, name string) (string, db.APIToken, error) {
+	token, err := newAPIToken()
+	if err != nil {
+		return "", db.APIToken{}, errors.New("Failed to generate token: " + err.Error())
+	}
+	stored, err := db.CreateAPIToken(userID, name, apiTokenHash(token))
+	if err != nil {
+		return "", db.APIToken{}, err
+	}
+	if err := db.AddAuditLog(userID, userID, "api_token_created", name); err != nil {
+		log.Println(err)
+	}
+	return token, stored, nil
+}
+
+type createAPITokenRequest struct {
+	Name string `json:"name"`
+}
+
+type createAPITokenResponse struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Token   string `json:"token"`
+	Created int64  `json:"created"`
+}
+
+// apiCreateTokenHandler mints a token for the logged in user. The plaintext
+// is only part of this response. Tokens can't mint tokens and admins can't
+// mint them for users they impersonate.
+func apiCreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		apierror(w, r, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	if r.Context().Value(ctxAPIToken) != nil || r.Context().Value(ctxImpersonatorID) != nil {
+		apierror(w, r, "API tokens can only be created from a login session", http.StatusForbidden)
+		return
+	}
+	var req createAPITokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&req); err != nil {
+		apierror(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if len(name) > maxAPITokenName {
+		writeValidationJSON(w, fieldErrors{"name": "too_long"})
+		return
+	}
+	token, stored, err := createAPIToken(uidVal.(int), name)
+	if err != nil {
+		apierror(w, r, "Error creating API token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createAPITokenResponse{ID: stored.ID, Name: stored.Name, Token: token, Created: stored.Created})
+}
+
+// apiTokenView is a token as listed on /me/tokens.
+type apiTokenView struct {
+	ID       int
+	Name     string
+	Created  time.Time
+	LastUsed time.Time // zero if never used
+}
+
+type tokensPage struct {
+	Tokens []apiTokenView
+	// NewToken is the plaintext of a token just created, shown only once
+	NewToken string
+	Errors   fieldErrors
+}
+
+func renderTokens(w http.ResponseWriter, r *http.Request, userID int, page tokensPage) {
+	tokens, err := db.GetUserAPITokens(userID)
+	if err != nil {
+		webError(w, r, "Error loading API tokens: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	for _, t := range tokens {
+		v := apiTokenView{ID: t.ID, Name: t.Name, Created: time.Unix(t.Created, 0)}
+		if t.LastUsed != 0 {
+			v.LastUsed = time.Unix(t.LastUsed, 0)
+		}
+		page.Tokens = append(page.Tokens, v)
+	}
+	if page.Errors != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	if err := getActiveTheme().Tpl.ExecuteTemplate(w, "tokens.html", page); err != nil {
+		webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+	}
+}
+
+func tokensHandler(w http.ResponseWriter, r *http.Request) {
+	renderTokens(w, r, r.Context().Value(ctxUserID).(int), tokensPage{})
+}
+
+// createTokenHandler creates a token and shows its plaintext on the page,
+// the only time it is visible.
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxUserID).(int)
+	name := strings.TrimSpace(r.FormValue("name"))
+	if len(name) > maxAPITokenName {
+		renderTokens(w, r, userID, tokensPage{Errors: fieldErrors{"name": "too_long"}})
+		return
+	}
+	token, _, err := createAPIToken(userID, name)
+	if err != nil {
+		webError(w, r, "Error creating API token: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	renderTokens(w, r, userID, tokensPage{NewToken: token})
+}
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Context().Value(ctxUserID).(int)
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		renderTokens(w, r, userID, tokensPage{Errors: fieldErrors{"token": "invalid"}})
+		return
+	}
+	err = db.DeleteAPIToken(userID, id)
+	if errors.Is(err, db.ErrNotFound) {
+		webError(w, r, "API token not found", "", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		webError(w, r, "Error revoking API token: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if err := db.AddAuditLog(userID, userID, "api_token_revoked", strconv.Itoa(id)); err != nil {
+		log.Println(err)
+	}
+	http.Redirect(w, r, "/me/tokens", http.StatusSeeOther)
+}
@@ -0,0 +1,120 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+// csrfRouter serves the API and a profile form behind the session, token
+// and CSRF middleware like GetRouter does.
+func csrfRouter() http.Handler {
+	r := chi.NewRouter()
+	useSessionAndCSRF(r)
+	getAPIRouter(r)
+	r.With(RequireAuth).Post("/me/devices/add", addDeviceHandler)
+	return r
+}
+
+// crossSitePost is a POST as a browser sends it from a foreign page.
+func crossSitePost(path, contentType, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Sec-Fetch-Site", "cross-site")
+	req.Header.Set("Origin", "https://evil.example")
+	return req
+}
+
+func TestAPITokenSkipsCSRF(t *testing.T) {
+	userID := createTestUser(t, "tokencsrf", false)
+	cookie := sessionCookie(t, userID)
+	token, _, err := createAPIToken(userID, "script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := csrfRouter()
+	serve := func(req *http.Request) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	const device = `{"mac": "02:00:00:00:12:77", "name": "script"}`
+
+	req := crossSitePost("/api/me/devices", "application/json", device)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if code := serve(req); code != http.StatusCreated {
+		t.Errorf("token: got status %d, want 201", code)
+	}
+
+	req = crossSitePost("/api/me/devices", "application/json", device)
+	req.AddCookie(cookie)
+	if code := serve(req); code != http.StatusForbidden {
+		t.Errorf("cross-site API call with the session cookie: got status %d, want 403", code)
+	}
+
+	form := url.Values{"mac": {"02:00:00:00:22:77"}, "name": {"form"}}.Encode()
+	req = crossSitePost("/me/devices/add", "application/x-www-form-urlencoded", form)
+	req.AddCookie(cookie)
+	if code := serve(req); code != http.StatusForbidden {
+		t.Errorf("cross-site form: got status %d, want 403", code)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if code := serve(req); code != http.StatusForbidden {
+		t.Errorf("token outside /api: got status %d, want 403", code)
+	}
+
+	req = crossSitePost("/me/devices/add", "application/x-www-form-urlencoded", form)
+	req.Header.Set("Sec-Fetch-Site", "same-origin")
+	req.Header.Del("Origin")
+	req.AddCookie(cookie)
+	if code := serve(req); code == http.StatusForbidden {
+		t.Error("same-origin form rejected")
+	}
+}
+
+func TestAPITokenRevoke(t *testing.T) {
+	userID := createTestUser(t, "tokenowner", false)
+	other := createTestUser(t, "tokenthief", false)
+	token, stored, err := createAPIToken(userID, "script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		t.Errorf("token %q lacks the prefix", token)
+	}
+	router := csrfRouter()
+	list := func() int {
+		req := httptest.NewRequest(http.MethodGet, "/api/me/devices", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	revoke := func(userID int) int {
+		form := url.Values{"id": {strconv.Itoa(stored.ID)}}
+		req := httptest.NewRequest(http.MethodPost, "/me/tokens/revoke", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveAs(revokeTokenHandler, req, userID).Code
+	}
+
+	if code := list(); code != http.StatusOK {
+		t.Fatalf("valid token: got status %d", code)
+	}
+	if code := revoke(other); code != http.StatusNotFound {
+		t.Errorf("revoke by another user: got status %d", code)
+	}
+	if code := list(); code != http.StatusOK {
+		t.Fatalf("token stopped working after a foreign revoke: got status %d", code)
+	}
+	if code := revoke(userID); code != http.StatusSeeOther {
+		t.Fatalf("revoke: got status %d", code)
+	}
+	if code := list(); code != http.StatusUnauthorized {
+		t.Errorf("revoked token: got status %d", code)
+	}
+}
@@ -0,0 +1,102 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// Middleware: Konten ohne Pflichtattribute (z.B. von vor der Einführung)
+// werden zum Profil geschickt. Nur GET-Seiten, damit das Speichern der
+// Attribute und das Abmelden weiter gehen.
+func requireCompleteProfile(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uidVal := r.Context().Value(ctxUserID)
+		if uidVal == nil || r.Method != http.MethodGet || r.URL.Path == "/me" ||
+			r.Context().Value(ctxImpersonatorID) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		missing, err := db.MissingRequiredAttributes(uidVal.(int))
+		if err != nil {
+			// do not lock anybody out over this
+			log.Println(err)
+		} else if len(missing) > 0 {
+			http.Redirect(w, r, "/me", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	attributes, err := db.GetAttributes()
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attributes)
+}
+
+type createAttributeResponse struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// adminCreateAttributeHandler adds a name to the attribute vocabulary, which
+// members can then fill in on their profile.
+func adminCreateAttributeHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		apierror(w, r, "name is required", http.StatusBadRequest)
+		return
+	}
+	id, err := db.CreateAttribute(name)
+	if errors.Is(err, db.ErrDuplicate) {
+		apierror(w, r, "Attribute already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := db.AddAuditLog(r.Context().Value(ctxUserID).(int), 0, "attribute_created", name); err != nil {
+		log.Println(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createAttributeResponse{ID: id, Name: name})
+}
+
+// adminSetAttributeRequiredHandler sets whether an attribute has to be
+// given at registration. Existing accounts without it are asked to add it.
+func adminSetAttributeRequiredHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		apierror(w, r, "name is required", http.StatusBadRequest)
+		return
+	}
+	required := r.FormValue("required") == "true" || r.FormValue("required") == "1"
+	err := db.SetAttributeRequired(name, required)
+	if errors.Is(err, db.ErrNotFound) {
+		apierror(w, r, "Attribute not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	detail := name + " optional"
+	if required {
+		detail = name + " required"
+	}
+	if err := db.AddAuditLog(r.Context().Value(ctxUserID).(int), 0, "attribute_required", detail); err != nil {
+		log.Println(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,84 @@
+package web
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+const (
+	badgeOpenColor   = "#4c1"
+	badgeClosedColor = "#e05d44"
+	badgeLabelColor  = "#555"
+	maxBadgeLabel    = 40
+)
+
+// badgeTextWidth is a rough width for Verdana 11px, good enough to size the
+// boxes without font metrics.
+func badgeTextWidth(s string) int {
+	return utf8.RuneCountInString(s)*7 + 10
+}
+
+// badgeHandler renders a shields.io style SVG with the open state and the
+// number of people present. ?label= replaces the space name, ?style= is
+// "flat" (default) or "flat-square".
+func badgeHandler(w http.ResponseWriter, r *http.Request) {
+	label := r.URL.Query().Get("label")
+	if label == "" {
+		meta, err := db.GetSpaceMeta()
+		if err != nil {
+			apierror(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		label = meta.Name
+	}
+	if utf8.RuneCountInString(label) > maxBadgeLabel {
+		label = string([]rune(label)[:maxBadgeLabel])
+	}
+	radius := 3
+	switch r.URL.Query().Get("style") {
+	case "", "flat":
+	case "flat-square":
+		radius = 0
+	default:
+		apierror(w, r, "style must be flat or flat-square", http.StatusBadRequest)
+		return
+	}
+
+	count := len(arplib.OnlineSet())
+	status, color := "geschlossen", badgeClosedColor
+	if count > 0 {
+		status, color = "offen ("+strconv.Itoa(count)+")", badgeOpenColor
+	}
+
+	lw, sw := badgeTextWidth(label), badgeTextWidth(status)
+	total := lw + sw
+	label, status = html.EscapeString(label), html.EscapeString(status)
+	svg := fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">
+<title>%s: %s</title>
+<clipPath id="r"><rect width="%d" height="20" rx="%d" fill="#fff"/></clipPath>
+<g clip-path="url(#r)">
+<rect width="%d" height="20" fill="%s"/>
+<rect x="%d" width="%d" height="20" fill="%s"/>
+</g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%d" y="14">%s</text>
+<text x="%d" y="14">%s</text>
+</g>
+</svg>
+`, total, label, status, label, status, total, radius,
+		lw, badgeLabelColor, lw, sw, color,
+		lw/2, label, lw+sw/2, status)
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	// embedded in READMEs behind image proxies, keep it short so the state
+	// doesn't lag much behind a scan
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write([]byte(svg))
+}
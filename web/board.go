@@ -0,0 +1,95 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// boardMessage is the announcement shown on the board. It lives in the
+// BoardMessage and BoardMessageExpires settings.
+type boardMessage struct {
+	Message string     `json:"message"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// currentBoardMessage returns the board message, clearing it if it has
+// expired.
+func currentBoardMessage() (boardMessage, error) {
+	var msg boardMessage
+	text, err := db.GetSettingDefault("BoardMessage", "")
+	if err != nil || text == "" {
+		return msg, err
+	}
+	exp, err := db.GetSettingDefault("BoardMessageExpires", "")
+	if err != nil {
+		return msg, err
+	}
+	if exp != "" {
+		t, err := time.Parse(time.RFC3339, exp)
+		if err != nil {
+			return msg, err
+		}
+		if time.Now().After(t) {
+			return msg, clearBoardMessage()
+		}
+		msg.Expires = &t
+	}
+	msg.Message = text
+	return msg, nil
+}
+
+func clearBoardMessage() error {
+	if err := db.DeleteSetting("BoardMessage"); err != nil {
+		return err
+	}
+	return db.DeleteSetting("BoardMessageExpires")
+}
+
+func boardMessageHandler(w http.ResponseWriter, r *http.Request) {
+	msg, err := currentBoardMessage()
+	if err != nil {
+		apierror(w, r, "Failed to get board message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
+
+// setBoardMessageHandler sets the board message from the "message" form
+// value, an empty message clears it. "expires" is optional and takes an
+// RFC 3339 timestamp.
+func setBoardMessageHandler(w http.ResponseWriter, r *http.Request) {
+	text := strings.TrimSpace(r.FormValue("message"))
+	if text == "" {
+		if err := clearBoardMessage(); err != nil {
+			apierror(w, r, "Failed to clear board message: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	msg := boardMessage{Message: text}
+	exp := strings.TrimSpace(r.FormValue("expires"))
+	if exp != "" {
+		t, err := time.Parse(time.RFC3339, exp)
+		if err != nil {
+			apierror(w, r, "Invalid expires, expected RFC 3339: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		msg.Expires = &t
+	}
+	if err := db.SetSetting("BoardMessage", text); err != nil {
+		apierror(w, r, "Failed to set board message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := db.SetSetting("BoardMessageExpires", exp); err != nil {
+		apierror(w, r, "Failed to set board message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msg)
+}
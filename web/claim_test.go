@@ -0,0 +1,40 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+)
+
+func TestClaimIgnoresSpoofedHeader(t *testing.T) {
+	var got netip.Addr
+	r := chi.NewRouter()
+	r.Use(KeepPeerAddr)
+	r.Use(middleware.RealIP)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		got, _ = peerIP(r)
+	})
+	request := func() {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.10:40000"
+		req.Header.Set("X-Real-IP", "192.0.2.99")
+		req.Header.Set("X-Forwarded-For", "192.0.2.99")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	request()
+	if got != netip.MustParseAddr("192.0.2.10") {
+		t.Errorf("untrusted peer: got %s, want the peer address", got)
+	}
+
+	trustedProxies = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/28")}
+	t.Cleanup(func() { trustedProxies = nil })
+	request()
+	if got != netip.MustParseAddr("192.0.2.99") {
+		t.Errorf("trusted proxy: got %s, want the forwarded address", got)
+	}
+}
@@ -0,0 +1,235 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+	"github.com/go-chi/chi"
+)
+
+// DeviceView is a device as the API and the profile show it: the stored row
+// without salt and raw columns, plus the live presence from the scanner.
+type DeviceView struct {
+	ID         int    `json:"id"`
+	DeviceName string `json:"devicename"`
+	// MACAddress is the full stored hash, only used by the profile forms
+	MACAddress      string     `json:"-"`
+	MACHash         string     `json:"machash"`
+	Online          bool       `json:"online"`
+	CountsPresence  bool       `json:"counts_presence"`
+	Added           *time.Time `json:"added,omitempty"`
+	LastSeen        *time.Time `json:"last_seen,omitempty"`
+	HashScheme      int        `json:"hash_scheme"`
+	NeedsReregister bool       `json:"needs_reregister"`
+}
+
+func unixTime(v sql.NullInt64) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := time.Unix(v.Int64, 0)
+	return &t
+}
+
+func newDeviceView(d db.Device) DeviceView {
+	return DeviceView{
+		ID:              d.ID,
+		DeviceName:      d.DeviceName,
+		MACAddress:      d.MACAddress,
+		MACHash:         maskHash(d.MACAddress),
+		Online:          arplib.CheckDeviceIsPresent(d.ID),
+		CountsPresence:  d.CountsPresence,
+		Added:           unixTime(d.Added),
+		LastSeen:        unixTime(d.LastSeen),
+		HashScheme:      d.HashScheme,
+		NeedsReregister: d.NeedsReregister,
+	}
+}
+
+func deviceViews(devices []db.Device) []DeviceView {
+	views := make([]DeviceView, 0, len(devices))
+	for _, d := range devices {
+		views = append(views, newDeviceView(d))
+	}
+	return views
+}
+
+// seenBefore reports whether the device was last seen, or if never, added
+// before t. Devices from before this was tracked are never considered stale.
+func (d DeviceView) seenBefore(t time.Time) bool {
+	ref := d.LastSeen
+	if ref == nil {
+		ref = d.Added
+	}
+	return ref != nil && ref.Before(t)
+}
+
+// notifyNewDevice records a newly registered device in the audit log and
+// tells the owner by mail if they have a verified address, so a device added
+// by someone else on a compromised account does not go unnoticed. Failures
+// are only logged, the device is already stored.
+func notifyNewDevice(r *http.Request, userID int, name string, mac net.HardwareAddr) {
+	masked := maskMAC(mac)
+	actor := userID
+	if v := r.Context().Value(ctxImpersonatorID); v != nil {
+		actor = v.(int)
+	}
+	if err := db.AddAuditLog(actor, userID, "device_added", name+" "+masked); err != nil {
+		log.Println(err)
+	}
+	email, err := db.GetVerifiedEmail(userID)
+	if err != nil {
+		return
+	}
+	if name == "" {
+		name = "(ohne Namen)"
+	}
+	body := "Zu deinem Fahrmarke-Account wurde ein neues Gerät hinzugefügt:\n\n" +
+		"Name: " + name + "\nMAC: " + masked + "\nZeit: " + time.Now().Format("02.01.2006 15:04") + "\n\n" +
+		"Falls du das nicht warst, entferne das Gerät und ändere dein Passwort:\n" + baseURL(r) + "/me\n"
+	if err := sendMail(email, "Fahrmarke: Neues Gerät hinzugefügt", body); err != nil {
+		log.Println("Failed to notify user", userID, "about new device:", err)
+	}
+}
+
+// maskMAC keeps only the vendor part of a MAC, enough for members to
+// recognize their device.
+func maskMAC(mac net.HardwareAddr) string {
+	return arplib.OUI(mac) + ":xx:xx:xx"
+}
+
+// findUserDevice returns the device of the user registered for mac. Every
+// device has its own salt, so the MAC is hashed once per device.
+func findUserDevice(userID int, mac net.HardwareAddr) (db.Device, bool, error) {
+	devices, err := db.GetUserDevices(userID)
+	if err != nil {
+		return db.Device{}, false, err
+	}
+	for _, d := range devices {
+		if arplib.HashMACScheme(mac, d.Salt, d.HashScheme, d.HashIterations) == d.MACAddress {
+			return d, true, nil
+		}
+	}
+	return db.Device{}, false, nil
+}
+
+// registerDevice adds the device or renames it if the user already has it,
+// and reports whether it was new. An existing device is updated by id and
+// re-hashed if its scheme or iteration count is outdated, since the new hash
+// would not find its row.
+func registerDevice(r *http.Request, userID int, mac net.HardwareAddr, name string) (bool, error) {
+	existing, found, err := findUserDevice(userID, mac)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		if err := db.RenameDevice(userID, existing.ID, name); err != nil {
+			return false, err
+		}
+		if existing.HashScheme == arplib.CurrentHashScheme && existing.HashIterations == arplib.HashIterations() {
+			return false, nil
+		}
+		hashedMac := arplib.HashMAC(mac, existing.Salt)
+		return false, db.UpdateDeviceHash(userID, existing.ID, hashedMac, existing.Salt, arplib.CurrentHashScheme, arplib.HashIterations())
+	}
+	salt := generateRandomSalt(saltSize)
+	hashedMac := arplib.HashMAC(mac, salt)
+	created, err := db.AddOrUpdateDevice(userID, hashedMac, name, salt, arplib.CurrentHashScheme, arplib.HashIterations())
+	if err != nil {
+		return false, err
+	}
+	if created {
+		notifyNewDevice(r, userID, name, mac)
+	}
+	return created, nil
+}
+
+type addDeviceRequest struct {
+	MAC  string `json:"mac"`
+	Name string `json:"name"`
+}
+
+// apiAddDeviceHandler registers a device from a JSON body and answers with
+// the stored device, 201 if it is new and 200 if an existing one was renamed.
+func apiAddDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		apierror(w, r, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	var req addDeviceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&req); err != nil {
+		apierror(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	errs := fieldErrors{}
+	mac, err := net.ParseMAC(strings.TrimSpace(req.MAC))
+	if err != nil {
+		errs.add("mac", "invalid")
+	}
+	name := strings.TrimSpace(req.Name)
+	if err := validateDeviceName(name); err != nil {
+		errs.add("name", "too_long")
+	}
+	if len(errs) > 0 {
+		writeValidationJSON(w, errs)
+		return
+	}
+	created, err := registerDevice(r, userID, mac, name)
+	if err != nil {
+		apierror(w, r, "Error adding device: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	device, found, err := findUserDevice(userID, mac)
+	if err != nil || !found {
+		apierror(w, r, "Device was added but could not be loaded", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(newDeviceView(device))
+}
+
+func apiDeleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		apierror(w, r, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	mac, err := net.ParseMAC(chi.URLParam(r, "mac"))
+	if err != nil {
+		apierror(w, r, "Invalid MAC address", http.StatusBadRequest)
+		return
+	}
+	device, found, err := findUserDevice(userID, mac)
+	if err != nil {
+		apierror(w, r, "Failed to get devices: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		apierror(w, r, "Device not found", http.StatusNotFound)
+		return
+	}
+	err = db.DeleteUserDevice(userID, device.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		apierror(w, r, "Device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		apierror(w, r, "Error deleting device: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,160 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+	"github.com/go-chi/chi"
+)
+
+// withURLParam sets a chi URL parameter like the router does.
+func withURLParam(req *http.Request, key, value string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add(key, value)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func listMyDevices(t *testing.T, userID int) []DeviceView {
+	t.Helper()
+	w := serveAs(getMyDevicesHandler, httptest.NewRequest(http.MethodGet, "/api/me/devices", nil), userID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list: got status %d", w.Code)
+	}
+	var devices []DeviceView
+	if err := json.NewDecoder(w.Body).Decode(&devices); err != nil {
+		t.Fatal(err)
+	}
+	return devices
+}
+
+func TestDeviceAPI(t *testing.T) {
+	userID := createTestUser(t, "deviceapi", false)
+	add := func(body string, userID int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/me/devices", strings.NewReader(body))
+		return serveAs(apiAddDeviceHandler, req, userID)
+	}
+
+	if w := add(`{"mac": "02:00:00:00:12:62", "name": "phone"}`, 0); w.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous add: got status %d", w.Code)
+	}
+	if w := add(`{"mac": "not a mac", "name": "phone"}`, userID); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid MAC: got status %d", w.Code)
+	}
+
+	w := add(`{"mac": "02:00:00:00:12:62", "name": "phone"}`, userID)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add: got status %d: %s", w.Code, w.Body)
+	}
+	var created DeviceView
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == 0 || created.DeviceName != "phone" {
+		t.Errorf("add: got %+v", created)
+	}
+	if w := add(`{"mac": "02:00:00:00:12:62", "name": "old phone"}`, userID); w.Code != http.StatusOK {
+		t.Errorf("re-add: got status %d", w.Code)
+	}
+
+	devices := listMyDevices(t, userID)
+	if len(devices) != 1 || devices[0].ID != created.ID || devices[0].DeviceName != "old phone" {
+		t.Fatalf("list: got %+v", devices)
+	}
+
+	del := func() int {
+		req := withURLParam(httptest.NewRequest(http.MethodDelete, "/api/me/devices/02-00-00-00-12-62", nil), "mac", "02-00-00-00-12-62")
+		return serveAs(apiDeleteDeviceHandler, req, userID).Code
+	}
+	if code := del(); code != http.StatusNoContent {
+		t.Fatalf("delete: got status %d", code)
+	}
+	if devices := listMyDevices(t, userID); len(devices) != 0 {
+		t.Errorf("device left after delete: %+v", devices)
+	}
+	if code := del(); code != http.StatusNotFound {
+		t.Errorf("second delete: got status %d", code)
+	}
+}
+
+func TestDeleteDeviceInOtherMACFormat(t *testing.T) {
+	userID := createTestUser(t, "macformats", false)
+	form := func(h http.HandlerFunc, values url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveAs(h, req, userID)
+	}
+
+	if w := form(addDeviceHandler, url.Values{"mac": {"02-00-00-00-12-8A"}, "name": {"laptop"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("add: got status %d: %s", w.Code, w.Body)
+	}
+	if devices := listMyDevices(t, userID); len(devices) != 1 {
+		t.Fatalf("got %d devices after add", len(devices))
+	}
+	if w := form(deleteDeviceHandler, url.Values{"mac": {"02:00:00:00:12:8a"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("delete: got status %d: %s", w.Code, w.Body)
+	}
+	if devices := listMyDevices(t, userID); len(devices) != 0 {
+		t.Errorf("device left after delete: %+v", devices)
+	}
+}
+
+func TestReAddAfterIterationChange(t *testing.T) {
+	userID := createTestUser(t, "reiterated", false)
+	addTestDevice(t, userID, "02:00:00:00:12:80")
+	orig := arplib.HashIterations()
+	arplib.SetHashIterations(orig + 1)
+	t.Cleanup(func() { arplib.SetHashIterations(orig) })
+
+	mac, _ := net.ParseMAC("02:00:00:00:12:80")
+	req := httptest.NewRequest(http.MethodPost, "/me/devices/add", nil)
+	created, err := registerDevice(req, userID, mac, "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("re-adding reported a new device")
+	}
+	devices, err := db.GetUserDevices(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("got %d devices after re-adding", len(devices))
+	}
+	d := devices[0]
+	if d.DeviceName != "renamed" || d.HashIterations != orig+1 {
+		t.Errorf("got name %q and %d iterations, want %q and %d", d.DeviceName, d.HashIterations, "renamed", orig+1)
+	}
+	if arplib.HashMACScheme(mac, d.Salt, d.HashScheme, d.HashIterations) != d.MACAddress {
+		t.Error("stored hash does not match the MAC")
+	}
+}
+
+func TestRenameDeviceLimitsBody(t *testing.T) {
+	userID := createTestUser(t, "bigrename", false)
+	addTestDevice(t, userID, "02:00:00:00:11:94")
+	id := strconv.Itoa(listMyDevices(t, userID)[0].ID)
+	rename := func(body string) int {
+		req := withURLParam(httptest.NewRequest(http.MethodPost, "/api/me/devices/"+id+"/rename", strings.NewReader(body)), "id", id)
+		return serveAs(apiRenameDeviceHandler, req, userID).Code
+	}
+
+	if code := rename(`{"name": "phone"}`); code >= 300 {
+		t.Fatalf("rename: got status %d", code)
+	}
+	if code := rename(`{"name": "tablet"` + strings.Repeat(" ", 1<<12) + `}`); code != http.StatusBadRequest {
+		t.Errorf("oversized body: got status %d", code)
+	}
+	if name := listMyDevices(t, userID)[0].DeviceName; name != "phone" {
+		t.Errorf("got name %q after the oversized rename", name)
+	}
+}
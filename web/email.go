@@ -0,0 +1,202 @@
+package web
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+const emailVerificationLifetime = 24 * time.Hour
+
+type mailConfig struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	From     string
+}
+
+var mailer mailConfig
+
+// baseURLSetting overrides the URL used in links, e.g. when running behind a
+// proxy that rewrites the host. Mails carrying a secret token are only sent
+// with it set.
+var baseURLSetting string
+
+// errNoBaseURL refuses to mail token links without BaseURL: a link built from
+// the Host header of the request could point to an attacker's host, who then
+// gets the token as soon as the victim clicks.
+var errNoBaseURL = errors.New("BaseURL is not configured, refusing to mail a link built from the request host")
+
+// tokenLinkBase returns the configured BaseURL for links carrying a token.
+func tokenLinkBase() (string, error) {
+	if baseURLSetting == "" {
+		return "", errNoBaseURL
+	}
+	return strings.TrimRight(baseURLSetting, "/"), nil
+}
+
+// sendMail delivers a plain text mail. Without SMTP configuration the mail is
+// written to the log instead, which is enough for small setups and testing.
+func sendMail(to string, subject string, body string) error {
+	if mailer.Host == "" {
+		log.Println("Mail to " + to + ": " + subject + "\n" + body)
+		return nil
+	}
+	msg := "From: " + mailer.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body
+	var auth smtp.Auth
+	if mailer.User != "" {
+		auth = smtp.PlainAuth("", mailer.User, mailer.Password, mailer.Host)
+	}
+	err := smtp.SendMail(mailer.Host+":"+mailer.Port, auth, mailer.From, []string{to}, []byte(msg))
+	if err != nil {
+		return errors.New("Failed to send mail: " + err.Error())
+	}
+	return nil
+}
+
+func baseURL(r *http.Request) string {
+	if baseURLSetting != "" {
+		return strings.TrimRight(baseURLSetting, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// newSecretToken returns a random token for links sent to users and the hash
+// that gets stored in the database.
+func newSecretToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashSecretToken(token), nil
+}
+
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeEmail lower-cases the address and rejects anything that is not a
+// bare address.
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "", errors.New("Invalid email address")
+	}
+	return email, nil
+}
+
+func sendEmailVerification(userID int, email string) error {
+	base, err := tokenLinkBase()
+	if err != nil {
+		return err
+	}
+	token, hash, err := newSecretToken()
+	if err != nil {
+		return errors.New("Failed to generate token: " + err.Error())
+	}
+	if err := db.AddEmailVerification(userID, email, hash, time.Now().Add(emailVerificationLifetime)); err != nil {
+		return err
+	}
+	link := base + "/verify-email?token=" + token
+	return sendMail(email, "Fahrmarke: E-Mail-Adresse bestätigen",
+		"Bitte bestätige deine E-Mail-Adresse für Fahrmarke:\n\n"+link+"\n\nDer Link ist 24 Stunden gültig.\n")
+}
+
+func verificationError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errNoBaseURL) {
+		webError(w, r, "Error sending verification: "+err.Error(), "Email verification is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	webError(w, r, "Error sending verification: "+err.Error(), "Could not send verification mail", http.StatusInternalServerError)
+}
+
+func setEmailHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email != "" {
+		var err error
+		if email, err = normalizeEmail(email); err != nil {
+			profileValidationError(w, r, fieldErrors{"email": "invalid"})
+			return
+		}
+	}
+	if err := db.SetUserEmail(userID, email); err != nil {
+		webError(w, r, "Error setting email: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if email != "" {
+		if err := sendEmailVerification(userID, email); err != nil {
+			verificationError(w, r, err)
+			return
+		}
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+func resendVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	email, verified, err := db.GetUserEmail(userID)
+	if err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if email == "" || verified {
+		webError(w, r, "Nothing to verify", "", http.StatusBadRequest)
+		return
+	}
+	if err := sendEmailVerification(userID, email); err != nil {
+		verificationError(w, r, err)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		webError(w, r, "Missing token", "", http.StatusBadRequest)
+		return
+	}
+	_, err := db.VerifyEmail(hashSecretToken(token))
+	if errors.Is(err, db.ErrNotFound) {
+		webError(w, r, "Invalid or expired verification token", "", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		webError(w, r, "Error verifying email: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
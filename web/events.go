@@ -0,0 +1,128 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// StreamPaths answer with long running streams and must not be cut off by
+// the request timeout.
+var StreamPaths = map[string]bool{
+	"/api/events": true,
+	"/api/ws":     true,
+}
+
+// eventStreamSlots caps the open /api/events and /api/ws streams together,
+// sized by the MaxEventStreams setting. 0 turns both endpoints off.
+var eventStreamSlots = make(chan struct{}, 100)
+
+func acquireStream() bool {
+	select {
+	case eventStreamSlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseStream() {
+	<-eventStreamSlots
+}
+
+// eventKeepAlive is how often an idle stream sends a comment, so proxies
+// don't close it.
+const eventKeepAlive = 30 * time.Second
+
+var (
+	streamsDone     = make(chan struct{})
+	stopStreamsOnce sync.Once
+)
+
+// StopStreams ends all open event streams. Call it on shutdown, the server
+// would otherwise wait for them until its timeout.
+func StopStreams() {
+	stopStreamsOnce.Do(func() { close(streamsDone) })
+}
+
+// presenceStreamHandler streams a "presence" Server-Sent Event with the IDs
+// of the users that came or left whenever a scan changes the online set.
+func presenceStreamHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		apierror(w, r, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if !acquireStream() {
+		apierror(w, r, "Too many event streams, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseStream()
+	changes, cancel := arplib.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-streamsDone:
+			return
+		case c := <-changes:
+			c, err = visibleChange(c)
+			if err != nil {
+				log.Println("Failed to filter presence change:", err)
+				continue
+			}
+			if len(c.Online) == 0 && len(c.Offline) == 0 {
+				continue
+			}
+			data, _ := json.Marshal(c)
+			_, err = fmt.Fprintf(w, "event: presence\ndata: %s\n\n", data)
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// visibleChange drops hidden users from c, like the board does.
+func visibleChange(c arplib.Change) (arplib.Change, error) {
+	users, err := db.GetUsers()
+	if err != nil {
+		return arplib.Change{}, err
+	}
+	hidden := make(map[int]bool)
+	for _, u := range users {
+		if u.Hidden {
+			hidden[u.ID] = true
+		}
+	}
+	visible := func(ids []int) []int {
+		out := []int{}
+		for _, id := range ids {
+			if !hidden[id] {
+				out = append(out, id)
+			}
+		}
+		return out
+	}
+	return arplib.Change{Online: visible(c.Online), Offline: visible(c.Offline)}, nil
+}
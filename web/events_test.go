@@ -0,0 +1,67 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+func TestPresenceStream(t *testing.T) {
+	visible := createTestUser(t, "streamed", false)
+	hidden := createTestUser(t, "streamhidden", false)
+	if err := db.SetUserHidden(hidden, true); err != nil {
+		t.Fatal(err)
+	}
+	addTestDevice(t, visible, "02:00:00:00:12:74")
+	addTestDevice(t, hidden, "02:00:00:00:22:74")
+
+	srv := httptest.NewServer(http.HandlerFunc(presenceStreamHandler))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got Content-Type %q", ct)
+	}
+
+	// the headers came, so the handler subscribed before this scan
+	scanOnce(t, "02:00:00:00:12:74", "02:00:00:00:22:74")
+
+	sc := bufio.NewScanner(resp.Body)
+	var event string
+	for sc.Scan() {
+		line := sc.Text()
+		if v, ok := strings.CutPrefix(line, "event: "); ok {
+			event = v
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if event != "presence" {
+			t.Errorf("got event %q", event)
+		}
+		var c arplib.Change
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.Online) != 1 || c.Online[0] != visible || len(c.Offline) != 0 {
+			t.Errorf("got change %+v, want only user %d online", c, visible)
+		}
+		return
+	}
+	t.Fatal("stream ended without an event:", sc.Err())
+}
@@ -0,0 +1,55 @@
+package web
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// readyDBCheck is the database probe of /readyz.
+var readyDBCheck = db.Ping
+
+type readyResponse struct {
+	Ready    bool `json:"ready"`
+	Database struct {
+		OK bool `json:"ok"`
+	} `json:"database"`
+	Scanner struct {
+		OK       bool      `json:"ok"`
+		LastScan time.Time `json:"last_scan,omitzero"`
+		Age      string    `json:"age"`
+	} `json:"scanner"`
+}
+
+// healthzHandler answers as long as the process serves requests at all.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+// readyzHandler reports whether the database answers and the presence data
+// is fresh, with 503 if either is not the case. Errors only go to the log,
+// the endpoint is public.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	var resp readyResponse
+	if err := readyDBCheck(); err != nil {
+		log.Println("Readiness check:", err)
+	} else {
+		resp.Database.OK = true
+	}
+	age, stale := scanAge()
+	resp.Scanner.OK = !stale
+	resp.Scanner.LastScan = arplib.LastScanTime()
+	resp.Scanner.Age = age.String()
+	resp.Ready = resp.Database.OK && resp.Scanner.OK
+
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,45 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	w := serveAs(healthzHandler, httptest.NewRequest(http.MethodGet, "/healthz", nil), 0)
+	if w.Code != http.StatusOK || w.Body.String() != `{"ok":true}` {
+		t.Errorf("got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	scanOnce(t)
+	orig := readyDBCheck
+	t.Cleanup(func() { readyDBCheck = orig })
+
+	for _, tc := range []struct {
+		name   string
+		check  func() error
+		status int
+	}{
+		{"healthy", func() error { return nil }, http.StatusOK},
+		{"database down", func() error { return errors.New("database is locked") }, http.StatusServiceUnavailable},
+	} {
+		readyDBCheck = tc.check
+		w := serveAs(readyzHandler, httptest.NewRequest(http.MethodGet, "/readyz", nil), 0)
+		if w.Code != tc.status {
+			t.Errorf("%s: got status %d, want %d", tc.name, w.Code, tc.status)
+		}
+		var resp readyResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		dbOK := tc.status == http.StatusOK
+		if resp.Ready != dbOK || resp.Database.OK != dbOK || !resp.Scanner.OK {
+			t.Errorf("%s: got %+v", tc.name, resp)
+		}
+	}
+}
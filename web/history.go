@@ -0,0 +1,194 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+const (
+	// maxHistoryBuckets bounds a single page of the history API
+	maxHistoryBuckets    = 500
+	minHistoryBucket     = time.Minute
+	defaultHistoryBucket = time.Hour
+	defaultHistorySpan   = 7 * 24 * time.Hour
+	historyConcurrency   = 4
+	defaultMyHistoryDays = 7
+	maxMyHistoryDays     = 90
+)
+
+type historyResponse struct {
+	From    int64                `json:"from"`
+	To      int64                `json:"to"`
+	Bucket  int64                `json:"bucket"`
+	Buckets []db.OccupancyBucket `json:"buckets"`
+	// Next is the cursor for the following page, 0 on the last one
+	Next int64 `json:"next,omitempty"`
+}
+
+// unixParam parses an optional unix timestamp query parameter.
+func unixParam(r *http.Request, name string, fallback int64) (int64, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return fallback, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	return n, err == nil && n >= 0
+}
+
+// presenceHistoryHandler returns the occupancy between from and to (unix
+// seconds, default the last week) downsampled into buckets, ?bucket=1h by
+// default. Pages hold at most maxHistoryBuckets, ?cursor= continues after
+// the next value of the previous page.
+func presenceHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().Unix()
+	to, ok := unixParam(r, "to", now)
+	if !ok {
+		apierror(w, r, "Invalid to parameter", http.StatusBadRequest)
+		return
+	}
+	from, ok := unixParam(r, "from", to-int64(defaultHistorySpan/time.Second))
+	if !ok || from >= to {
+		apierror(w, r, "Invalid from parameter", http.StatusBadRequest)
+		return
+	}
+	bucket := defaultHistoryBucket
+	if v := r.URL.Query().Get("bucket"); v != "" {
+		var err error
+		bucket, err = time.ParseDuration(v)
+		if err != nil || bucket < minHistoryBucket || bucket%time.Second != 0 {
+			apierror(w, r, "Invalid bucket parameter, expected a duration of at least 1m", http.StatusBadRequest)
+			return
+		}
+	}
+	cursor, ok := unixParam(r, "cursor", -1)
+	if !ok {
+		apierror(w, r, "Invalid cursor parameter", http.StatusBadRequest)
+		return
+	}
+
+	// samples only change when a scan adds one, so the newest sample and
+	// the query identify the response
+	hw, err := db.GetOccupancyHighWater()
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256([]byte(strconv.FormatInt(hw, 10) + "?" + r.URL.RawQuery))
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	var modified time.Time
+	if hw > 0 {
+		modified = time.Unix(hw, 0)
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	width := int64(bucket / time.Second)
+	buckets, err := db.GetOccupancyBuckets(from, to, width, cursor, maxHistoryBuckets+1)
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := historyResponse{From: from, To: to, Bucket: width, Buckets: buckets}
+	if len(buckets) > maxHistoryBuckets {
+		resp.Buckets = buckets[:maxHistoryBuckets]
+		resp.Next = resp.Buckets[maxHistoryBuckets-1].Start
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// onlineWindow is a stretch of time in which a user was seen by every scan,
+// in unix seconds.
+type onlineWindow struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+type historyDay struct {
+	Date    string         `json:"date"`
+	Windows []onlineWindow `json:"windows"`
+}
+
+type myHistoryResponse struct {
+	Days []historyDay `json:"days"`
+}
+
+// onlineWindows merges sample times, oldest first, into windows. Samples at
+// most gap seconds apart belong to the same window, the same grace a user
+// stays online with. A sample stands for the scan interval after it, so a
+// window ends one interval after its last sample.
+func onlineWindows(times []int64, gap, interval int64) []onlineWindow {
+	var windows []onlineWindow
+	for _, t := range times {
+		if n := len(windows); n > 0 && t-(windows[n-1].To-interval) <= gap {
+			windows[n-1].To = t + interval
+			continue
+		}
+		windows = append(windows, onlineWindow{From: t, To: t + interval})
+	}
+	return windows
+}
+
+// historyDays cuts the windows into the given number of local calendar days
+// starting at first, a window over midnight ends up on both days.
+func historyDays(windows []onlineWindow, first time.Time, days int) []historyDay {
+	result := make([]historyDay, 0, days)
+	for i := 0; i < days; i++ {
+		start := first.AddDate(0, 0, i)
+		from, to := start.Unix(), start.AddDate(0, 0, 1).Unix()
+		day := historyDay{Date: start.Format(time.DateOnly), Windows: []onlineWindow{}}
+		for _, w := range windows {
+			if w.From >= to || w.To < from {
+				continue
+			}
+			day.Windows = append(day.Windows, onlineWindow{From: max(w.From, from), To: min(w.To, to)})
+		}
+		result = append(result, day)
+	}
+	return result
+}
+
+// myHistoryHandler returns when the user was present on each of the last
+// ?days= local days (7 by default), oldest first, based on the presence log.
+// Samples are written in batches, so the last minutes may be missing.
+func myHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		apierror(w, r, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	days := defaultMyHistoryDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxMyHistoryDays {
+			apierror(w, r, "Invalid days parameter, expected 1 to "+strconv.Itoa(maxMyHistoryDays), http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	now := time.Now()
+	first := time.Date(now.Year(), now.Month(), now.Day()-(days-1), 0, 0, 0, 0, time.Local)
+	times, err := db.GetUserPresenceTimes(uidVal.(int), first)
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	gap := int64(arplib.PresenceGrace() / time.Second)
+	interval := int64(arplib.ScanInterval() / time.Second)
+	resp := myHistoryResponse{Days: historyDays(onlineWindows(times, gap, interval), first, days)}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	"github.com/Nerdberg/fahrmarke/clock"
+)
+
+func TestMyHistory(t *testing.T) {
+	userID := createTestUser(t, "history", false)
+	addTestDevice(t, userID, "02:00:00:00:12:85")
+	mac, _ := net.ParseMAC("02:00:00:00:12:85")
+	nobody, _ := net.ParseMAC(nobodyMAC)
+	now := time.Now()
+	morning := time.Date(now.Year(), now.Month(), now.Day()-1, 10, 0, 0, 0, time.Local)
+	clk := clock.NewFake(morning)
+	arplib.SetClock(clk)
+	arplib.SetMissedScanGrace(2 * time.Minute)
+	t.Cleanup(func() {
+		arplib.SetClock(clock.Real{})
+		arplib.SetMissedScanGrace(time.Nanosecond)
+		runScan([]net.HardwareAddr{nobody})
+	})
+
+	// three scans in a row yesterday morning, one in the afternoon; every
+	// scan flushes the presence log when the ticker stops
+	for i := 0; i < 3; i++ {
+		runScan([]net.HardwareAddr{mac})
+		clk.Advance(time.Minute)
+	}
+	afternoon := morning.Add(4 * time.Hour)
+	clk.Set(afternoon)
+	runScan([]net.HardwareAddr{mac})
+	clk.Advance(time.Minute)
+	runScan([]net.HardwareAddr{nobody})
+
+	history := func(query string) (int, myHistoryResponse) {
+		t.Helper()
+		w := serveAs(myHistoryHandler, httptest.NewRequest(http.MethodGet, "/api/me/history"+query, nil), userID)
+		var resp myHistoryResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	code, resp := history("?days=2")
+	if code != http.StatusOK || len(resp.Days) != 2 {
+		t.Fatalf("got status %d and %d days", code, len(resp.Days))
+	}
+	yesterday, today := resp.Days[0], resp.Days[1]
+	if yesterday.Date != morning.Format(time.DateOnly) || today.Date != now.Format(time.DateOnly) {
+		t.Errorf("got days %s and %s", yesterday.Date, today.Date)
+	}
+	want := []onlineWindow{
+		{From: morning.Unix(), To: morning.Add(3 * time.Minute).Unix()},
+		{From: afternoon.Unix(), To: afternoon.Add(time.Minute).Unix()},
+	}
+	if len(yesterday.Windows) != len(want) {
+		t.Fatalf("got windows %+v, want %+v", yesterday.Windows, want)
+	}
+	for i, w := range yesterday.Windows {
+		if w != want[i] {
+			t.Errorf("window %d: got %+v, want %+v", i, w, want[i])
+		}
+	}
+	if len(today.Windows) != 0 {
+		t.Errorf("got windows today: %+v", today.Windows)
+	}
+
+	if code, resp := history(""); code != http.StatusOK || len(resp.Days) != defaultMyHistoryDays {
+		t.Errorf("default: got status %d and %d days", code, len(resp.Days))
+	}
+	if code, resp := history("?days=1"); code != http.StatusOK || len(resp.Days) != 1 || len(resp.Days[0].Windows) != 0 {
+		t.Errorf("today only: got status %d and %+v", code, resp.Days)
+	}
+	for _, q := range []string{"?days=0", "?days=91", "?days=x"} {
+		if code, _ := history(q); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d", q, code)
+		}
+	}
+}
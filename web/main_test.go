@@ -0,0 +1,111 @@
+package web
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestMain runs the tests against a fresh database and the bundled theme.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "fahrmarke-web")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.InitDB(filepath.Join(dir, "test.db")); err != nil {
+		log.Fatal(err)
+	}
+	th, err := loadTheme("..", "fahrmarke")
+	if err != nil {
+		log.Fatal(err)
+	}
+	currentTheme.Store(th)
+	bcryptCost = bcrypt.MinCost
+	// users go offline on the first scan that misses them
+	arplib.SetMissedScanGrace(time.Nanosecond)
+
+	code := m.Run()
+	db.CloseDB()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// createTestUser creates a user with the password "secret" and deletes it
+// when the test ends.
+func createTestUser(t *testing.T, username string, admin bool) int {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcryptCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var adminFlag int
+	if admin {
+		adminFlag = 1
+	}
+	id, err := db.CreateUser(username, string(hash), adminFlag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DeleteUser(id) })
+	return id
+}
+
+// sessionCookie starts a session for the user and returns its cookie.
+func sessionCookie(t *testing.T, userID int) *http.Cookie {
+	t.Helper()
+	sid, _, err := newSession(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Delete(sid) })
+	return &http.Cookie{Name: sessionCookieName, Value: sid}
+}
+
+// addTestDevice registers the MAC for the user like the profile form does.
+func addTestDevice(t *testing.T, userID int, mac string) {
+	t.Helper()
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/me/devices/add", nil)
+	if _, err := registerDevice(req, userID, hw, "test device"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nobodyMAC matches no registered device.
+const nobodyMAC = "02:00:00:00:00:00"
+
+// scanOnce runs a scan that sees exactly the given MACs. When the test ends
+// another scan takes everyone offline again.
+func scanOnce(t *testing.T, macs ...string) {
+	t.Helper()
+	var hws []net.HardwareAddr
+	for _, mac := range append(macs, nobodyMAC) {
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hws = append(hws, hw)
+	}
+	runScan(hws)
+	t.Cleanup(func() { runScan(hws[len(hws)-1:]) })
+}
+
+func runScan(macs []net.HardwareAddr) {
+	arplib.SetFakeScan(macs)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	arplib.StartScanTicker(ctx, []string{"lo"}, "127.0.0.1/32", time.Minute)()
+}
@@ -0,0 +1,55 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "fahrmarke_http_requests_total",
+	Help: "HTTP requests by route pattern and status code.",
+}, []string{"path", "code"})
+
+// metricsEnabled serves /metrics, from the Metrics setting. Off by default,
+// the endpoint has no authentication.
+var metricsEnabled = false
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequests,
+	)
+	metricsRegistry.MustRegister(arplib.Collectors()...)
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// CountRequests counts every request by its route pattern rather than the
+// raw path, so IDs and MACs in URLs don't create a series each.
+func CountRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		path := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			path = rctx.RoutePattern()
+		}
+		code := ww.Status()
+		if code == 0 {
+			code = http.StatusOK
+		}
+		httpRequests.WithLabelValues(path, strconv.Itoa(code)).Inc()
+	})
+}
@@ -0,0 +1,33 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrapeMetrics(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsAfterScan(t *testing.T) {
+	alice := createTestUser(t, "metricsalice", false)
+	bob := createTestUser(t, "metricsbob", false)
+	addTestDevice(t, alice, "02:00:00:00:12:73")
+	addTestDevice(t, bob, "02:00:00:00:22:73")
+	scanOnce(t, "02:00:00:00:12:73", "02:00:00:00:22:73")
+
+	body := scrapeMetrics(t)
+	for _, want := range []string{"\nfahrmarke_users_online 2\n", "\nfahrmarke_scan_devices_matched 2\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q:\n%s", strings.TrimSpace(want), body)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package web
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Showname policies, set through the ShownamePolicy setting.
+const (
+	namesShownameThenUsername = "showname_then_username"
+	namesShowname             = "showname"
+	namesUsername             = "username"
+	namesShort                = "short" // "Firstname L.", falling back to the username
+)
+
+var shownamePolicy = namesShownameThenUsername
+
+// formatName applies the showname policy. Every place that shows a member's
+// name goes through here.
+func formatName(showname, username string) string {
+	showname = strings.TrimSpace(showname)
+	switch shownamePolicy {
+	case namesShowname:
+		return showname
+	case namesUsername:
+		return username
+	case namesShort:
+		if showname == "" {
+			return username
+		}
+		return shortName(showname)
+	}
+	if showname == "" {
+		return username
+	}
+	return showname
+}
+
+// shortName turns "Ada Lovelace" into "Ada L.".
+func shortName(name string) string {
+	parts := strings.Fields(name)
+	if len(parts) < 2 {
+		return name
+	}
+	last, _ := utf8.DecodeRuneInString(parts[len(parts)-1])
+	return parts[0] + " " + string(last) + "."
+}
+
+// displayName is the template helper for themes: {{displayname .}}
+func displayName(u User) string {
+	return formatName(u.Showname, u.Username)
+}
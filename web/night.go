@@ -0,0 +1,21 @@
+package web
+
+import (
+	"time"
+)
+
+// nightStart and nightEnd are minutes after midnight, from the NightStart and
+// NightEnd settings. The window may wrap past midnight.
+var (
+	nightStart = 22 * 60
+	nightEnd   = 7 * 60
+)
+
+// isNight reports whether t falls into the night window, in local time.
+func isNight(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if nightStart <= nightEnd {
+		return m >= nightStart && m < nightEnd
+	}
+	return m >= nightStart || m < nightEnd
+}
@@ -0,0 +1,47 @@
+package web
+
+import (
+	"context"
+	"runtime"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptSlots limits how many bcrypt operations run at once, so a burst of
+// logins queues up instead of starving the scanner and other requests.
+var bcryptSlots = make(chan struct{}, runtime.GOMAXPROCS(0))
+
+func setBcryptConcurrency(n int) {
+	bcryptSlots = make(chan struct{}, n)
+}
+
+func acquireBcrypt(ctx context.Context) error {
+	select {
+	case bcryptSlots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func releaseBcrypt() {
+	<-bcryptSlots
+}
+
+// hashPassword hashes with the configured cost once a bcrypt slot is free.
+func hashPassword(ctx context.Context, password string) ([]byte, error) {
+	if err := acquireBcrypt(ctx); err != nil {
+		return nil, err
+	}
+	defer releaseBcrypt()
+	return bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+}
+
+// comparePassword checks password against hash once a bcrypt slot is free.
+func comparePassword(ctx context.Context, hash string, password string) error {
+	if err := acquireBcrypt(ctx); err != nil {
+		return err
+	}
+	defer releaseBcrypt()
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
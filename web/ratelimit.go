@@ -0,0 +1,110 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/clock"
+)
+
+// loginLimiter counts failed logins per key in fixed windows. A key that
+// reached max failures is refused until its window is over, so guessing
+// passwords costs the attacker time instead of costing us bcrypt rounds.
+type loginLimiter struct {
+	mu     sync.Mutex
+	clock  clock.Clock
+	max    int // 0 disables the limit
+	window time.Duration
+	fails  map[string]*failWindow
+}
+
+type failWindow struct {
+	start time.Time
+	count int
+}
+
+// loginLimitPrune is the number of tracked keys above which expired windows
+// are dropped, so a spray from many addresses can't grow the map forever.
+const loginLimitPrune = 1024
+
+var loginLimit = &loginLimiter{
+	clock:  clock.Real{},
+	max:    10,
+	window: 15 * time.Minute,
+	fails:  map[string]*failWindow{},
+}
+
+// configure sets the limit, max failures per window. 0 disables it.
+func (l *loginLimiter) configure(max int, window time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+	l.window = window
+}
+
+// loginKeys are the counters a login attempt is charged to: the username
+// and the address it came from.
+func loginKeys(r *http.Request, username string) []string {
+	keys := []string{"user:" + strings.ToLower(username)}
+	if ip, err := clientIP(r); err == nil {
+		keys = append(keys, "ip:"+ip.String())
+	}
+	return keys
+}
+
+// blocked reports whether any of the keys used up its failures, and how long
+// until that window ends.
+func (l *loginLimiter) blocked(keys []string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max == 0 {
+		return 0, false
+	}
+	now := l.clock.Now()
+	var wait time.Duration
+	for _, k := range keys {
+		f, ok := l.fails[k]
+		if !ok || f.count < l.max {
+			continue
+		}
+		if left := f.start.Add(l.window).Sub(now); left > wait {
+			wait = left
+		}
+	}
+	return wait, wait > 0
+}
+
+func (l *loginLimiter) fail(keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max == 0 {
+		return
+	}
+	now := l.clock.Now()
+	if len(l.fails) > loginLimitPrune {
+		for k, f := range l.fails {
+			if now.Sub(f.start) >= l.window {
+				delete(l.fails, k)
+			}
+		}
+	}
+	for _, k := range keys {
+		f, ok := l.fails[k]
+		if !ok || now.Sub(f.start) >= l.window {
+			f = &failWindow{start: now}
+			l.fails[k] = f
+		}
+		f.count++
+	}
+}
+
+// reset forgets the failures of the keys after a successful login.
+func (l *loginLimiter) reset(keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		delete(l.fails, k)
+	}
+}
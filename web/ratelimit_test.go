@@ -0,0 +1,50 @@
+package web
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/clock"
+)
+
+func TestLoginRateLimit(t *testing.T) {
+	createTestUser(t, "limited", false)
+	clk := clock.NewFake(time.Now())
+	orig := loginLimit
+	loginLimit = &loginLimiter{clock: clk, max: 3, window: time.Minute, fails: map[string]*failWindow{}}
+	t.Cleanup(func() { loginLimit = orig })
+	login := func(password string) *http.Response {
+		w := postForm(loginHandler, url.Values{"username": {"limited"}, "password": {password}})
+		if c := w.Result().Cookies(); len(c) > 0 {
+			session.Delete(c[0].Value)
+		}
+		return w.Result()
+	}
+
+	// a successful login forgets the failures before it
+	for i := 0; i < 2; i++ {
+		login("wrong")
+	}
+	if resp := login("secret"); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("login after 2 failures: got status %d", resp.StatusCode)
+	}
+	for i := 0; i < 3; i++ {
+		if resp := login("wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("failure %d after reset: got status %d", i+1, resp.StatusCode)
+		}
+	}
+
+	resp := login("secret")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("login over the limit: got status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("429 without Retry-After")
+	}
+	clk.Advance(time.Minute)
+	if resp := login("secret"); resp.StatusCode != http.StatusSeeOther {
+		t.Errorf("login after the window: got status %d", resp.StatusCode)
+	}
+}
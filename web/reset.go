@@ -0,0 +1,134 @@
+package web
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+const passwordResetLifetime = time.Hour
+
+type resetPage struct {
+	Sent  bool
+	Token string
+}
+
+// requestResetHandler mails a reset link if the username or email belongs to
+// an account with a verified address. The answer is the same either way so
+// the form can't be used to probe for accounts.
+func requestResetHandler(w http.ResponseWriter, r *http.Request) {
+	th := getActiveTheme()
+	switch r.Method {
+	case http.MethodGet:
+		if err := th.Tpl.ExecuteTemplate(w, "reset_request.html", resetPage{}); err != nil {
+			webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		base, err := tokenLinkBase()
+		if err != nil {
+			webError(w, r, "Password reset requested: "+err.Error(), "Password reset is not available", http.StatusServiceUnavailable)
+			return
+		}
+		login := strings.TrimSpace(r.FormValue("login"))
+		if login != "" {
+			link := base + "/reset/confirm?token="
+			// mailing happens in the background to keep the response time
+			// independent of whether the account exists
+			go sendPasswordReset(login, link)
+		}
+		if err := th.Tpl.ExecuteTemplate(w, "reset_request.html", resetPage{Sent: true}); err != nil {
+			webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func sendPasswordReset(login string, link string) {
+	var u db.User
+	var err error
+	if strings.Contains(login, "@") {
+		u, err = db.GetUserByEmail(strings.ToLower(login))
+	} else {
+		u, err = db.GetUserByUsername(login)
+	}
+	if err != nil {
+		log.Println("Password reset requested for unknown account:", err)
+		return
+	}
+	email, err := db.GetVerifiedEmail(u.ID)
+	if err != nil {
+		log.Println("Password reset requested for user", u.ID, "without verified email")
+		return
+	}
+	token, hash, err := newSecretToken()
+	if err != nil {
+		log.Println("Failed to generate reset token:", err)
+		return
+	}
+	if err := db.AddPasswordReset(u.ID, hash, time.Now().Add(passwordResetLifetime)); err != nil {
+		log.Println(err)
+		return
+	}
+	err = sendMail(email, "Fahrmarke: Passwort zurücksetzen",
+		"Für dein Fahrmarke-Konto "+u.Username+" wurde ein neues Passwort angefordert:\n\n"+link+token+
+			"\n\nDer Link ist eine Stunde gültig. Falls du das nicht warst, kannst du diese Mail ignorieren.\n")
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func confirmResetHandler(w http.ResponseWriter, r *http.Request) {
+	th := getActiveTheme()
+	token := r.FormValue("token")
+	switch r.Method {
+	case http.MethodGet:
+		if _, err := db.CheckPasswordReset(hashSecretToken(token)); err != nil {
+			webError(w, r, "Invalid reset token: "+err.Error(), "Invalid or expired link", http.StatusBadRequest)
+			return
+		}
+		if err := th.Tpl.ExecuteTemplate(w, "reset_confirm.html", resetPage{Token: token}); err != nil {
+			webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		p1 := r.FormValue("password")
+		p2 := r.FormValue("password2")
+		if p1 == "" || p1 != p2 {
+			webError(w, r, "Invalid input", "", http.StatusBadRequest)
+			return
+		}
+		// a guessed token must not cost a bcrypt slot, ResetPassword checks
+		// the token again in its transaction
+		if _, err := db.CheckPasswordReset(hashSecretToken(token)); errors.Is(err, db.ErrNotFound) {
+			webError(w, r, "Invalid reset token", "Invalid or expired link", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			webError(w, r, "Error checking reset token: "+err.Error(), "Password reset failed", http.StatusInternalServerError)
+			return
+		}
+		hash, err := hashPassword(r.Context(), p1)
+		if err != nil {
+			webError(w, r, "Error generating hash: "+err.Error(), "Password reset failed", http.StatusInternalServerError)
+			return
+		}
+		userID, err := db.ResetPassword(hashSecretToken(token), string(hash))
+		if errors.Is(err, db.ErrNotFound) {
+			webError(w, r, "Invalid reset token", "Invalid or expired link", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			webError(w, r, "Error resetting password: "+err.Error(), "Password reset failed", http.StatusInternalServerError)
+			return
+		}
+		// whoever knew the old password may still be logged in
+		n := session.DeleteUser(userID)
+		log.Println("Password reset for user", userID, "ended", n, "sessions")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
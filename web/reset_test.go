@@ -0,0 +1,69 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+func TestRequestResetNeedsBaseURL(t *testing.T) {
+	w := postForm(requestResetHandler, url.Values{"login": {"someone"}})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d without BaseURL, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestConfirmResetEndsSessions(t *testing.T) {
+	id := createTestUser(t, "forgetful", false)
+	cookie := sessionCookie(t, id)
+	if _, err := db.CreateAPIToken(id, "script", hashSecretToken("apitoken")); err != nil {
+		t.Fatal(err)
+	}
+	token, hash, err := newSecretToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddPasswordReset(id, hash, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := postForm(confirmResetHandler, url.Values{"token": {token}, "password": {"new"}, "password2": {"new"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	if _, ok := getSession(cookie.Value); ok {
+		t.Error("session still valid after password reset")
+	}
+	if _, err := db.ValidateAPIToken(hashSecretToken("apitoken"), time.Now()); !errors.Is(err, db.ErrNotFound) {
+		t.Error("API token still valid after password reset:", err)
+	}
+}
+
+func TestConfirmResetChecksTokenBeforeHashing(t *testing.T) {
+	// every bcrypt slot is taken, hashing would wait for the deadline
+	orig := bcryptSlots
+	bcryptSlots = make(chan struct{}, 1)
+	bcryptSlots <- struct{}{}
+	t.Cleanup(func() { bcryptSlots = orig })
+
+	form := url.Values{"token": {"guessed"}, "password": {"new"}, "password2": {"new"}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/reset/confirm", strings.NewReader(form.Encode())).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	confirmResetHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if ctx.Err() != nil {
+		t.Error("an invalid token waited for a bcrypt slot")
+	}
+}
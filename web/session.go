@@ -6,73 +6,335 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/Nerdberg/fahrmarke/clock"
+	db "github.com/Nerdberg/fahrmarke/dblib"
 )
 
 var sessionHMACKey = []byte("")
 
+// clockLeeway is the clock skew tolerated between the node that signed a
+// token and the one checking it, from the ClockSkewLeeway setting.
+var clockLeeway = 30 * time.Second
+
+// issuedAtValid rejects tokens issued further in the future than the leeway
+// allows and logs any skew it notices, which points at unsynced clocks.
+func issuedAtValid(iat time.Time, what string) bool {
+	skew := iat.Sub(session.clock.Now())
+	if skew > clockLeeway {
+		log.Println("Rejecting", what, "issued", skew, "in the future, check the clocks")
+		return false
+	}
+	if skew > time.Second {
+		log.Println("Clock skew of", skew, "seen on", what)
+	}
+	return true
+}
+
+// expired reports whether exp has passed, allowing for clockLeeway.
+func expired(exp time.Time) bool {
+	return session.clock.Now().After(exp.Add(clockLeeway))
+}
+
+// signSID appends the issue time and a signature over both.
 func signSID(sid string) string {
+	payload := sid + "." + strconv.FormatInt(session.clock.Now().Unix(), 10)
 	mac := hmac.New(sha256.New, sessionHMACKey)
-	mac.Write([]byte(sid))
+	mac.Write([]byte(payload))
 	sig := mac.Sum(nil)
-	return sid + "." + base64.RawURLEncoding.EncodeToString(sig[:16])
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig[:16])
 }
 
+// logoutToken binds a GET logout link to the session it ends.
+func logoutToken(sid string) string {
+	mac := hmac.New(sha256.New, sessionHMACKey)
+	mac.Write([]byte("logout:" + sid))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// logoutRedirect is where logout lands, from the LogoutRedirect setting.
+var logoutRedirect = "/login"
+
+// allowGetLogout enables GET /logout with a token, for themes that can't POST.
+var allowGetLogout = false
+
 func verifySignedSID(v string) bool {
 	parts := strings.Split(v, ".")
-	if len(parts) != 2 {
+	if len(parts) != 3 {
 		return false
 	}
-	sid, sig := parts[0], parts[1]
+	payload, sig := parts[0]+"."+parts[1], parts[2]
 
 	mac := hmac.New(sha256.New, sessionHMACKey)
-	mac.Write([]byte(sid))
+	mac.Write([]byte(payload))
 	want := base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
 
 	if !hmac.Equal([]byte(sig), []byte(want)) {
 		return false
 	}
-	return true
+	iat, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	return issuedAtValid(time.Unix(iat, 0), "session")
 }
 
 type sessionData struct {
 	UserID int
 	Exp    time.Time
+	// LastSeen is the last request made with the session, for the
+	// inactivity timeout.
+	LastSeen time.Time
+	// ImpersonatorID is the admin acting as UserID, 0 for normal sessions.
+	ImpersonatorID int
+	Created        time.Time
+	// savedSeen is the LastSeen last written to the database.
+	savedSeen time.Time
 }
 
+// sessionTouchInterval limits how often activity on a session is written
+// to the database. Losing less than that on a restart does not matter.
+const sessionTouchInterval = time.Minute
+
+// sessionStore keeps sessions in memory and writes them through to the
+// SESSIONS table so they survive restarts. Sessions are keyed by a hash of
+// the session id, the id itself is never stored.
 type sessionStore struct {
 	sync.RWMutex
 	sessions map[string]sessionData
+	// byUser holds the session keys of each user, oldest first
+	byUser map[int][]string
+	clock  clock.Clock
+}
+
+func sessionKey(sid string) string {
+	sum := sha256.Sum256([]byte(sid))
+	return hex.EncodeToString(sum[:])
 }
 
 func (s *sessionStore) Get(sid string) (sessionData, bool) {
 	s.RLock()
 	defer s.RUnlock()
-	sess, ok := s.sessions[sid]
+	sess, ok := s.sessions[sessionKey(sid)]
 	return sess, ok
 }
 
 func (s *sessionStore) Set(sid string, data sessionData) {
+	key := sessionKey(sid)
+	data.savedSeen = data.LastSeen
 	s.Lock()
-	defer s.Unlock()
-	s.sessions[sid] = data
+	if old, ok := s.sessions[key]; ok {
+		s.unindex(key, old.UserID)
+	}
+	s.sessions[key] = data
+	s.byUser[data.UserID] = append(s.byUser[data.UserID], key)
+	s.Unlock()
+
+	err := db.SaveSession(db.Session{
+		SIDHash:        key,
+		UserID:         data.UserID,
+		ImpersonatorID: data.ImpersonatorID,
+		Created:        data.Created.Unix(),
+		Expires:        data.Exp.Unix(),
+		LastSeen:       data.LastSeen.Unix(),
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Touch records activity on the session without reordering the index.
+func (s *sessionStore) Touch(sid string, now time.Time) {
+	key := sessionKey(sid)
+	s.Lock()
+	sess, ok := s.sessions[key]
+	if !ok {
+		s.Unlock()
+		return
+	}
+	sess.LastSeen = now
+	save := now.Sub(sess.savedSeen) >= sessionTouchInterval
+	if save {
+		sess.savedSeen = now
+	}
+	s.sessions[key] = sess
+	s.Unlock()
+
+	if save {
+		if err := db.TouchSession(key, now); err != nil {
+			log.Println(err)
+		}
+	}
 }
 
 func (s *sessionStore) Delete(sid string) {
+	s.remove(sessionKey(sid))
+}
+
+func (s *sessionStore) remove(key string) {
+	s.Lock()
+	if old, ok := s.sessions[key]; ok {
+		s.unindex(key, old.UserID)
+	}
+	delete(s.sessions, key)
+	s.Unlock()
+
+	if err := db.DeleteSession(key); err != nil {
+		log.Println(err)
+	}
+}
+
+// CleanupExpired deletes the sessions that are past Exp or idle for longer
+// than the inactivity timeout and returns how many were removed. getSession
+// only refuses those, without this they would stay in memory forever.
+func (s *sessionStore) CleanupExpired() int {
+	now := s.clock.Now()
+	s.Lock()
+	removed := 0
+	for key, sess := range s.sessions {
+		idle := inactivityTimeout > 0 && now.Sub(sess.LastSeen) > inactivityTimeout
+		if now.After(sess.Exp.Add(clockLeeway)) || idle {
+			s.unindex(key, sess.UserID)
+			delete(s.sessions, key)
+			removed++
+		}
+	}
+	s.Unlock()
+
+	if err := db.DeleteExpiredSessions(now.Add(-clockLeeway)); err != nil {
+		log.Println(err)
+	}
+	return removed
+}
+
+// Load fills the store with the unexpired sessions from the database.
+func (s *sessionStore) Load() error {
+	stored, err := db.LoadSessions(s.clock.Now())
+	if err != nil {
+		return err
+	}
 	s.Lock()
 	defer s.Unlock()
-	delete(s.sessions, sid)
+	for _, v := range stored {
+		seen := time.Unix(v.LastSeen, 0)
+		s.sessions[v.SIDHash] = sessionData{
+			UserID:         v.UserID,
+			Exp:            time.Unix(v.Expires, 0),
+			LastSeen:       seen,
+			ImpersonatorID: v.ImpersonatorID,
+			Created:        time.Unix(v.Created, 0),
+			savedSeen:      seen,
+		}
+		s.byUser[v.UserID] = append(s.byUser[v.UserID], v.SIDHash)
+	}
+	return nil
+}
+
+// unindex must be called with s locked.
+func (s *sessionStore) unindex(key string, userID int) {
+	sids := s.byUser[userID]
+	for i, v := range sids {
+		if v == key {
+			sids = append(sids[:i], sids[i+1:]...)
+			break
+		}
+	}
+	if len(sids) == 0 {
+		delete(s.byUser, userID)
+	} else {
+		s.byUser[userID] = sids
+	}
+}
+
+// EvictOldest deletes the oldest own sessions of the user so that at most
+// keep remain. Sessions of admins impersonating the user are not counted.
+func (s *sessionStore) EvictOldest(userID int, keep int) int {
+	s.RLock()
+	var own []string
+	for _, key := range s.byUser[userID] {
+		if s.sessions[key].ImpersonatorID == 0 {
+			own = append(own, key)
+		}
+	}
+	s.RUnlock()
+	evicted := 0
+	for len(own)-evicted > keep {
+		s.remove(own[evicted])
+		evicted++
+	}
+	return evicted
+}
+
+// DeleteUser ends every session of the user, e.g. after a password reset,
+// and returns how many there were.
+func (s *sessionStore) DeleteUser(userID int) int {
+	s.RLock()
+	keys := append([]string(nil), s.byUser[userID]...)
+	s.RUnlock()
+	for _, key := range keys {
+		s.remove(key)
+	}
+	return len(keys)
+}
+
+func (s *sessionStore) Count() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.sessions)
+}
+
+// sessionSweepInterval is how often expired sessions are reaped, from the
+// SessionSweepInterval setting.
+var sessionSweepInterval = 10 * time.Minute
+
+// StartSessionReaper removes expired sessions every sessionSweepInterval.
+// Call it after GetRouter, which loads the setting.
+func StartSessionReaper() {
+	ticker := time.NewTicker(sessionSweepInterval)
+	go func() {
+		for range ticker.C {
+			if n := session.CleanupExpired(); n > 0 {
+				log.Println("Reaped", n, "expired sessions")
+			}
+		}
+	}()
 }
 
 var session = sessionStore{
 	sessions: make(map[string]sessionData),
+	byUser:   make(map[int][]string),
+	clock:    clock.Real{},
 }
 
+// maxSessionsPerUser limits the sessions a user keeps on login, 0 means no
+// limit. 1 logs the user out everywhere else on each login.
+var maxSessionsPerUser = 0
+
 const sessionCookieName = "sid"
 
+// sessionLifetime is how long a session and its cookie stay valid, set from
+// the SessionLifetime setting.
+var sessionLifetime = 24 * time.Hour
+
+// inactivityTimeout ends sessions that were not used for that long, from the
+// InactivityTimeout setting. 0 disables it, sessions then live until Exp.
+var inactivityTimeout time.Duration
+
+// secureCookies marks the session cookie Secure. It is on when TLSCert and
+// TLSKey are configured, or with SecureCookies behind a TLS terminating proxy.
+var secureCookies = false
+
+// cookieSameSite is the SameSite mode of the session cookie, from the
+// CookieSameSite setting.
+var cookieSameSite = http.SameSiteLaxMode
+
 func newSession(userID int) (string, sessionData, error) {
 	b := make([]byte, 32)
 	if _, err := rand.Read(b); err != nil {
@@ -80,14 +342,50 @@ func newSession(userID int) (string, sessionData, error) {
 	}
 	sid := base64.RawURLEncoding.EncodeToString(b)
 	sid = signSID(sid)
+	now := session.clock.Now()
 	s := sessionData{
-		UserID: userID,
-		Exp:    time.Now().Add(24 * time.Hour),
+		UserID:   userID,
+		Exp:      now.Add(sessionLifetime),
+		LastSeen: now,
+		Created:  now,
 	}
 	session.Set(sid, s)
 	return sid, s, nil
 }
 
+func setSessionCookie(w http.ResponseWriter, sid string) {
+	writeSessionCookie(w, sid, sessionLifetime)
+}
+
+// writeSessionCookie sets the cookie to expire after remaining, or after the
+// inactivity timeout if that is shorter, so an idle browser drops it too.
+func writeSessionCookie(w http.ResponseWriter, sid string, remaining time.Duration) {
+	if inactivityTimeout > 0 && inactivityTimeout < remaining {
+		remaining = inactivityTimeout
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sid,
+		Path:     "/",
+		SameSite: cookieSameSite,
+		MaxAge:   int(remaining / time.Second),
+		HttpOnly: true,
+		Secure:   secureCookies,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		SameSite: cookieSameSite,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureCookies,
+	})
+}
+
 func getSession(sid string) (sessionData, bool) {
 	valid := verifySignedSID(sid)
 	if !valid {
@@ -95,9 +393,15 @@ func getSession(sid string) (sessionData, bool) {
 		return sessionData{}, false
 	}
 	s, ok := session.Get(sid)
-	if !ok || time.Now().After(s.Exp) {
+	now := session.clock.Now()
+	if !ok || expired(s.Exp) {
+		return sessionData{}, false
+	}
+	if inactivityTimeout > 0 && now.Sub(s.LastSeen) > inactivityTimeout {
+		session.Delete(sid)
 		return sessionData{}, false
 	}
+	session.Touch(sid, now)
 	return s, true
 }
 
@@ -113,13 +417,21 @@ func destroySession(sid string) {
 type ctxKey string
 
 const ctxUserID ctxKey = "uid"
+const ctxImpersonatorID ctxKey = "impersonator"
 
 func SessionMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c, err := r.Cookie(sessionCookieName)
 		if err == nil {
 			if s, ok := getSession(c.Value); ok {
+				if inactivityTimeout > 0 {
+					// push the cookie expiry along with the server side
+					writeSessionCookie(w, c.Value, s.Exp.Sub(session.clock.Now()))
+				}
 				ctx := context.WithValue(r.Context(), ctxUserID, s.UserID)
+				if s.ImpersonatorID != 0 {
+					ctx = context.WithValue(ctx, ctxImpersonatorID, s.ImpersonatorID)
+				}
 				r = r.WithContext(ctx)
 			}
 		}
@@ -137,3 +449,31 @@ func RequireAuth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Middleware: Admin Pflicht, nach RequireAuth verwenden
+func RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uidVal := r.Context().Value(ctxUserID)
+		if uidVal == nil {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		u, err := db.GetUserByID(uidVal.(int))
+		if err != nil || u.Admin != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Middleware: nicht während einer Impersonation erlaubt
+func denyImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(ctxImpersonatorID) != nil {
+			http.Error(w, "Not allowed while impersonating", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,159 @@
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/clock"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// fakeSessionClock drives the session store from a fake clock for the
+// duration of the test.
+func fakeSessionClock(t *testing.T) *clock.Fake {
+	t.Helper()
+	clk := clock.NewFake(time.Now())
+	orig := session.clock
+	session.clock = clk
+	t.Cleanup(func() { session.clock = orig })
+	return clk
+}
+
+func TestSessionExpiry(t *testing.T) {
+	clk := fakeSessionClock(t)
+	cookie := sessionCookie(t, createTestUser(t, "expiring", false))
+
+	clk.Advance(sessionLifetime)
+	if _, ok := getSession(cookie.Value); !ok {
+		t.Fatal("session expired within the clock skew leeway")
+	}
+	clk.Advance(clockLeeway + time.Second)
+	if _, ok := getSession(cookie.Value); ok {
+		t.Error("session still valid after its lifetime")
+	}
+}
+
+func TestSessionInactivitySlides(t *testing.T) {
+	clk := fakeSessionClock(t)
+	orig := inactivityTimeout
+	inactivityTimeout = 15 * time.Minute
+	t.Cleanup(func() { inactivityTimeout = orig })
+	cookie := sessionCookie(t, createTestUser(t, "idle", false))
+
+	// every use pushes the timeout along
+	for i := 0; i < 4; i++ {
+		clk.Advance(10 * time.Minute)
+		if _, ok := getSession(cookie.Value); !ok {
+			t.Fatalf("active session ended after %d uses", i)
+		}
+	}
+	clk.Advance(16 * time.Minute)
+	if _, ok := getSession(cookie.Value); ok {
+		t.Error("idle session still valid")
+	}
+}
+
+// restartSessions empties the in-memory store like a restart does and puts
+// the old contents back when the test ends.
+func restartSessions(t *testing.T) {
+	t.Helper()
+	session.Lock()
+	sessions, byUser := session.sessions, session.byUser
+	session.sessions = make(map[string]sessionData)
+	session.byUser = make(map[int][]string)
+	session.Unlock()
+	t.Cleanup(func() {
+		session.Lock()
+		session.sessions, session.byUser = sessions, byUser
+		session.Unlock()
+	})
+}
+
+func TestSessionSurvivesRestart(t *testing.T) {
+	userID := createTestUser(t, "restarted", false)
+	cookie := sessionCookie(t, userID)
+
+	restartSessions(t)
+	if _, ok := getSession(cookie.Value); ok {
+		t.Fatal("session valid before loading the store")
+	}
+	if err := session.Load(); err != nil {
+		t.Fatal(err)
+	}
+	s, ok := getSession(cookie.Value)
+	if !ok {
+		t.Fatal("session lost in the restart")
+	}
+	if s.UserID != userID {
+		t.Errorf("got user %d, want %d", s.UserID, userID)
+	}
+}
+
+func TestCleanupExpiredPurgesSessions(t *testing.T) {
+	clk := fakeSessionClock(t)
+	cookie := sessionCookie(t, createTestUser(t, "reaped", false))
+	created := clk.Now()
+
+	if n := session.CleanupExpired(); n != 0 {
+		t.Fatalf("removed %d live sessions", n)
+	}
+	// sessions other tests logged in with expire along with ours
+	live := session.Count()
+	clk.Advance(sessionLifetime + clockLeeway + time.Second)
+	if n := session.CleanupExpired(); n != live {
+		t.Errorf("removed %d sessions, want all %d", n, live)
+	}
+	if _, ok := session.Get(cookie.Value); ok {
+		t.Error("expired session still in memory")
+	}
+	// loading as of the creation time would still return an unpurged row
+	stored, err := db.LoadSessions(created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stored {
+		if s.SIDHash == sessionKey(cookie.Value) {
+			t.Error("expired session still in the database")
+		}
+	}
+}
+
+func TestSessionCookieFlags(t *testing.T) {
+	createTestUser(t, "cookies", false)
+	origSecure, origSameSite := secureCookies, cookieSameSite
+	t.Cleanup(func() { secureCookies, cookieSameSite = origSecure, origSameSite })
+
+	for _, tc := range []struct {
+		secure   bool
+		sameSite http.SameSite
+	}{
+		{false, http.SameSiteLaxMode},
+		{true, http.SameSiteStrictMode},
+		{true, http.SameSiteNoneMode},
+	} {
+		secureCookies, cookieSameSite = tc.secure, tc.sameSite
+		w := postForm(loginHandler, url.Values{"username": {"cookies"}, "password": {"secret"}})
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != sessionCookieName {
+			t.Fatalf("login set cookies %v", cookies)
+		}
+		c := cookies[0]
+		session.Delete(c.Value)
+		if !c.HttpOnly || c.Secure != tc.secure || c.SameSite != tc.sameSite || c.Path != "/" {
+			t.Errorf("secure %v, SameSite %v: got cookie %q", tc.secure, tc.sameSite, c.String())
+		}
+		if c.MaxAge != int(sessionLifetime/time.Second) {
+			t.Errorf("got Max-Age %d, want the session lifetime", c.MaxAge)
+		}
+
+		rec := httptest.NewRecorder()
+		clearSessionCookie(rec)
+		cleared := rec.Result().Cookies()[0]
+		if cleared.MaxAge >= 0 || !cleared.HttpOnly || cleared.Secure != tc.secure || cleared.SameSite != tc.sameSite {
+			t.Errorf("secure %v, SameSite %v: got clearing cookie %q", tc.secure, tc.sameSite, cleared.String())
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+	"github.com/go-chi/chi"
+)
+
+// shareScope is the only scope share tokens carry for now.
+const shareScope = "presence"
+
+// shareLinkLifetimes are the durations a member can pick for a share link.
+var shareLinkLifetimes = map[string]time.Duration{
+	"1h":   time.Hour,
+	"24h":  24 * time.Hour,
+	"168h": 7 * 24 * time.Hour,
+}
+
+// shareToken signs "scope:id:exp:iat". The row is still checked on every
+// visit, so deleting it revokes the link.
+func shareToken(id int, expires int64, issued int64) string {
+	payload := shareScope + ":" + strconv.Itoa(id) + ":" + strconv.FormatInt(expires, 10) + ":" + strconv.FormatInt(issued, 10)
+	mac := hmac.New(sha256.New, sessionHMACKey)
+	mac.Write([]byte("share:" + payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+var errInvalidShareToken = errors.New("invalid share token")
+
+// verifyShareToken checks signature, scope and expiry and returns the link ID.
+func verifyShareToken(token string) (int, error) {
+	enc, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return 0, errInvalidShareToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return 0, errInvalidShareToken
+	}
+	parts := strings.Split(string(payload), ":")
+	if len(parts) != 4 || parts[0] != shareScope {
+		return 0, errInvalidShareToken
+	}
+	id, err1 := strconv.Atoi(parts[1])
+	exp, err2 := strconv.ParseInt(parts[2], 10, 64)
+	iat, err3 := strconv.ParseInt(parts[3], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, errInvalidShareToken
+	}
+	if !hmac.Equal([]byte(token), []byte(shareToken(id, exp, iat))) {
+		return 0, errInvalidShareToken
+	}
+	if expired(time.Unix(exp, 0)) || !issuedAtValid(time.Unix(iat, 0), "share link") {
+		return 0, errInvalidShareToken
+	}
+	return id, nil
+}
+
+// shareLink is a share link as listed on the profile.
+type shareLink struct {
+	ID      int
+	URL     string
+	Expires time.Time
+}
+
+func (u *User) loadShareLinks(r *http.Request) error {
+	links, err := db.GetUserShareLinks(u.ID)
+	if err != nil {
+		return err
+	}
+	u.ShareLinks = nil
+	for _, l := range links {
+		u.ShareLinks = append(u.ShareLinks, shareLink{
+			ID:      l.ID,
+			URL:     baseURL(r) + "/share/" + shareToken(l.ID, l.Expires, l.Created),
+			Expires: time.Unix(l.Expires, 0),
+		})
+	}
+	return nil
+}
+
+func createShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	lifetime, ok := shareLinkLifetimes[r.FormValue("valid")]
+	if !ok {
+		profileValidationError(w, r, fieldErrors{"share": "invalid"})
+		return
+	}
+	if _, err := db.AddShareLink(uidVal.(int), time.Now().Add(lifetime)); err != nil {
+		webError(w, r, "Error creating share link: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+func revokeShareLinkHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		profileValidationError(w, r, fieldErrors{"share": "invalid"})
+		return
+	}
+	if err := db.DeleteShareLink(uidVal.(int), id); err != nil {
+		webError(w, r, "Error revoking share link: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+type sharePage struct {
+	Space   db.SpaceMeta
+	Open    bool
+	Present int
+	Expires time.Time
+}
+
+// sharedPresenceHandler shows open/closed and the head count to holders of
+// a share link, without login and without any names.
+func sharedPresenceHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := verifyShareToken(chi.URLParam(r, "token"))
+	if err != nil {
+		webError(w, r, "Share link rejected: "+err.Error(), "Link ungültig oder abgelaufen", http.StatusNotFound)
+		return
+	}
+	link, err := db.GetShareLink(id)
+	if errors.Is(err, db.ErrNotFound) {
+		webError(w, r, "Share link revoked", "Link ungültig oder abgelaufen", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	space, err := db.GetSpaceMeta()
+	if err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	present := len(arplib.OnlineSet())
+	page := sharePage{Space: space, Open: present > 0, Present: present, Expires: time.Unix(link.Expires, 0)}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := getActiveTheme().Tpl.ExecuteTemplate(w, "share.html", page); err != nil {
+		webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+	}
+}
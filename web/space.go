@@ -0,0 +1,192 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	"github.com/Nerdberg/fahrmarke/config"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+type spaceAPILocation struct {
+	Address string  `json:"address,omitempty"`
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+}
+
+type spaceAPIContact struct {
+	Email    string `json:"email,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+	Matrix   string `json:"matrix,omitempty"`
+	Mastodon string `json:"mastodon,omitempty"`
+}
+
+type spaceAPIState struct {
+	Open       bool   `json:"open"`
+	Lastchange int64  `json:"lastchange,omitempty"`
+	Message    string `json:"message,omitempty"`
+}
+
+// spaceAPIPeople is a sensors.people_now_present entry.
+type spaceAPIPeople struct {
+	Value       int    `json:"value"`
+	Location    string `json:"location,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type spaceAPISensors struct {
+	PeopleNowPresent []spaceAPIPeople `json:"people_now_present"`
+}
+
+// spaceAPIRooms are the rooms reported in people_now_present.
+var spaceAPIRooms []config.SpaceAPIRoom
+
+// peopleNowPresent counts the present users per configured room, followed by
+// the total. Without rooms only the total is reported.
+func peopleNowPresent(online map[int]bool) ([]spaceAPIPeople, error) {
+	var entries []spaceAPIPeople
+	for _, room := range spaceAPIRooms {
+		ids, err := db.GetUserIDsByTag(room.Tag)
+		if err != nil {
+			return nil, err
+		}
+		entry := spaceAPIPeople{Location: room.Location, Name: room.Name, Description: room.Description}
+		for _, id := range ids {
+			if online[id] {
+				entry.Value++
+			}
+		}
+		entries = append(entries, entry)
+	}
+	total := spaceAPIPeople{Value: len(online)}
+	if len(entries) > 0 {
+		total.Name = "total"
+	}
+	return append(entries, total), nil
+}
+
+// spaceAPIDocument follows the SpaceAPI schema, version 14 and 15.
+type spaceAPIDocument struct {
+	APICompatibility []string         `json:"api_compatibility"`
+	Space            string           `json:"space"`
+	Logo             string           `json:"logo"`
+	URL              string           `json:"url"`
+	Location         spaceAPILocation `json:"location"`
+	Contact          spaceAPIContact  `json:"contact"`
+	State            spaceAPIState    `json:"state"`
+	Sensors          spaceAPISensors  `json:"sensors"`
+}
+
+func spaceAPIHandler(w http.ResponseWriter, r *http.Request) {
+	meta, err := db.GetSpaceMeta()
+	if err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// fall back to our own URLs so the document stays valid before the
+	// space is configured
+	if meta.URL == "" {
+		meta.URL = baseURL(r) + "/"
+	}
+	if meta.Logo == "" {
+		meta.Logo = baseURL(r) + "/favicon.ico"
+	}
+	doc := spaceAPIDocument{
+		APICompatibility: []string{"14", "15"},
+		Space:            meta.Name,
+		Logo:             meta.Logo,
+		URL:              meta.URL,
+		Location:         spaceAPILocation{Address: meta.Address, Lat: meta.Lat, Lon: meta.Lon},
+		Contact: spaceAPIContact{
+			Email:    meta.Email,
+			Phone:    meta.Phone,
+			Matrix:   meta.Matrix,
+			Mastodon: meta.Mastodon,
+		},
+	}
+	online := arplib.OnlineSet()
+	doc.State.Open = len(online) > 0
+	if doc.Sensors.PeopleNowPresent, err = peopleNowPresent(online); err != nil {
+		apierror(w, r, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if t := arplib.LastPresenceChange(); !t.IsZero() {
+		doc.State.Lastchange = t.Unix()
+	}
+	if msg, err := currentBoardMessage(); err == nil {
+		doc.State.Message = msg.Message
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(doc)
+}
+
+type spacePage struct {
+	Meta  db.SpaceMeta
+	Saved bool
+	Error string
+}
+
+func adminSpaceHandler(w http.ResponseWriter, r *http.Request) {
+	th := getActiveTheme()
+	meta, err := db.GetSpaceMeta()
+	if err != nil {
+		webError(w, r, "Failed to get space meta: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	page := spacePage{Meta: meta, Saved: r.URL.Query().Get("saved") == "1"}
+	if err := th.Tpl.ExecuteTemplate(w, "space.html", page); err != nil {
+		webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+	}
+}
+
+func adminSetSpaceHandler(w http.ResponseWriter, r *http.Request) {
+	th := getActiveTheme()
+	meta := db.SpaceMeta{
+		Name:         strings.TrimSpace(r.FormValue("name")),
+		URL:          strings.TrimSpace(r.FormValue("url")),
+		Logo:         strings.TrimSpace(r.FormValue("logo")),
+		Address:      strings.TrimSpace(r.FormValue("address")),
+		Email:        strings.TrimSpace(r.FormValue("email")),
+		Phone:        strings.TrimSpace(r.FormValue("phone")),
+		Matrix:       strings.TrimSpace(r.FormValue("matrix")),
+		Mastodon:     strings.TrimSpace(r.FormValue("mastodon")),
+		OpeningHours: strings.TrimSpace(r.FormValue("opening_hours")),
+	}
+	var errMsg string
+	for _, c := range []struct {
+		key string
+		dst *float64
+	}{{"lat", &meta.Lat}, {"lon", &meta.Lon}} {
+		v := strings.TrimSpace(r.FormValue(c.key))
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			errMsg = "Invalid coordinates"
+		}
+		*c.dst = f
+	}
+	if errMsg == "" {
+		if err := meta.Validate(); err != nil {
+			errMsg = err.Error()
+		}
+	}
+	if errMsg != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		if err := th.Tpl.ExecuteTemplate(w, "space.html", spacePage{Meta: meta, Error: errMsg}); err != nil {
+			webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := db.SetSpaceMeta(meta); err != nil {
+		webError(w, r, "Failed to save space meta: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/admin/space?saved=1", http.StatusSeeOther)
+}
@@ -0,0 +1,87 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+func addTagHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	tag, err := db.NormalizeTag(r.FormValue("tag"))
+	if err != nil {
+		profileValidationError(w, r, fieldErrors{"tag": "invalid"})
+		return
+	}
+	if err := db.AddUserTag(uidVal.(int), tag); err != nil {
+		webError(w, r, "Error adding tag: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+func removeTagHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	tag, err := db.NormalizeTag(r.FormValue("tag"))
+	if err != nil {
+		webError(w, r, err.Error(), "", http.StatusBadRequest)
+		return
+	}
+	if err := db.RemoveUserTag(uidVal.(int), tag); err != nil {
+		webError(w, r, "Error removing tag: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+type presenceCountResponse struct {
+	Tag    string `json:"tag,omitempty"`
+	Online int    `json:"online"`
+	Total  int    `json:"total"`
+}
+
+// presenceCountHandler returns how many users are online, optionally only
+// those carrying ?tag=.
+func presenceCountHandler(w http.ResponseWriter, r *http.Request) {
+	var ids []int
+	resp := presenceCountResponse{}
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		var err error
+		if resp.Tag, err = db.NormalizeTag(tag); err != nil {
+			apierror(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ids, err = db.GetUserIDsByTag(resp.Tag); err != nil {
+			apierror(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		users, err := db.GetUsers()
+		if err != nil {
+			apierror(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, u := range users {
+			ids = append(ids, u.ID)
+		}
+	}
+	resp.Total = len(ids)
+	online := arplib.OnlineSet()
+	for _, id := range ids {
+		if online[id] {
+			resp.Online++
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
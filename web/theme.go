@@ -0,0 +1,150 @@
+package web
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// themeFS returns the file tree of a theme, either the directory
+// themes/<name> or the archive themes/<name>.zip. The directory wins if both
+// exist.
+func themeFS(base, name string) (fs.FS, error) {
+	dir := filepath.Join(base, "themes", name)
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		return os.DirFS(dir), nil
+	}
+	archive := dir + ".zip"
+	if _, err := os.Stat(archive); err != nil {
+		return nil, errors.New("theme directory not found: " + dir)
+	}
+	return openThemeZip(archive)
+}
+
+// openThemeZip reads a theme archive into memory. Entries that could escape
+// the archive root (absolute paths, "..", backslashes) are rejected. A zip
+// whose content sits in a single top level folder is accepted as well.
+func openThemeZip(archive string) (fs.FS, error) {
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		return nil, errors.New("failed to read theme archive: " + err.Error())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, errors.New("failed to open theme archive " + archive + ": " + err.Error())
+	}
+	for _, f := range zr.File {
+		name := strings.TrimSuffix(f.Name, "/")
+		if strings.Contains(f.Name, `\`) || !fs.ValidPath(name) {
+			return nil, errors.New("theme archive " + archive + " contains invalid path: " + f.Name)
+		}
+	}
+	var fsys fs.FS = zr
+	if !isDir(fsys, "templates") {
+		entries, err := fs.ReadDir(fsys, ".")
+		if err == nil && len(entries) == 1 && entries[0].IsDir() {
+			if sub, err := fs.Sub(fsys, entries[0].Name()); err == nil {
+				fsys = sub
+			}
+		}
+	}
+	return fsys, nil
+}
+
+func isDir(fsys fs.FS, name string) bool {
+	fi, err := fs.Stat(fsys, name)
+	return err == nil && fi.IsDir()
+}
+
+// ListThemes returns the names of the themes found in base/themes, from
+// directories as well as zip archives.
+func ListThemes(base string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(base, "themes"))
+	if err != nil {
+		return nil, errors.New("Failed to list themes: " + err.Error())
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		switch {
+		case e.IsDir():
+		case strings.HasSuffix(name, ".zip"):
+			name = strings.TrimSuffix(name, ".zip")
+		default:
+			continue
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// load from disk or a zip archive based on name
+func loadTheme(base, name string) (*Theme, error) {
+	fsys, err := themeFS(base, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// parse templates: themes/<name>/templates/*.html
+	if !isDir(fsys, "templates") {
+		return nil, errors.New("templates directory not found for theme " + name)
+	}
+	tpl, err := template.New(name).Funcs(templateFuncs).ParseFS(fsys, "templates/*.html")
+	if err != nil {
+		return nil, errors.New("failed to parse templates for theme " + name + ": " + err.Error())
+	}
+	if missing := missingTemplates(tpl); len(missing) > 0 {
+		return nil, errors.New("theme " + name + " is missing required templates: " + strings.Join(missing, ", "))
+	}
+
+	if !isDir(fsys, "static") {
+		return nil, errors.New("static directory not found for theme " + name)
+	}
+	static, err := fs.Sub(fsys, "static")
+	if err != nil {
+		return nil, errors.New("failed to open static directory for theme " + name + ": " + err.Error())
+	}
+
+	return &Theme{Name: name, Tpl: tpl, Static: static}, nil
+}
+
+// serveFS serves a single file from fsys. Directories are treated as missing
+// so there are no listings. Files that cannot seek, like those in a zip
+// archive, are read into memory first.
+func serveFS(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string) bool {
+	if !fs.ValidPath(name) {
+		return false
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		return false
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return false
+		}
+		content = bytes.NewReader(data)
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), content)
+	return true
+}
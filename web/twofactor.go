@@ -0,0 +1,269 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+const (
+	totpIssuer  = "Fahrmarke"
+	totpPeriod  = 30
+	totpDigits  = 6
+	totpSkew    = 1 // accepted periods before and after the current one
+	secretBytes = 20
+
+	backupCodeCount  = 10
+	backupCodeLength = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, secretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode computes the RFC 6238 code for the given time step.
+func totpCode(key []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code := strconv.Itoa(int(value % 1000000))
+	return strings.Repeat("0", totpDigits-len(code)) + code
+}
+
+func validateTOTP(secret string, code string, now time.Time) bool {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+	step := now.Unix() / totpPeriod
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		if hmac.Equal([]byte(totpCode(key, step+i)), []byte(code)) {
+			return true
+		}
+	}
+	return false
+}
+
+func totpURI(username string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + v.Encode()
+}
+
+var backupCodeLetters = []rune("abcdefghijkmnpqrstuvwxyz23456789")
+
+func generateBackupCode() string {
+	b := make([]rune, backupCodeLength)
+	for i := range b {
+		a, _ := rand.Int(rand.Reader, big.NewInt(int64(len(backupCodeLetters))))
+		b[i] = backupCodeLetters[a.Int64()]
+	}
+	return string(b[:backupCodeLength/2]) + "-" + string(b[backupCodeLength/2:])
+}
+
+// hashBackupCode normalizes the code the way a user might type it and hashes
+// it. The codes are random enough that a plain SHA-256 is sufficient.
+func hashBackupCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.ReplaceAll(code, "-", ""), " ", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// newBackupCodes replaces the backup codes of the user and returns the
+// plaintext codes, which are shown exactly once.
+func newBackupCodes(userID int) ([]string, error) {
+	codes := make([]string, backupCodeCount)
+	hashes := make([]string, backupCodeCount)
+	for i := range codes {
+		codes[i] = generateBackupCode()
+		hashes[i] = hashBackupCode(codes[i])
+	}
+	if err := db.ReplaceBackupCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// verifySecondFactor checks code against the TOTP secret or, failing that,
+// consumes a matching backup code. Users without 2FA always pass.
+func verifySecondFactor(userID int, code string) (bool, error) {
+	secret, enabled, err := db.GetTOTP(userID)
+	if err != nil {
+		return false, err
+	}
+	if !enabled {
+		return true, nil
+	}
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	if validateTOTP(secret, code, time.Now()) {
+		return true, nil
+	}
+	return db.UseBackupCode(userID, hashBackupCode(code))
+}
+
+type twoFactorPage struct {
+	Secret string
+	URI    string
+	Codes  []string
+}
+
+func twoFactorSetupHandler(w http.ResponseWriter, r *http.Request) {
+	th := getActiveTheme()
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	if _, enabled, err := db.GetTOTP(userID); err != nil {
+		webError(w, r, "Error loading 2FA state: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	} else if enabled {
+		webError(w, r, "2FA already enabled", "", http.StatusConflict)
+		return
+	}
+	u, err := db.GetUserByID(userID)
+	if err != nil {
+		webError(w, r, "Failed to get user: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		webError(w, r, "Error generating TOTP secret: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if err := db.SetTOTPSecret(userID, secret); err != nil {
+		webError(w, r, "Error storing TOTP secret: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	page := twoFactorPage{Secret: secret, URI: totpURI(u.Username, secret)}
+	if err := th.Tpl.ExecuteTemplate(w, "twofactor.html", page); err != nil {
+		webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+	}
+}
+
+func twoFactorEnableHandler(w http.ResponseWriter, r *http.Request) {
+	th := getActiveTheme()
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	secret, enabled, err := db.GetTOTP(userID)
+	if err != nil {
+		webError(w, r, "Error loading 2FA state: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if secret == "" || enabled {
+		webError(w, r, "No pending 2FA setup", "", http.StatusBadRequest)
+		return
+	}
+	if !validateTOTP(secret, strings.TrimSpace(r.FormValue("code")), time.Now()) {
+		webError(w, r, "Invalid 2FA code", "", http.StatusBadRequest)
+		return
+	}
+	if err := db.EnableTOTP(userID); err != nil {
+		webError(w, r, "Error enabling 2FA: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	codes, err := newBackupCodes(userID)
+	if err != nil {
+		webError(w, r, "Error generating backup codes: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if err := th.Tpl.ExecuteTemplate(w, "twofactor.html", twoFactorPage{Codes: codes}); err != nil {
+		webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+	}
+}
+
+func regenerateBackupCodesHandler(w http.ResponseWriter, r *http.Request) {
+	th := getActiveTheme()
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	if _, enabled, err := db.GetTOTP(userID); err != nil {
+		webError(w, r, "Error loading 2FA state: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	} else if !enabled {
+		webError(w, r, "2FA not enabled", "", http.StatusBadRequest)
+		return
+	}
+	codes, err := newBackupCodes(userID)
+	if err != nil {
+		webError(w, r, "Error generating backup codes: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if err := th.Tpl.ExecuteTemplate(w, "twofactor.html", twoFactorPage{Codes: codes}); err != nil {
+		webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+	}
+}
+
+func twoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	ok, err := verifySecondFactor(userID, r.FormValue("code"))
+	if err != nil {
+		webError(w, r, "Error verifying 2FA code: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		webError(w, r, "Invalid 2FA code", "", http.StatusBadRequest)
+		return
+	}
+	if err := db.DisableTOTP(userID); err != nil {
+		webError(w, r, "Error disabling 2FA: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+// loadTwoFactorState fills the 2FA fields shown on the profile page.
+func (u *User) loadTwoFactorState() error {
+	_, enabled, err := db.GetTOTP(u.ID)
+	if err != nil {
+		return errors.New("Failed to get 2FA state: " + err.Error())
+	}
+	u.TwoFactor = enabled
+	if enabled {
+		u.BackupCodes, err = db.CountBackupCodes(u.ID)
+		if err != nil {
+			return errors.New("Failed to count backup codes: " + err.Error())
+		}
+	}
+	return nil
+}
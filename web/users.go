@@ -0,0 +1,296 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+	"github.com/go-chi/chi"
+)
+
+// adminUser is a user as the admin user list shows it.
+type adminUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Showname string `json:"showname"`
+	Admin    bool   `json:"admin"`
+	Hidden   bool   `json:"hidden"`
+}
+
+type adminUsersPage struct {
+	Users   []adminUser
+	Message string
+	Errors  fieldErrors
+	// Username and Admin refill the create form after an error
+	Username string
+	Admin    bool
+}
+
+// adminUserRequest is the body of the create and password forms, sent as
+// form values by the admin page and as JSON by API clients.
+type adminUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Admin    bool   `json:"admin"`
+}
+
+func readAdminUserRequest(w http.ResponseWriter, r *http.Request) (adminUserRequest, error) {
+	var req adminUserRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&req)
+		return req, err
+	}
+	req.Username = r.FormValue("username")
+	req.Password = r.FormValue("password")
+	req.Admin = r.FormValue("admin") == "on" || r.FormValue("admin") == "true"
+	return req, nil
+}
+
+func loadAdminUsers() ([]adminUser, error) {
+	users, err := db.GetAllUsers()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]adminUser, 0, len(users))
+	for _, u := range users {
+		list = append(list, adminUser{
+			ID:       u.ID,
+			Username: u.Username,
+			Showname: u.Showname.String,
+			Admin:    u.Admin == 1,
+			Hidden:   u.Hidden,
+		})
+	}
+	return list, nil
+}
+
+func renderUsers(w http.ResponseWriter, r *http.Request, page adminUsersPage, status int) {
+	users, err := loadAdminUsers()
+	if err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	page.Users = users
+	w.WriteHeader(status)
+	if err := getActiveTheme().Tpl.ExecuteTemplate(w, "users.html", page); err != nil {
+		webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+	}
+}
+
+// usersValidationError answers a failed admin user form like
+// profileValidationError does for the profile.
+func usersValidationError(w http.ResponseWriter, r *http.Request, errs fieldErrors, req adminUserRequest) {
+	if wantsJSON(r) {
+		writeValidationJSON(w, errs)
+		return
+	}
+	renderUsers(w, r, adminUsersPage{Errors: errs, Username: req.Username, Admin: req.Admin}, http.StatusBadRequest)
+}
+
+// adminDone finishes a successful admin user action: JSON callers get
+// status, the admin page is reloaded with a message.
+func adminDone(w http.ResponseWriter, r *http.Request, status int, body any, msg string) {
+	if wantsJSON(r) {
+		if body == nil {
+			w.WriteHeader(status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+		return
+	}
+	http.Redirect(w, r, "/admin/users?msg="+url.QueryEscape(msg), http.StatusSeeOther)
+}
+
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	if wantsJSON(r) {
+		users, err := loadAdminUsers()
+		if err != nil {
+			apierror(w, r, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+		return
+	}
+	renderUsers(w, r, adminUsersPage{Message: r.URL.Query().Get("msg")}, http.StatusOK)
+}
+
+type createUserResponse struct {
+	ID int `json:"id"`
+}
+
+func adminCreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := readAdminUserRequest(w, r)
+	if err != nil {
+		apierror(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	errs := fieldErrors{}
+	if req.Username == "" {
+		errs.add("username", "required")
+	}
+	if req.Password == "" {
+		errs.add("password", "required")
+	}
+	if len(errs) > 0 {
+		usersValidationError(w, r, errs, req)
+		return
+	}
+	hash, err := hashPassword(r.Context(), req.Password)
+	if err != nil {
+		webError(w, r, "Error generating hash: "+err.Error(), "User creation failed", http.StatusInternalServerError)
+		return
+	}
+	admin := 0
+	if req.Admin {
+		admin = 1
+	}
+	id, err := db.CreateUser(req.Username, string(hash), admin)
+	if errors.Is(err, db.ErrDuplicate) {
+		usersValidationError(w, r, fieldErrors{"username": "exists"}, req)
+		return
+	}
+	if err != nil {
+		webError(w, r, "Error creating user: "+err.Error(), "User creation failed", http.StatusInternalServerError)
+		return
+	}
+	adminID := r.Context().Value(ctxUserID).(int)
+	detail := req.Username
+	if req.Admin {
+		detail += " (admin)"
+	}
+	if err := db.AddAuditLog(adminID, id, "user_created", detail); err != nil {
+		log.Println(err)
+	}
+	adminDone(w, r, http.StatusCreated, createUserResponse{ID: id}, "Nutzer "+req.Username+" angelegt")
+}
+
+// targetUser returns the user of the {id} URL parameter, answering the
+// request itself if there is none.
+func targetUser(w http.ResponseWriter, r *http.Request) (db.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		apierror(w, r, "Invalid user id", http.StatusBadRequest)
+		return db.User{}, false
+	}
+	u, err := db.GetUserByID(id)
+	if err != nil {
+		apierror(w, r, "User not found", http.StatusNotFound)
+		return db.User{}, false
+	}
+	return u, true
+}
+
+// adminResetPasswordHandler sets a new password and ends every session of
+// the user, so whoever knew the old one is logged out.
+func adminResetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	req, err := readAdminUserRequest(w, r)
+	if err != nil {
+		apierror(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Password == "" {
+		usersValidationError(w, r, fieldErrors{"password": "required"}, adminUserRequest{})
+		return
+	}
+	hash, err := hashPassword(r.Context(), req.Password)
+	if err != nil {
+		webError(w, r, "Error generating hash: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if err := db.SetUserPassword(target.ID, string(hash)); err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	n := session.DeleteUser(target.ID)
+	adminID := r.Context().Value(ctxUserID).(int)
+	if err := db.AddAuditLog(adminID, target.ID, "password_reset", strconv.Itoa(n)+" sessions ended"); err != nil {
+		log.Println(err)
+	}
+	adminDone(w, r, http.StatusNoContent, nil, "Passwort von "+target.Username+" gesetzt")
+}
+
+func adminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	target, ok := targetUser(w, r)
+	if !ok {
+		return
+	}
+	adminID := r.Context().Value(ctxUserID).(int)
+	if target.ID == adminID {
+		apierror(w, r, "Admins can't delete themselves here", http.StatusBadRequest)
+		return
+	}
+	err := db.DeleteUser(target.ID)
+	if errors.Is(err, db.ErrNotFound) {
+		apierror(w, r, "User not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	session.DeleteUser(target.ID)
+	if err := db.AddAuditLog(adminID, target.ID, "user_deleted", target.Username); err != nil {
+		log.Println(err)
+	}
+	adminDone(w, r, http.StatusNoContent, nil, "Nutzer "+target.Username+" gelöscht")
+}
+
+// deleteAccountHandler lets members delete their own account after
+// confirming with their password. The last admin can't, so the instance
+// stays manageable.
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	u, err := db.GetUserByID(userID)
+	if err != nil {
+		webError(w, r, "Failed to get user: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	withHash, err := db.GetUserByUsername(u.Username)
+	if err != nil {
+		webError(w, r, "Failed to get user: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if err := comparePassword(r.Context(), withHash.Password, r.FormValue("password")); err != nil {
+		profileValidationError(w, r, fieldErrors{"delete": "invalid"})
+		return
+	}
+	if u.Admin == 1 {
+		admins, err := db.CountAdmins()
+		if err != nil {
+			webError(w, r, err.Error(), "", http.StatusInternalServerError)
+			return
+		}
+		if admins <= 1 {
+			profileValidationError(w, r, fieldErrors{"delete": "last_admin"})
+			return
+		}
+	}
+	if err := db.DeleteUser(userID); err != nil {
+		webError(w, r, "Error deleting account: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	session.DeleteUser(userID)
+	if err := db.AddAuditLog(userID, userID, "account_deleted", u.Username); err != nil {
+		log.Println(err)
+	}
+	clearSessionCookie(w)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,120 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+	"github.com/go-chi/chi"
+)
+
+// adminRouter serves the admin routes behind the session middleware.
+func adminRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Use(SessionMiddleware)
+	r.Route("/admin", adminRoutes)
+	return r
+}
+
+func TestAdminCreateUser(t *testing.T) {
+	member := sessionCookie(t, createTestUser(t, "member", false))
+	admin := sessionCookie(t, createTestUser(t, "boss", true))
+	create := func(c *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/users", strings.NewReader(`{"username": "newbie", "password": "pw"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		req.AddCookie(c)
+		w := httptest.NewRecorder()
+		adminRouter().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := create(member); w.Code != http.StatusForbidden {
+		t.Fatalf("member: got status %d, want 403", w.Code)
+	}
+	if _, err := db.GetUserByUsername("newbie"); err == nil {
+		t.Fatal("member created a user")
+	}
+
+	w := create(admin)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("admin: got status %d: %s", w.Code, w.Body)
+	}
+	var resp createUserResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DeleteUser(resp.ID) })
+	u, err := db.GetUserByUsername("newbie")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.ID != resp.ID || u.Admin != 0 {
+		t.Errorf("got %+v, want non-admin user %d", u, resp.ID)
+	}
+}
+
+func TestDeleteAccountRemovesDevices(t *testing.T) {
+	userID := createTestUser(t, "leaving", false)
+	addTestDevice(t, userID, "02:00:00:00:12:65")
+	cookie := sessionCookie(t, userID)
+	deleteAccount := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"password": {password}}
+		req := httptest.NewRequest(http.MethodPost, "/me/delete", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serveAs(deleteAccountHandler, req, userID)
+	}
+
+	deleteAccount("wrong")
+	if _, err := db.GetUserByID(userID); err != nil {
+		t.Fatal("deleted with a wrong password")
+	}
+
+	w := deleteAccount("secret")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Fatalf("got status %d to %q, want a redirect to /login", w.Code, w.Header().Get("Location"))
+	}
+	if _, err := db.GetUserByID(userID); err == nil {
+		t.Error("user still exists")
+	}
+	devices, err := db.GetUserDevices(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 0 {
+		t.Errorf("devices left: %+v", devices)
+	}
+	if _, ok := getSession(cookie.Value); ok {
+		t.Error("session still valid")
+	}
+}
+
+func TestDebugNeedsAdmin(t *testing.T) {
+	r := chi.NewRouter()
+	GetAdminRouter(r)
+	member := sessionCookie(t, createTestUser(t, "debugmember", false))
+	admin := sessionCookie(t, createTestUser(t, "debugadmin", true))
+	get := func(cookies ...*http.Cookie) int {
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/goroutine?debug=1", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := get(); code != http.StatusSeeOther {
+		t.Errorf("anonymous: got status %d, want a redirect to the login", code)
+	}
+	if code := get(member); code != http.StatusForbidden {
+		t.Errorf("member: got status %d, want 403", code)
+	}
+	if code := get(admin); code != http.StatusOK {
+		t.Errorf("admin: got status %d", code)
+	}
+}
@@ -0,0 +1,58 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// fieldErrors maps form field names to an error code such as "required" or
+// "invalid". Themes turn the codes into text with the errtext helper.
+type fieldErrors map[string]string
+
+func (e fieldErrors) add(field string, code string) {
+	if _, ok := e[field]; !ok {
+		e[field] = code
+	}
+}
+
+var errorTexts = map[string]string{
+	"required":   "Pflichtfeld",
+	"invalid":    "Ungültige Eingabe",
+	"too_long":   "Zu lang",
+	"mismatch":   "Stimmt nicht überein",
+	"exists":     "Existiert bereits",
+	"last_admin": "Der letzte Admin kann sein Konto nicht löschen",
+}
+
+func errorText(code string) string {
+	if t, ok := errorTexts[code]; ok {
+		return t
+	}
+	return code
+}
+
+type validationResponse struct {
+	Errors fieldErrors `json:"errors"`
+}
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") ||
+		strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+}
+
+func writeValidationJSON(w http.ResponseWriter, errs fieldErrors) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(validationResponse{Errors: errs})
+}
+
+// profileValidationError answers a failed profile form, as JSON for API
+// callers and otherwise by rendering the profile again with the errors.
+func profileValidationError(w http.ResponseWriter, r *http.Request, errs fieldErrors) {
+	if wantsJSON(r) {
+		writeValidationJSON(w, errs)
+		return
+	}
+	renderProfile(w, r, errs, http.StatusBadRequest)
+}
@@ -0,0 +1,47 @@
+package web
+
+import (
+	"net/http"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+)
+
+// Board visibility modes, set through the BoardVisibility setting.
+const (
+	boardPublic  = "public"  // everyone sees the board
+	boardMembers = "members" // logged in users only
+	boardPrivate = "private" // admins only
+)
+
+var boardVisibility = boardPublic
+
+// boardAccess checks whether the request may see presence data. It returns
+// the HTTP status to reply with when it may not.
+func boardAccess(r *http.Request) (bool, int) {
+	if boardVisibility == boardPublic {
+		return true, 0
+	}
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		return false, http.StatusUnauthorized
+	}
+	if boardVisibility == boardMembers {
+		return true, 0
+	}
+	u, err := db.GetUserByID(uidVal.(int))
+	if err != nil || u.Admin != 1 {
+		return false, http.StatusForbidden
+	}
+	return true, 0
+}
+
+// Middleware: Board-Sichtbarkeit für API-Routen
+func requireBoardAccessAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, code := boardAccess(r); !ok {
+			apierror(w, r, "Board is not visible", code)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
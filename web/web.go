@@ -1,39 +1,68 @@
 package web
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"html/template"
+	"io"
+	"io/fs"
 	"log"
 	"math/big"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	csrf "filippo.io/csrf/gorilla"
 	"github.com/Nerdberg/fahrmarke/arplib"
+	"github.com/Nerdberg/fahrmarke/config"
 	db "github.com/Nerdberg/fahrmarke/dblib"
 	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
 	"golang.org/x/crypto/bcrypt"
 )
 
-const bcryptCost = 15
+// bcryptCost is the work factor for new password hashes, set from the
+// BcryptCost setting. Hashes with another cost are redone on the next login.
+var bcryptCost = 12
 
 type errorResponse struct {
 	Httpstatus   string `json:"httpstatus"`
 	Errormessage string `json:"errormessage"`
 	RequestURL   string `json:"requesturl"`
+	RequestID    string `json:"requestid,omitempty"`
+}
+
+// requestID returns the id middleware.RequestID assigned to the request and
+// echoes it in the X-Request-ID header, so members can quote it when
+// reporting an error.
+func requestID(w http.ResponseWriter, r *http.Request) string {
+	id := middleware.GetReqID(r.Context())
+	if id != "" {
+		w.Header().Set("X-Request-ID", id)
+	}
+	return id
 }
 
 func apierror(w http.ResponseWriter, r *http.Request, err string, httpcode int) {
-	log.Println(err)
-	er := errorResponse{strconv.Itoa(httpcode), err, r.URL.Path}
+	reqID := requestID(w, r)
+	log.Printf("[%s] %s", reqID, err)
+	er := errorResponse{strconv.Itoa(httpcode), err, r.URL.Path, reqID}
 	j, erro := json.Marshal(&er)
 	if erro != nil {
 		return
@@ -41,21 +70,46 @@ func apierror(w http.ResponseWriter, r *http.Request, err string, httpcode int)
 	http.Error(w, string(j), httpcode)
 }
 
-func webError(w http.ResponseWriter, err string, publicerr string, httpcode int) {
+func webError(w http.ResponseWriter, r *http.Request, err string, publicerr string, httpcode int) {
 	if publicerr == "" {
 		publicerr = err
 	}
-	log.Println(err)
+	reqID := requestID(w, r)
+	log.Printf("[%s] %s", reqID, err)
+	if reqID != "" {
+		publicerr += "\nRequest-ID: " + reqID
+	}
 	http.Error(w, publicerr, httpcode)
 }
 
 type User struct {
-	ID         int               `json:"-"`
+	ID         int               `json:"id"` // the key of /api/presence/batch
 	Username   string            `json:"-"`
-	Showname   string            `json:"name"`
+	Showname   string            `json:"-"`
+	Name       string            `json:"name"`
 	Attributes map[string]string `json:"attributes"`
-	Devices    []db.Device       `json:"-"`
+	Devices    []DeviceView      `json:"-"`
 	Online     bool              `json:"online"`
+	Hidden     bool              `json:"-"`
+	State      string            `json:"state"` // here, away or gone
+
+	TwoFactor   bool `json:"-"`
+	BackupCodes int  `json:"-"`
+	// Impersonating is set on the profile page while an admin views it
+	Impersonating bool        `json:"-"`
+	Email         string      `json:"-"`
+	EmailVerified bool        `json:"-"`
+	Tags          []string    `json:"-"`
+	ShareLinks    []shareLink `json:"-"`
+	// LogoutURL is a GET logout link for themes, only set with AllowGetLogout
+	LogoutURL string `json:"-"`
+	// StaleDevices is set on the profile page when none of the devices has
+	// been seen for staleDeviceAfter although scanning works
+	StaleDevices bool `json:"-"`
+	// MissingAttributes are the required attributes still to be filled in
+	MissingAttributes []string `json:"-"`
+	// Errors holds validation errors of the last profile form
+	Errors fieldErrors `json:"-"`
 }
 
 func (u *User) LoadDetails(devices, attributes bool) error {
@@ -64,7 +118,7 @@ func (u *User) LoadDetails(devices, attributes bool) error {
 		if err != nil {
 			return errors.New("Failed to get user devices: " + err.Error())
 		}
-		u.Devices = devs
+		u.Devices = deviceViews(devs)
 	}
 	if attributes {
 		attrs, err := db.GetUserAttributes(u.ID)
@@ -80,7 +134,9 @@ func dbUserToUser(dbUser db.User) User {
 	return User{
 		ID:       dbUser.ID,
 		Username: dbUser.Username,
-		Showname: dbUser.GetShowname(),
+		Showname: dbUser.Showname.String,
+		Name:     formatName(dbUser.Showname.String, dbUser.Username),
+		Hidden:   dbUser.Hidden,
 	}
 }
 
@@ -89,93 +145,526 @@ func getUsers(devices, attributes bool) ([]User, error) {
 	if err != nil {
 		return nil, errors.New("Failed to get users from DB: " + err.Error())
 	}
+	return toUsers(usersdb, devices, attributes)
+}
+
+// toUsers converts the visible users and fills in their presence.
+func toUsers(usersdb []db.User, devices, attributes bool) ([]User, error) {
+	online := arplib.OnlineSet()
+	states := arplib.PresenceStates()
 	var users []User
 	for _, u := range usersdb {
+		if u.Hidden {
+			continue
+		}
 		user := dbUserToUser(u)
 		if err := user.LoadDetails(devices, attributes); err != nil {
 			return nil, errors.New("Failed to load user details: " + err.Error())
 		}
-		user.Online = arplib.CheckUserIsPresent(u.ID)
+		user.Online = online[u.ID]
+		user.State = states[u.ID]
+		if user.State == "" {
+			user.State = arplib.StateGone
+		}
 		users = append(users, user)
 	}
 	return users, nil
 }
 
+const (
+	defaultUsersPage = 100
+	maxUsersPage     = 500
+)
+
+// usersPage is the /api/users response when paging with after or offset.
+type usersPage struct {
+	Users []User `json:"users"`
+	// NextCursor is the after value for the next page, 0 on the last one
+	NextCursor int `json:"next_cursor,omitempty"`
+	// NextOffset replaces NextCursor when paging with offset
+	NextOffset int `json:"next_offset,omitempty"`
+}
+
+// getUsersHandler lists the visible users. Without paging parameters it
+// returns all of them as an array. ?after=<id>&limit= pages by user ID and
+// stays consistent while the roster changes, ?offset=&limit= is there for
+// simple UIs; both return a usersPage. ?attr=name:value only returns users
+// with that attribute value and can't be combined with paging,
+// ?online=true|false filters by presence.
 func getUsersHandler(w http.ResponseWriter, r *http.Request) {
 	getDevices := false
 	getAttributes := true
-	users, err := getUsers(getDevices, getAttributes)
+	var usersdb []db.User
+	var err error
+	q := r.URL.Query()
+	paged := q.Has("after") || q.Has("offset") || q.Has("limit")
+	limit := defaultUsersPage
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxUsersPage {
+			apierror(w, r, "Invalid limit parameter, expected 1 to "+strconv.Itoa(maxUsersPage), http.StatusBadRequest)
+			return
+		}
+	}
+	if paged && q.Get("attr") != "" {
+		apierror(w, r, "attr can't be combined with paging", http.StatusBadRequest)
+		return
+	}
+	if paged && q.Has("after") && q.Has("offset") {
+		apierror(w, r, "Use either after or offset", http.StatusBadRequest)
+		return
+	}
+	var offset int
+	if paged {
+		var after int
+		if v := q.Get("after"); v != "" {
+			if after, err = strconv.Atoi(v); err != nil || after < 0 {
+				apierror(w, r, "Invalid after parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if v := q.Get("offset"); v != "" {
+			if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+				apierror(w, r, "Invalid offset parameter", http.StatusBadRequest)
+				return
+			}
+		}
+		if q.Has("offset") {
+			usersdb, err = db.GetUsersPage(offset, limit)
+		} else {
+			usersdb, err = db.GetUsersAfter(after, limit)
+		}
+	} else if attr := q.Get("attr"); attr != "" {
+		name, value, ok := strings.Cut(attr, ":")
+		if !ok || name == "" {
+			apierror(w, r, "Invalid attr parameter, expected name:value", http.StatusBadRequest)
+			return
+		}
+		usersdb, err = db.GetUsersByAttribute(name, value)
+	} else {
+		usersdb, err = db.GetUsers()
+	}
 	if err != nil {
 		apierror(w, r, "Failed to get users: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	json.NewEncoder(w).Encode(users)
+	users, err := toUsers(usersdb, getDevices, getAttributes)
+	if err != nil {
+		apierror(w, r, "Failed to get users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if o := r.URL.Query().Get("online"); o != "" {
+		want, err := strconv.ParseBool(o)
+		if err != nil {
+			apierror(w, r, "Invalid online parameter", http.StatusBadRequest)
+			return
+		}
+		filtered := []User{}
+		for _, u := range users {
+			if u.Online == want {
+				filtered = append(filtered, u)
+			}
+		}
+		users = filtered
+	}
+	if !paged {
+		json.NewEncoder(w).Encode(users)
+		return
+	}
+	page := usersPage{Users: users}
+	if page.Users == nil {
+		page.Users = []User{}
+	}
+	// the cursor follows the database rows, hidden or filtered users may
+	// make a page shorter than limit without it being the last
+	if len(usersdb) == limit {
+		if q.Has("offset") {
+			page.NextOffset = offset + limit
+		} else {
+			page.NextCursor = usersdb[len(usersdb)-1].ID
+		}
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// presentTextHandler lists the names of the present members, one per line,
+// followed by their number. Meant for signs and shell scripts.
+func presentTextHandler(w http.ResponseWriter, r *http.Request) {
+	users, err := getUsers(false, false)
+	if err != nil {
+		webError(w, r, "Failed to get users: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	var b strings.Builder
+	count := 0
+	for _, u := range users {
+		if !u.Online {
+			continue
+		}
+		b.WriteString(strings.ReplaceAll(u.Name, "\n", " ") + "\n")
+		count++
+	}
+	b.WriteString(strconv.Itoa(count) + "\n")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+func setHiddenHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	hidden := r.FormValue("hidden") == "on"
+	if err := db.SetUserHidden(uidVal.(int), hidden); err != nil {
+		webError(w, r, "Error setting hidden: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+// caller returns the id of the logged in user, 0 for anonymous requests, and
+// whether the user is an admin. Both may see hidden users: the admin all of
+// them, the user only itself.
+func caller(r *http.Request) (int, bool) {
+	callerID, _ := r.Context().Value(ctxUserID).(int)
+	if callerID == 0 {
+		return 0, false
+	}
+	u, err := db.GetUserByID(callerID)
+	return callerID, err == nil && u.Admin == 1
+}
+
+const maxPresenceBatch = 500
+
+// presenceBatchHandler answers {"<id>": online} for a JSON array of user ids.
+// Unknown ids are left out, hidden users are null unless the caller is the
+// user or an admin.
+func presenceBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var ids []int
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&ids); err != nil {
+		apierror(w, r, "Invalid request body, expected an array of user ids: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(ids) > maxPresenceBatch {
+		apierror(w, r, "Too many ids, at most "+strconv.Itoa(maxPresenceBatch)+" allowed", http.StatusBadRequest)
+		return
+	}
+	usersdb, err := db.GetUsers()
+	if err != nil {
+		apierror(w, r, "Failed to get users: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	hidden := make(map[int]bool, len(usersdb))
+	for _, u := range usersdb {
+		hidden[u.ID] = u.Hidden
+	}
+	callerID, isAdmin := caller(r)
+	online := arplib.OnlineSet()
+	resp := make(map[string]*bool, len(ids))
+	for _, id := range ids {
+		h, ok := hidden[id]
+		if !ok {
+			continue
+		}
+		key := strconv.Itoa(id)
+		if h && id != callerID && !isAdmin {
+			resp[key] = nil
+			continue
+		}
+		o := online[id]
+		resp[key] = &o
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+const maxPresenceEvents = 1000
+
+type presenceEventsResponse struct {
+	Events []db.PresenceEvent `json:"events"`
+	Seq    int64              `json:"seq"`
+}
+
+// getPresenceEventsHandler returns the presence transitions after ?since=<seq>.
+// Seq in the response is the value to pass as since on the next poll. Like on
+// the board, hidden users are left out for everyone but themselves and
+// admins.
+func getPresenceEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			apierror(w, r, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	callerID, isAdmin := caller(r)
+	events, err := db.GetPresenceEventsSince(since, maxPresenceEvents, callerID, isAdmin)
+	if err != nil {
+		apierror(w, r, "Failed to get presence events: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp := presenceEventsResponse{Events: events, Seq: since}
+	if len(events) > 0 {
+		resp.Seq = events[len(events)-1].Seq
+	} else {
+		// nothing new, still report the current high water mark so a client
+		// with a pruned or bogus cursor can resync
+		seq, err := db.GetPresenceEventsHighWater()
+		if err != nil {
+			apierror(w, r, "Failed to get presence events: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if seq < since {
+			resp.Seq = seq
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// maskHash shortens a stored device hash so the API never hands out enough of
+// it to be useful for offline guessing.
+func maskHash(hash string) string {
+	if len(hash) <= 8 {
+		return hash
+	}
+	return hash[:8] + "…"
+}
+
+func getMyDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		apierror(w, r, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	devices, err := db.GetUserDevices(uidVal.(int))
+	if err != nil {
+		apierror(w, r, "Failed to get devices: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body, err := json.Marshal(deviceViews(devices))
+	if err != nil {
+		apierror(w, r, "Failed to encode devices: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	modified := arplib.LastPresenceChange()
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// notModified implements the conditional GET rules: If-None-Match wins over
+// If-Modified-Since when both are present.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimSpace(t)
+			if t == etag || t == "W/"+etag || t == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		if err == nil && !modified.Truncate(time.Second).After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+type renameDeviceRequest struct {
+	Name string `json:"name"`
+}
+
+func apiRenameDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		apierror(w, r, "Not logged in", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	deviceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		apierror(w, r, "Invalid device id", http.StatusBadRequest)
+		return
+	}
+	var req renameDeviceRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&req); err != nil {
+		apierror(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if err := validateDeviceName(name); err != nil {
+		writeValidationJSON(w, fieldErrors{"name": "too_long"})
+		return
+	}
+	err = db.RenameDevice(userID, deviceID, name)
+	if errors.Is(err, db.ErrNotFound) {
+		apierror(w, r, "Device not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		apierror(w, r, "Error renaming device: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pingHandler is the cheapest possible liveness check for uptime monitors, it
+// touches neither the database nor the scanner.
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+// QuietPaths are polled frequently by monitors and not worth a log line.
+var QuietPaths = map[string]bool{
+	"/api/ping": true,
+	"/healthz":  true,
+	"/readyz":   true,
+	"/metrics":  true,
 }
 
 func getAPIRouter(r *chi.Mux) {
 	r.Route("/api", func(r chi.Router) {
-		r.Get("/users", getUsersHandler)
+		r.Get("/ping", pingHandler)
+		r.Group(func(r chi.Router) {
+			r.Use(requireBoardAccessAPI)
+			r.Get("/users", getUsersHandler)
+			r.Get("/presence/events", getPresenceEventsHandler)
+			r.Get("/presence/count", presenceCountHandler)
+			r.Get("/events", presenceStreamHandler)
+			r.Get("/ws", presenceSocketHandler)
+			// aggregating is the expensive part, don't let clients pile up
+			r.With(middleware.Throttle(historyConcurrency)).Get("/presence/history", presenceHistoryHandler)
+			r.Post("/presence/batch", presenceBatchHandler)
+			r.Get("/spaceapi.json", spaceAPIHandler)
+			r.Get("/present.txt", presentTextHandler)
+			r.Get("/badge.svg", badgeHandler)
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(RequireAPIAuth)
+			r.Get("/me/devices", getMyDevicesHandler)
+			r.Post("/me/devices", apiAddDeviceHandler)
+			r.Delete("/me/devices/{mac}", apiDeleteDeviceHandler)
+			r.Post("/me/devices/{id}/rename", apiRenameDeviceHandler)
+			r.Get("/me/history", myHistoryHandler)
+			r.Post("/me/tokens", apiCreateTokenHandler)
+		})
 	})
 }
 
 type Theme struct {
-	Name      string
-	Tpl       *template.Template
-	StaticDir string
+	Name   string
+	Tpl    *template.Template
+	Static fs.FS
 }
 
 var currentTheme atomic.Value // stores *Theme
 
+var templateFuncs = template.FuncMap{
+	"asset":       assetURL,
+	"errtext":     errorText,
+	"displayname": displayName,
+}
+
+// assetURL returns the URL of a file in the shared assets directory.
+func assetURL(name string) string {
+	return path.Join("/assets", name)
+}
+
 func getActiveTheme() *Theme {
 	return currentTheme.Load().(*Theme)
 }
 
-// load from disk or embed based on name
-func loadTheme(base, name string) (*Theme, error) {
-	dir := filepath.Join(base, "themes", name)
-
-	// ensure dir exists
-	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
-		return nil, errors.New("theme directory not found: " + dir)
-	}
+// RequiredTemplates lists the templates every theme has to provide, a theme
+// missing any of them is rejected at load time.
+var RequiredTemplates = []string{
+	"index.html",
+	"login.html",
+	"register.html",
+	"profile.html",
+	"claim.html",
+	"twofactor.html",
+	"reset_request.html",
+	"reset_confirm.html",
+	"space.html",
+	"share.html",
+	"users.html",
+	"tokens.html",
+}
 
-	// parse templates: themes/<name>/templates/*.html
-	tmplDir := filepath.Join(dir, "templates")
-	pattern := filepath.Join(tmplDir, "*.html")
-	tpl, err := template.ParseGlob(pattern)
-	if err != nil {
-		return nil, errors.New("failed to parse templates for theme " + name + ": " + err.Error())
+func missingTemplates(tpl *template.Template) []string {
+	var missing []string
+	for _, name := range RequiredTemplates {
+		if tpl.Lookup(name) == nil {
+			missing = append(missing, name)
+		}
 	}
+	return missing
+}
 
-	staticPath := filepath.Join(dir, "static")
-	if fi, err := os.Stat(staticPath); err != nil || !fi.IsDir() {
-		return nil, errors.New("static directory not found for theme " + name + ": " + staticPath)
-	}
+type registerPage struct {
+	Username string
+	// Required are the attributes to fill in at sign-up
+	Required []requiredAttribute
+	Errors   fieldErrors
+}
 
-	return &Theme{Name: name, Tpl: tpl, StaticDir: staticPath}, nil
+type requiredAttribute struct {
+	Name  string
+	Field string // form field name, "attr_" + Name
+	Value string
 }
 
-// read 'Theme' from SETTINGS, load and swap
-func reloadThemeFromDB(datadir string) (*Theme, error) {
-	name, err := db.GetSetting("Theme")
-	if err != nil {
-		return nil, errors.New("Failed to get Theme setting: " + err.Error())
-	}
-	th, err := loadTheme(datadir, name)
+// requiredAttributes reads the required attributes from the form, empty
+// values are reported in errs.
+func requiredAttributes(r *http.Request, errs fieldErrors) ([]requiredAttribute, error) {
+	names, err := db.GetRequiredAttributes()
 	if err != nil {
 		return nil, err
 	}
-	currentTheme.Store(th)
-	return th, nil
+	attrs := make([]requiredAttribute, 0, len(names))
+	for _, name := range names {
+		a := requiredAttribute{Name: name, Field: "attr_" + name}
+		if r.Method == http.MethodPost {
+			a.Value = strings.TrimSpace(r.FormValue(a.Field))
+			if a.Value == "" {
+				errs.add(a.Field, "required")
+			}
+		}
+		attrs = append(attrs, a)
+	}
+	return attrs, nil
 }
 
 func registerHandler(w http.ResponseWriter, r *http.Request) {
 	th := getActiveTheme()
 	switch r.Method {
 	case http.MethodGet:
-		err := th.Tpl.ExecuteTemplate(w, "register.html", nil)
+		required, err := requiredAttributes(r, nil)
 		if err != nil {
-			webError(w, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+			webError(w, r, "Failed to get required attributes: "+err.Error(), "", http.StatusInternalServerError)
+			return
+		}
+		err = th.Tpl.ExecuteTemplate(w, "register.html", registerPage{Required: required})
+		if err != nil {
+			webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
 			return
 		}
 	case http.MethodPost:
@@ -183,44 +672,62 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		p1 := r.FormValue("password")
 		p2 := r.FormValue("password2")
 
-		if username == "" || p1 == "" || p1 != p2 {
-			webError(w, "Invalid input", "", http.StatusBadRequest)
+		errs := fieldErrors{}
+		if username == "" {
+			errs.add("username", "required")
+		} else if _, err := db.GetUserByUsername(username); err == nil {
+			errs.add("username", "exists")
+		}
+		if p1 == "" {
+			errs.add("password", "required")
+		} else if p1 != p2 {
+			errs.add("password2", "mismatch")
+		}
+		required, err := requiredAttributes(r, errs)
+		if err != nil {
+			webError(w, r, "Failed to get required attributes: "+err.Error(), "User creation failed", http.StatusInternalServerError)
 			return
 		}
-
-		// already exists?
-		if _, err := db.GetUserByUsername(username); err == nil {
-			webError(w, "User already exists", "", http.StatusConflict)
+		if len(errs) > 0 {
+			if wantsJSON(r) {
+				writeValidationJSON(w, errs)
+				return
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			if err := th.Tpl.ExecuteTemplate(w, "register.html", registerPage{Username: username, Required: required, Errors: errs}); err != nil {
+				webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+			}
 			return
 		}
 
-		hash, err := bcrypt.GenerateFromPassword([]byte(p1), bcryptCost)
+		hash, err := hashPassword(r.Context(), p1)
 		if err != nil {
-			webError(w, "Error generating hash: "+err.Error(), "User creation failed", http.StatusInternalServerError)
+			webError(w, r, "Error generating hash: "+err.Error(), "User creation failed", http.StatusInternalServerError)
 			return
 		}
 
-		id, err := db.CreateUser(username, string(hash), 0)
+		attrs := make(map[string]string, len(required))
+		for _, a := range required {
+			attrs[a.Name] = a.Value
+		}
+		id, err := db.CreateUserWithAttributes(username, string(hash), 0, attrs)
+		if errors.Is(err, db.ErrDuplicate) {
+			// lost the race against a concurrent registration of the same name
+			webError(w, r, "User already exists", "", http.StatusConflict)
+			return
+		}
 		if err != nil {
-			webError(w, "Error creating user: "+err.Error(), "User creation failed", http.StatusInternalServerError)
+			webError(w, r, "Error creating user: "+err.Error(), "User creation failed", http.StatusInternalServerError)
 			return
 		}
 
 		// Session
-		sid, s, err := newSession(id)
+		sid, _, err := newSession(id)
 		if err != nil {
-			webError(w, "Creating new Session failed:"+err.Error(), "User creation failed", http.StatusInternalServerError)
+			webError(w, r, "Creating new Session failed:"+err.Error(), "User creation failed", http.StatusInternalServerError)
 			return
 		}
-		session.Set(sid, s)
-		http.SetCookie(w, &http.Cookie{
-			Name:     sessionCookieName,
-			Value:    sid,
-			Path:     "/",
-			SameSite: http.SameSiteLaxMode,
-			MaxAge:   int(24 * time.Hour / time.Second),
-			HttpOnly: true,
-		})
+		setSessionCookie(w, sid)
 
 		http.Redirect(w, r, "/me", http.StatusSeeOther)
 	default:
@@ -234,37 +741,56 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		err := th.Tpl.ExecuteTemplate(w, "login.html", nil)
 		if err != nil {
-			webError(w, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+			webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
 			return
 		}
 	case http.MethodPost:
 		username := strings.TrimSpace(r.FormValue("username"))
 		password := r.FormValue("password")
 
+		keys := loginKeys(r, username)
+		if wait, blocked := loginLimit.blocked(keys); blocked {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			webError(w, r, "Too many failed logins for "+strings.Join(keys, ", "), "Too many failed logins, try again later", http.StatusTooManyRequests)
+			return
+		}
 		u, err := db.GetUserByUsername(username)
 		if err != nil {
-			webError(w, "Error finding user:"+err.Error(), "Wrong username or password", http.StatusUnauthorized)
+			loginLimit.fail(keys)
+			webError(w, r, "Error finding user:"+err.Error(), "Wrong username or password", http.StatusUnauthorized)
 			return
 		}
-		if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)); err != nil {
-			webError(w, "Error comparing password:"+err.Error(), "Wrong username or password", http.StatusUnauthorized)
+		if err := comparePassword(r.Context(), u.Password, password); err != nil {
+			loginLimit.fail(keys)
+			webError(w, r, "Error comparing password:"+err.Error(), "Wrong username or password", http.StatusUnauthorized)
 			return
 		}
-
-		sid, s, err := newSession(u.ID)
+		ok, err := verifySecondFactor(u.ID, r.FormValue("code"))
 		if err != nil {
-			webError(w, "Error creating session:"+err.Error(), "Wrong username or password", http.StatusInternalServerError)
+			webError(w, r, "Error verifying 2FA code:"+err.Error(), "Login failed", http.StatusInternalServerError)
 			return
 		}
-		session.Set(sid, s)
+		if !ok {
+			loginLimit.fail(keys)
+			webError(w, r, "Invalid 2FA code for user "+u.Username, "Wrong or missing 2FA code", http.StatusUnauthorized)
+			return
+		}
+		loginLimit.reset(keys)
+		if cost, err := bcrypt.Cost([]byte(u.Password)); err == nil && cost != bcryptCost {
+			rehashPassword(u.ID, password)
+		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:     sessionCookieName,
-			Value:    sid,
-			Path:     "/",
-			MaxAge:   int(24 * time.Hour / time.Second),
-			HttpOnly: true,
-		})
+		sid, _, err := newSession(u.ID)
+		if err != nil {
+			webError(w, r, "Error creating session:"+err.Error(), "Wrong username or password", http.StatusInternalServerError)
+			return
+		}
+		if maxSessionsPerUser > 0 {
+			if n := session.EvictOldest(u.ID, maxSessionsPerUser); n > 0 {
+				log.Println("Evicted", n, "old sessions of user", u.ID)
+			}
+		}
+		setSessionCookie(w, sid)
 
 		http.Redirect(w, r, "/me", http.StatusSeeOther)
 	default:
@@ -272,25 +798,61 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func logoutHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+// rehashPassword stores the password with the configured cost. Failing to do
+// so is not fatal, the old hash keeps working.
+func rehashPassword(userID int, password string) {
+	hash, err := hashPassword(context.Background(), password)
+	if err != nil {
+		log.Println("Error rehashing password:", err)
+		return
+	}
+	if err := db.SetUserPassword(userID, string(hash)); err != nil {
+		log.Println("Error storing rehashed password:", err)
 		return
 	}
+	log.Println("Rehashed password of user", userID, "with cost", bcryptCost)
+}
+
+// logoutHandler ends the session. POST is always accepted, GET only with
+// AllowGetLogout and the token from User.LogoutURL, so a foreign page can't
+// log members out with a plain link.
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
 	c, err := r.Cookie(sessionCookieName)
+	if r.Method == http.MethodGet {
+		if !allowGetLogout || err != nil || !hmac.Equal([]byte(r.URL.Query().Get("token")), []byte(logoutToken(c.Value))) {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	}
 	if err == nil {
 		destroySession(c.Value)
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:   sessionCookieName,
-		Value:  "",
-		Path:   "/",
-		MaxAge: -1,
-	})
-	http.Redirect(w, r, "/login", http.StatusSeeOther)
+	clearSessionCookie(w)
+	http.Redirect(w, r, logoutRedirect, http.StatusSeeOther)
 }
 
 func profileHandler(w http.ResponseWriter, r *http.Request) {
+	renderProfile(w, r, nil, http.StatusOK)
+}
+
+// staleDeviceAfter is how long none of a member's devices may go unseen
+// before the profile shows a warning.
+var staleDeviceAfter = 72 * time.Hour
+
+func devicesStale(devices []DeviceView) bool {
+	if len(devices) == 0 || !arplib.ScannerHealthy() {
+		return false
+	}
+	cutoff := time.Now().Add(-staleDeviceAfter)
+	for _, d := range devices {
+		if !d.seenBefore(cutoff) {
+			return false
+		}
+	}
+	return true
+}
+
+func renderProfile(w http.ResponseWriter, r *http.Request, errs fieldErrors, status int) {
 	th := getActiveTheme()
 	uidVal := r.Context().Value(ctxUserID)
 	if uidVal == nil {
@@ -301,7 +863,7 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 
 	u, err := db.GetUserByID(userID)
 	if err != nil {
-		webError(w, "Failed to get user: "+err.Error(), "", http.StatusInternalServerError)
+		webError(w, r, "Failed to get user: "+err.Error(), "", http.StatusInternalServerError)
 		return
 	}
 	user := dbUserToUser(u)
@@ -309,13 +871,43 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 	getAttributes := true
 	err = user.LoadDetails(getDevices, getAttributes)
 	if err != nil {
-		webError(w, "Failed to load user details: "+err.Error(), "", http.StatusInternalServerError)
+		webError(w, r, "Failed to load user details: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if err := user.loadTwoFactorState(); err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	user.Impersonating = r.Context().Value(ctxImpersonatorID) != nil
+	user.Email, user.EmailVerified, err = db.GetUserEmail(userID)
+	if err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	user.Tags, err = db.GetUserTags(userID)
+	if err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
 		return
 	}
+	if err := user.loadShareLinks(r); err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	user.StaleDevices = devicesStale(user.Devices)
+	user.MissingAttributes, err = db.MissingRequiredAttributes(userID)
+	if err != nil {
+		webError(w, r, err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil && allowGetLogout {
+		user.LogoutURL = "/logout?token=" + logoutToken(c.Value)
+	}
+	user.Errors = errs
 
+	w.WriteHeader(status)
 	err = th.Tpl.ExecuteTemplate(w, "profile.html", user)
 	if err != nil {
-		webError(w, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+		webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
 		return
 	}
 }
@@ -323,17 +915,17 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 func setShownameHandler(w http.ResponseWriter, r *http.Request) {
 	uidVal := r.Context().Value(ctxUserID)
 	if uidVal == nil {
-		webError(w, "Not logged in", "", http.StatusUnauthorized)
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
 		return
 	}
 	userID := uidVal.(int)
 	name := strings.TrimSpace(r.FormValue("showname"))
 	if name == "" {
-		webError(w, "Showname empty", "", http.StatusBadRequest)
+		profileValidationError(w, r, fieldErrors{"showname": "required"})
 		return
 	}
 	if err := db.SetUserShowname(userID, name); err != nil {
-		webError(w, "Error setting Showname: "+err.Error(), "", http.StatusInternalServerError)
+		webError(w, r, "Error setting Showname: "+err.Error(), "", http.StatusInternalServerError)
 		return
 	}
 	http.Redirect(w, r, "/me", http.StatusSeeOther)
@@ -341,6 +933,15 @@ func setShownameHandler(w http.ResponseWriter, r *http.Request) {
 
 const saltSize = 16
 
+const maxDeviceNameLength = 64
+
+func validateDeviceName(name string) error {
+	if utf8.RuneCountInString(name) > maxDeviceNameLength {
+		return errors.New("Device name too long (max " + strconv.Itoa(maxDeviceNameLength) + " characters)")
+	}
+	return nil
+}
+
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
 
 func generateRandomSalt(n int) string {
@@ -356,104 +957,471 @@ func generateRandomSalt(n int) string {
 func addDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	uidVal := r.Context().Value(ctxUserID)
 	if uidVal == nil {
-		webError(w, "Not logged in", "", http.StatusUnauthorized)
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
 		return
 	}
 	userID := uidVal.(int)
+	errs := fieldErrors{}
 	macStr := r.FormValue("mac")
 	mac, err := net.ParseMAC(strings.TrimSpace(macStr))
 	if err != nil {
-		webError(w, "Invalid MAC address", "", http.StatusBadRequest)
+		errs.add("mac", "invalid")
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if err := validateDeviceName(name); err != nil {
+		errs.add("name", "too_long")
+	}
+	if len(errs) > 0 {
+		profileValidationError(w, r, errs)
+		return
+	}
+	if _, err := registerDevice(r, userID, mac, name); err != nil {
+		webError(w, r, "Error adding or updating device: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+// rotateSaltHandler gives a device a fresh salt. Only the salted hash of a MAC
+// is stored, so the member has to enter the MAC again; it is checked against
+// the current hash before re-hashing. Keeping a recoverable copy of the MAC
+// would allow rotating without re-entry, but would defeat the point of
+// hashing if the database leaks, so we don't.
+func rotateSaltHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	errs := fieldErrors{}
+	deviceID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		errs.add("rotate", "invalid")
+	}
+	mac, err := net.ParseMAC(strings.TrimSpace(r.FormValue("mac")))
+	if err != nil {
+		errs.add("rotate", "invalid")
+	}
+	if len(errs) > 0 {
+		profileValidationError(w, r, errs)
+		return
+	}
+	device, err := db.GetUserDevice(userID, deviceID)
+	if errors.Is(err, db.ErrNotFound) {
+		webError(w, r, "Device not found", "", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		webError(w, r, "Error loading device: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(arplib.HashMACScheme(mac, device.Salt, device.HashScheme, device.HashIterations)), []byte(device.MACAddress)) != 1 {
+		profileValidationError(w, r, fieldErrors{"rotate": "mismatch"})
 		return
 	}
 	salt := generateRandomSalt(saltSize)
-	hashedMac := arplib.HashMAC(mac, salt)
+	if err := db.UpdateDeviceHash(userID, deviceID, arplib.HashMAC(mac, salt), salt, arplib.CurrentHashScheme, arplib.HashIterations()); err != nil {
+		webError(w, r, "Error rotating device salt: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+// devicePresenceHandler sets whether a device makes its owner present.
+func devicePresenceHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	deviceID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		profileValidationError(w, r, fieldErrors{"id": "invalid"})
+		return
+	}
+	err = db.SetDeviceCountsPresence(uidVal.(int), deviceID, r.FormValue("counts") == "on")
+	if errors.Is(err, db.ErrNotFound) {
+		webError(w, r, "Device not found", "", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		webError(w, r, "Error updating device: "+err.Error(), "", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/me", http.StatusSeeOther)
+}
+
+func renameDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+	errs := fieldErrors{}
+	deviceID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		errs.add("id", "invalid")
+	}
 	name := strings.TrimSpace(r.FormValue("name"))
-	if err := db.AddOrUpdateDevice(userID, hashedMac, name, salt); err != nil { // in dblib hinzufügen
-		webError(w, "Error adding or updating device: "+err.Error(), "", http.StatusInternalServerError)
+	if err := validateDeviceName(name); err != nil {
+		errs.add("name", "too_long")
+	}
+	if len(errs) > 0 {
+		profileValidationError(w, r, errs)
+		return
+	}
+	err = db.RenameDevice(userID, deviceID, name)
+	if errors.Is(err, db.ErrNotFound) {
+		webError(w, r, "Device not found", "", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		webError(w, r, "Error renaming device: "+err.Error(), "", http.StatusInternalServerError)
 		return
 	}
 	http.Redirect(w, r, "/me", http.StatusSeeOther)
 }
 
+// clientIP returns the address of the requester, RealIP has already taken
+// care of proxy headers.
+func clientIP(r *http.Request) (netip.Addr, error) {
+	return parseRemoteAddr(r.RemoteAddr)
+}
+
+func parseRemoteAddr(addr string) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return netip.ParseAddr(host)
+}
+
+// trustedProxies are the peers whose X-Forwarded-For and X-Real-IP headers
+// name the client, from the TrustedProxies setting.
+var trustedProxies []netip.Prefix
+
+const ctxPeerAddr ctxKey = "peer"
+
+// KeepPeerAddr remembers the address of the connection's peer. It has to
+// run before middleware.RealIP, which replaces RemoteAddr with whatever the
+// proxy headers say.
+func KeepPeerAddr(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxPeerAddr, r.RemoteAddr)))
+	})
+}
+
+// peerIP returns the address of the requester for decisions that must not
+// trust a forged header. Proxy headers only count when the peer is one of
+// trustedProxies, anyone else could send them.
+func peerIP(r *http.Request) (netip.Addr, error) {
+	addr, ok := r.Context().Value(ctxPeerAddr).(string)
+	if !ok {
+		addr = r.RemoteAddr
+	}
+	peer, err := parseRemoteAddr(addr)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, p := range trustedProxies {
+		if p.Contains(peer.Unmap()) {
+			return clientIP(r)
+		}
+	}
+	return peer, nil
+}
+
+type claimPage struct {
+	Found  bool
+	MAC    string
+	OUI    string
+	Vendor string
+}
+
+// claimDeviceHandler lets a member register the device they are using right
+// now. Only the unregistered device seen on the requester's own IP is
+// offered, so nobody can claim somebody else's device. The IP comes from
+// peerIP, a spoofed X-Real-IP must not pick another member's device.
+func claimDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	th := getActiveTheme()
+	uidVal := r.Context().Value(ctxUserID)
+	if uidVal == nil {
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
+		return
+	}
+	userID := uidVal.(int)
+
+	var mac net.HardwareAddr
+	found := false
+	if ip, err := peerIP(r); err == nil {
+		mac, found = arplib.UnknownMACForIP(ip)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		page := claimPage{Found: found}
+		if found {
+			page.MAC = arplib.CanonicalMAC(mac)
+			page.OUI = arplib.OUI(mac)
+			page.Vendor = arplib.LookupVendor(mac)
+		}
+		if err := th.Tpl.ExecuteTemplate(w, "claim.html", page); err != nil {
+			webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		if !found {
+			webError(w, r, "No unregistered device seen for this address", "", http.StatusNotFound)
+			return
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		if err := validateDeviceName(name); err != nil {
+			webError(w, r, err.Error(), "", http.StatusBadRequest)
+			return
+		}
+		salt := generateRandomSalt(saltSize)
+		hashedMac := arplib.HashMAC(mac, salt)
+		created, err := db.AddOrUpdateDevice(userID, hashedMac, name, salt, arplib.CurrentHashScheme, arplib.HashIterations())
+		if err != nil {
+			webError(w, r, "Error adding device: "+err.Error(), "", http.StatusInternalServerError)
+			return
+		}
+		if created {
+			notifyNewDevice(r, userID, name, mac)
+		}
+		http.Redirect(w, r, "/me", http.StatusSeeOther)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	uidVal := r.Context().Value(ctxUserID)
 	if uidVal == nil {
-		webError(w, "Not logged in", "", http.StatusUnauthorized)
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
 		return
 	}
 	userID := uidVal.(int)
-	macStr := r.FormValue("mac")
-	mac, err := net.ParseMAC(strings.TrimSpace(macStr))
-	if err != nil {
-		webError(w, "Invalid MAC address", "", http.StatusBadRequest)
+	deviceID, err := deleteDeviceID(r, userID)
+	if err == nil && deviceID == 0 {
+		profileValidationError(w, r, fieldErrors{"id": "invalid"})
 		return
 	}
-	if err := db.DeleteDevice(userID, mac.String()); err != nil { // in dblib hinzufügen
-		webError(w, "Error deleting device: "+err.Error(), "", http.StatusInternalServerError)
+	if err == nil {
+		err = db.DeleteUserDevice(userID, deviceID)
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		webError(w, r, "Device not found", "", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		webError(w, r, "Error deleting device: "+err.Error(), "", http.StatusInternalServerError)
 		return
 	}
 	http.Redirect(w, r, "/me", http.StatusSeeOther)
 }
 
+// deleteDeviceID resolves the device a delete form refers to. The profile
+// page sends the id; a MAC in any format net.ParseMAC accepts is matched
+// against the salted hashes, since the raw MAC is never stored. It returns 0
+// for a malformed form and db.ErrNotFound for a MAC the user hasn't got.
+func deleteDeviceID(r *http.Request, userID int) (int, error) {
+	if id := r.FormValue("id"); id != "" {
+		deviceID, err := strconv.Atoi(id)
+		if err != nil || deviceID <= 0 {
+			return 0, nil
+		}
+		return deviceID, nil
+	}
+	mac, err := net.ParseMAC(strings.TrimSpace(r.FormValue("mac")))
+	if err != nil {
+		return 0, nil
+	}
+	device, found, err := findUserDevice(userID, mac)
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, db.ErrNotFound
+	}
+	return device.ID, nil
+}
+
 func setAttributeHandler(w http.ResponseWriter, r *http.Request) {
 	uidVal := r.Context().Value(ctxUserID)
 	if uidVal == nil {
-		webError(w, "Not logged in", "", http.StatusUnauthorized)
+		webError(w, r, "Not logged in", "", http.StatusUnauthorized)
 		return
 	}
 	userID := uidVal.(int)
 	key := strings.TrimSpace(r.FormValue("key"))
 	val := strings.TrimSpace(r.FormValue("value"))
 	if key == "" {
-		webError(w, "Key empty", "", http.StatusBadRequest)
+		profileValidationError(w, r, fieldErrors{"key": "required"})
+		return
+	}
+	err := db.SetUserAttribute(userID, key, val)
+	if errors.Is(err, db.ErrUnknownAttribute) {
+		// the vocabulary is managed by admins
+		profileValidationError(w, r, fieldErrors{"key": "invalid"})
 		return
 	}
-	if err := db.SetUserAttribute(userID, key, val); err != nil {
-		webError(w, "Error setting attribute: "+err.Error(), "", http.StatusInternalServerError)
+	if err != nil {
+		webError(w, r, "Error setting attribute: "+err.Error(), "", http.StatusInternalServerError)
 		return
 	}
 	http.Redirect(w, r, "/me", http.StatusSeeOther)
 }
 
+type indexPage struct {
+	Users   []User
+	Message string
+	Space   db.SpaceMeta
+	// ScanAge is how long ago the last scan succeeded, ScanStale is set once
+	// that exceeds ScanStaleAfter and the board should not be trusted.
+	ScanAge   time.Duration
+	ScanStale bool
+	// IsNight and SpaceOpen let themes switch variants without JS, e.g. a
+	// dimmed wall display at night.
+	IsNight   bool
+	SpaceOpen bool
+}
+
+// scanStaleAfter is the ScanStaleAfter setting.
+var scanStaleAfter = 20 * time.Minute
+
+// webStarted stands in for the last scan until the first one succeeded, so
+// a scanner that never works is flagged too.
+var webStarted = time.Now()
+
+// scanAge returns how old the presence data is and whether that is stale.
+func scanAge() (time.Duration, bool) {
+	last := arplib.LastScanTime()
+	if last.IsZero() {
+		last = webStarted
+	}
+	age := time.Since(last)
+	return age.Truncate(time.Minute), age > scanStaleAfter
+}
+
 func webInterfaceHandler(w http.ResponseWriter, r *http.Request) {
+	if ok, code := boardAccess(r); !ok {
+		if code == http.StatusUnauthorized {
+			http.Redirect(w, r, "/login?next="+r.URL.Path, http.StatusSeeOther)
+			return
+		}
+		webError(w, r, "Board not visible to this user", "Forbidden", code)
+		return
+	}
 	th := getActiveTheme()
 	getDevices := false
 	getAttributes := true
 	users, err := getUsers(getDevices, getAttributes)
 	if err != nil {
-		webError(w, "Failed to load users: "+err.Error(), "", http.StatusInternalServerError)
+		webError(w, r, "Failed to load users: "+err.Error(), "", http.StatusInternalServerError)
 		return
 	}
-	if err := th.Tpl.ExecuteTemplate(w, "index.html", users); err != nil {
-		webError(w, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+	msg, err := currentBoardMessage()
+	if err != nil {
+		log.Println("Failed to load board message:", err)
+	}
+	space, err := db.GetSpaceMeta()
+	if err != nil {
+		log.Println("Failed to load space meta:", err)
+	}
+	page := indexPage{Users: users, Message: msg.Message, Space: space}
+	page.ScanAge, page.ScanStale = scanAge()
+	page.IsNight = isNight(time.Now())
+	page.SpaceOpen = len(arplib.OnlineSet()) > 0
+	if err := th.Tpl.ExecuteTemplate(w, "index.html", page); err != nil {
+		webError(w, r, "Failed to render template: "+err.Error(), "", http.StatusInternalServerError)
+	}
+}
+
+// noDirFS refuses to open directories so the file servers never render
+// directory listings.
+type noDirFS struct {
+	http.FileSystem
+}
+
+func (fs noDirFS) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
 	}
+	return f, nil
 }
 
 func staticHandler(w http.ResponseWriter, r *http.Request) {
 	th := getActiveTheme()
-	fs := http.FileServer(http.Dir(th.StaticDir))
-	http.StripPrefix("/static/", fs).ServeHTTP(w, r)
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/static/")
+	if !serveFS(w, r, th.Static, name) {
+		http.NotFound(w, r)
+	}
 }
 
-var datadir string
+//go:embed favicon.ico
+var defaultFavicon []byte
 
-func getWebRouter(r *chi.Mux) {
-	_, err := reloadThemeFromDB(datadir) // initial load
-	if err != nil {
-		log.Fatal("Failed to load initial theme: ", err)
+// faviconPath is the space wide favicon from the FaviconPath setting.
+var faviconPath string
+
+const faviconMaxAge = "public, max-age=86400"
+
+// faviconHandler serves the configured favicon, falling back to the one of
+// the active theme and finally to a built-in default.
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", faviconMaxAge)
+	if faviconPath != "" {
+		if f, err := os.Open(faviconPath); err == nil {
+			defer f.Close()
+			if fi, err := f.Stat(); err == nil && !fi.IsDir() {
+				http.ServeContent(w, r, filepath.Base(faviconPath), fi.ModTime(), f)
+				return
+			}
+		}
 	}
-	hmac, err := db.GetSetting("SessionHMACKey")
-	if err != nil {
-		log.Fatal("Failed to get SessionHMACKey: ", err)
+	if serveFS(w, r, getActiveTheme().Static, "favicon.ico") {
+		return
 	}
-	if hmac != "" {
-		sessionHMACKey = []byte(hmac)
-	} else {
-		log.Fatal("No SessionHMACKey found. Please set in Database")
+	w.Header().Set("Content-Type", "image/x-icon")
+	http.ServeContent(w, r, "favicon.ico", startTime, bytes.NewReader(defaultFavicon))
+}
+
+// startTime serves as modification time of embedded files.
+var startTime = time.Now()
+
+var assetsDir string
+
+func assetsHandler(w http.ResponseWriter, r *http.Request) {
+	if assetsDir == "" {
+		http.NotFound(w, r)
+		return
 	}
-	r.Get("/favicon.ico", staticHandler)
+	fs := http.FileServer(noDirFS{http.Dir(assetsDir)})
+	http.StripPrefix("/assets/", fs).ServeHTTP(w, r)
+}
+
+var datadir string
+
+func getWebRouter(r *chi.Mux) {
+	webStarted = time.Now()
+	if err := session.Load(); err != nil {
+		log.Fatal("Failed to load sessions: ", err)
+	}
+	r.Get("/favicon.ico", faviconHandler)
 	r.Get("/static/*", staticHandler)
+	r.Get("/assets/*", assetsHandler)
 
 	// Auth Routen
 	r.Get("/register", registerHandler)
@@ -461,36 +1429,182 @@ func getWebRouter(r *chi.Mux) {
 	r.Get("/login", loginHandler)
 	r.Post("/login", loginHandler)
 	r.Post("/logout", logoutHandler)
+	r.Get("/logout", logoutHandler)
+	r.Get("/verify-email", verifyEmailHandler)
+	r.Get("/share/{token}", sharedPresenceHandler)
+	r.Get("/reset/request", requestResetHandler)
+	r.Post("/reset/request", requestResetHandler)
+	r.Get("/reset/confirm", confirmResetHandler)
+	r.Post("/reset/confirm", confirmResetHandler)
 
 	// Private Routen
 	r.Group(func(pr chi.Router) {
 		pr.Use(RequireAuth)
+		pr.Use(requireCompleteProfile)
 		pr.Get("/me", profileHandler)
 		pr.Post("/me/showname", setShownameHandler)
+		pr.Post("/me/hidden", setHiddenHandler)
 		pr.Post("/me/devices/add", addDeviceHandler)
+		pr.Post("/me/devices/rename", renameDeviceHandler)
+		pr.Post("/me/devices/rotate-salt", rotateSaltHandler)
+		pr.Post("/me/devices/presence", devicePresenceHandler)
+		pr.Get("/me/devices/claim", claimDeviceHandler)
+		pr.Post("/me/devices/claim", claimDeviceHandler)
 		pr.Post("/me/devices/delete", deleteDeviceHandler)
 		pr.Post("/me/attributes/set", setAttributeHandler)
+		pr.Post("/me/tags/add", addTagHandler)
+		pr.Post("/me/tags/remove", removeTagHandler)
+		pr.Post("/me/sharelink", createShareLinkHandler)
+		pr.Post("/me/sharelink/revoke", revokeShareLinkHandler)
+		pr.Post("/impersonate/stop", stopImpersonatingHandler)
+
+		// credentials of the target user stay out of reach for admins
+		pr.Group(func(sr chi.Router) {
+			sr.Use(denyImpersonation)
+			sr.Post("/me/email", setEmailHandler)
+			sr.Post("/me/email/resend", resendVerificationHandler)
+			sr.Post("/me/2fa/setup", twoFactorSetupHandler)
+			sr.Post("/me/2fa/enable", twoFactorEnableHandler)
+			sr.Post("/me/2fa/disable", twoFactorDisableHandler)
+			sr.Post("/me/2fa/codes", regenerateBackupCodesHandler)
+			sr.Post("/me/delete", deleteAccountHandler)
+			sr.Get("/me/tokens", tokensHandler)
+			sr.Post("/me/tokens", createTokenHandler)
+			sr.Post("/me/tokens/revoke", revokeTokenHandler)
+		})
 	})
 
-	r.Get("/", webInterfaceHandler)
+	r.With(requireCompleteProfile).Get("/", webInterfaceHandler)
+}
+
+// Admin Routen
+func adminRoutes(ar chi.Router) {
+	ar.Use(RequireAuth)
+	ar.Use(RequireAdmin)
+	ar.Get("/status", adminStatusHandler)
+	ar.Get("/unknown-devices", adminUnknownDevicesHandler)
+	ar.Get("/scans", adminScanLogHandler)
+	ar.Get("/selftest", adminSelfTestHandler)
+	ar.Get("/themes", adminThemesHandler)
+	ar.Post("/devices/rehash", adminRehashHandler)
+	ar.Post("/oui/reload", adminReloadOUIHandler)
+	ar.Get("/settings", adminSettingsHandler)
+	ar.Post("/settings", adminSetSettingsHandler)
+	ar.Get("/attributes", adminAttributesHandler)
+	ar.Post("/attributes", adminCreateAttributeHandler)
+	ar.Post("/attributes/required", adminSetAttributeRequiredHandler)
+	ar.Get("/space", adminSpaceHandler)
+	ar.Post("/space", adminSetSpaceHandler)
+	ar.Get("/board-message", boardMessageHandler)
+	ar.Post("/board-message", setBoardMessageHandler)
+	ar.Get("/users", adminUsersHandler)
+	ar.Post("/users", adminCreateUserHandler)
+	ar.Post("/users/{id}/password", adminResetPasswordHandler)
+	ar.Post("/users/{id}/delete", adminDeleteUserHandler)
+	ar.Delete("/users/{id}", adminDeleteUserHandler)
+	ar.Post("/users/{id}/impersonate", impersonateHandler)
 }
 
-func GetRouter(r *chi.Mux, dir string) {
+var csrfKey []byte
+
+func useSessionAndCSRF(r *chi.Mux) {
 	r.Use(SessionMiddleware)
-	datadir = dir
-	csrfKeySetting, err := db.GetSetting("CSRFKey")
+	r.Use(apiTokenMiddleware)
+	r.Use(csrf.Protect(
+		csrfKey,
+	))
+}
+
+// configure applies the web settings, config.Load has validated them
+// already.
+func configure(c *config.Config) {
+	w := c.Web
+	datadir = c.DataPath
+	th, err := loadTheme(datadir, w.Theme)
 	if err != nil {
-		log.Fatal("Failed to get CSRFKey: ", err)
+		log.Fatal("Failed to load initial theme: ", err)
+	}
+	currentTheme.Store(th)
+
+	sessionHMACKey = w.SessionHMACKey
+	csrfKey = w.CSRFKey
+	assetsDir = w.AssetsDir
+	faviconPath = w.FaviconPath
+	bcryptCost = w.BcryptCost
+	setBcryptConcurrency(w.BcryptConcurrency)
+	staleDeviceAfter = w.StaleDeviceWarning
+	scanStaleAfter = w.ScanStaleAfter
+
+	secureCookies = w.SecureCookies
+	cookieSameSite = w.CookieSameSite
+	sessionLifetime = w.SessionLifetime
+	clockLeeway = w.ClockSkewLeeway
+	inactivityTimeout = w.InactivityTimeout
+	sessionSweepInterval = w.SessionSweepInterval
+	maxSessionsPerUser = w.MaxSessionsPerUser
+	logoutRedirect = w.LogoutRedirect
+	trustedProxies = w.TrustedProxies
+	allowGetLogout = w.AllowGetLogout
+	loginLimit.configure(w.LoginMaxFailures, w.LoginFailureWindow)
+	eventStreamSlots = make(chan struct{}, w.MaxEventStreams)
+
+	spaceAPIRooms = w.SpaceAPIRooms
+	nightStart = w.NightStart
+	nightEnd = w.NightEnd
+	shownamePolicy = w.ShownamePolicy
+	boardVisibility = w.BoardVisibility
+
+	mailer = mailConfig{
+		Host:     w.SMTPHost,
+		Port:     w.SMTPPort,
+		User:     w.SMTPUser,
+		Password: w.SMTPPassword,
+		From:     w.SMTPFrom,
 	}
-	if csrfKeySetting == "" {
-		log.Fatal("No CSRFKey found. Please set in Database")
+	if mailer.Host == "" {
+		log.Println("No SMTPHost configured, mails will only be logged")
 	}
-	csrfKey := []byte(csrfKeySetting)
+	baseURLSetting = w.BaseURL
+	metricsEnabled = w.Metrics
+}
 
-	r.Use(csrf.Protect(
-		csrfKey,
-	))
+// GetRouter sets up the public board, API and member routes. The admin
+// routes are included unless withAdmin is false because they are served by
+// GetAdminRouter on a separate listener, /metrics likewise. /healthz, /readyz
+// and /metrics sit in front of the session and CSRF middleware so probes and
+// scrapers don't need either. The web settings of c are applied first.
+func GetRouter(r *chi.Mux, c *config.Config, withAdmin bool) {
+	configure(c)
+	r.Get("/healthz", healthzHandler)
+	r.Get("/readyz", readyzHandler)
+	if withAdmin && metricsEnabled {
+		r.Handle("/metrics", metricsHandler())
+	}
+
+	app := chi.NewRouter()
+	useSessionAndCSRF(app)
+	getAPIRouter(app)
+	getWebRouter(app)
+	if withAdmin {
+		app.Route("/admin", adminRoutes)
+	}
+	r.Mount("/", app)
+}
 
-	getAPIRouter(r)
-	getWebRouter(r)
+// GetAdminRouter sets up the routes for the admin listener: /admin, the
+// pprof handlers under /debug/pprof, both for admins only, and /metrics if
+// enabled. These are only available here, so keep the admin listener off the
+// public network. Call it after GetRouter.
+func GetAdminRouter(r *chi.Mux) {
+	if metricsEnabled {
+		r.Handle("/metrics", metricsHandler())
+	}
+	useSessionAndCSRF(r)
+	r.Route("/admin", adminRoutes)
+	r.Group(func(dr chi.Router) {
+		// heap and goroutine dumps are for admins only, like /admin
+		dr.Use(RequireAuth)
+		dr.Use(RequireAdmin)
+		dr.Mount("/debug", middleware.Profiler())
+	})
 }
@@ -0,0 +1,279 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	db "github.com/Nerdberg/fahrmarke/dblib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func postForm(h http.HandlerFunc, form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+// serveAs runs the handler as the given user, 0 for anonymous, without going
+// through the session middleware.
+func serveAs(h http.HandlerFunc, req *http.Request, userID int) *httptest.ResponseRecorder {
+	if userID != 0 {
+		req = req.WithContext(context.WithValue(req.Context(), ctxUserID, userID))
+	}
+	w := httptest.NewRecorder()
+	h(w, req)
+	return w
+}
+
+func TestConcurrentRegistration(t *testing.T) {
+	form := url.Values{"username": {"racer"}, "password": {"pw"}, "password2": {"pw"}}
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = postForm(registerHandler, form).Code
+		}()
+	}
+	wg.Wait()
+	u, err := db.GetUserByUsername("racer")
+	if err != nil {
+		t.Fatal("user not created:", err)
+	}
+	t.Cleanup(func() { db.DeleteUser(u.ID) })
+
+	var created, rejected int
+	for _, code := range codes {
+		switch code {
+		case http.StatusSeeOther:
+			created++
+		case http.StatusConflict, http.StatusBadRequest:
+			// the loser either hit the unique constraint or already saw
+			// the user in the existence check
+			rejected++
+		}
+	}
+	if created != 1 || rejected != 1 {
+		t.Errorf("got status codes %v, want one redirect and one rejection", codes)
+	}
+}
+
+func TestLoginRehashesOnCostChange(t *testing.T) {
+	createTestUser(t, "oldhash", false)
+	orig := bcryptCost
+	bcryptCost = orig + 1
+	t.Cleanup(func() { bcryptCost = orig })
+
+	w := postForm(loginHandler, url.Values{"username": {"oldhash"}, "password": {"secret"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusSeeOther)
+	}
+	u, err := db.GetUserByUsername("oldhash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, err := bcrypt.Cost([]byte(u.Password)); err != nil || cost != bcryptCost {
+		t.Errorf("stored hash has cost %d, want %d", cost, bcryptCost)
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte("secret")); err != nil {
+		t.Error("rehashed password does not match:", err)
+	}
+}
+
+func TestPresenceEventsHideHiddenUsers(t *testing.T) {
+	visible := createTestUser(t, "visible", false)
+	hidden := createTestUser(t, "hidden", false)
+	admin := createTestUser(t, "eventadmin", true)
+	if err := db.SetUserHidden(hidden, true); err != nil {
+		t.Fatal(err)
+	}
+	since, err := db.GetPresenceEventsHighWater()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AddPresenceEvents([]db.PresenceEvent{
+		{UserID: visible, Online: true, TS: 1},
+		{UserID: hidden, Online: true, TS: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		userID int
+		want   int
+	}{
+		{"anonymous", 0, 1},
+		{"other member", visible, 1},
+		{"hidden member", hidden, 2},
+		{"admin", admin, 2},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/events/since?since="+strconv.FormatInt(since, 10), nil)
+		w := serveAs(getPresenceEventsHandler, req, tc.userID)
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got Content-Type %q", tc.name, ct)
+		}
+		var resp presenceEventsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Events) != tc.want {
+			t.Errorf("%s: got %d events, want %d", tc.name, len(resp.Events), tc.want)
+		}
+	}
+}
+
+func TestPresenceBatchUsesListedIDs(t *testing.T) {
+	here := createTestUser(t, "batchhere", false)
+	createTestUser(t, "batchgone", false)
+	addTestDevice(t, here, "02:00:00:00:12:37")
+	scanOnce(t, "02:00:00:00:12:37")
+
+	w := serveAs(getUsersHandler, httptest.NewRequest(http.MethodGet, "/api/users", nil), 0)
+	var users []struct {
+		ID     int    `json:"id"`
+		Name   string `json:"name"`
+		Online bool   `json:"online"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&users); err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, u := range users {
+		if u.ID == 0 {
+			t.Fatalf("user %q listed without id", u.Name)
+		}
+		ids = append(ids, u.ID)
+	}
+	body, _ := json.Marshal(ids)
+	req := httptest.NewRequest(http.MethodPost, "/api/presence/batch", strings.NewReader(string(body)))
+	w = serveAs(presenceBatchHandler, req, 0)
+	var presence map[string]*bool
+	if err := json.NewDecoder(w.Body).Decode(&presence); err != nil {
+		t.Fatal(err)
+	}
+	if len(presence) != len(users) {
+		t.Fatalf("got %d entries for %d users", len(presence), len(users))
+	}
+	for _, u := range users {
+		online := presence[strconv.Itoa(u.ID)]
+		if online == nil || *online != u.Online {
+			t.Errorf("user %q: batch says %v, /api/users says %v", u.Name, online, u.Online)
+		}
+		if u.ID == here && !u.Online {
+			t.Errorf("user %q should be online", u.Name)
+		}
+	}
+}
+
+func TestConfiguredBcryptCost(t *testing.T) {
+	// seeded with the old cost before the setting changes
+	createTestUser(t, "oldcost", false)
+	orig := bcryptCost
+	bcryptCost = bcrypt.MinCost + 1
+	t.Cleanup(func() { bcryptCost = orig })
+	storedCost := func(username string) int {
+		t.Helper()
+		u, err := db.GetUserByUsername(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cost, err := bcrypt.Cost([]byte(u.Password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cost
+	}
+
+	w := postForm(registerHandler, url.Values{"username": {"newcost"}, "password": {"pw"}, "password2": {"pw"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("register: got status %d", w.Code)
+	}
+	if u, err := db.GetUserByUsername("newcost"); err == nil {
+		t.Cleanup(func() { db.DeleteUser(u.ID) })
+	}
+	if cost := storedCost("newcost"); cost != bcryptCost {
+		t.Errorf("registered with cost %d, want %d", cost, bcryptCost)
+	}
+
+	if cost := storedCost("oldcost"); cost != orig {
+		t.Fatalf("seeded hash has cost %d, want %d", cost, orig)
+	}
+	if w := postForm(loginHandler, url.Values{"username": {"oldcost"}, "password": {"secret"}}); w.Code != http.StatusSeeOther {
+		t.Fatalf("login: got status %d", w.Code)
+	}
+	if cost := storedCost("oldcost"); cost != bcryptCost {
+		t.Errorf("old hash not upgraded, has cost %d", cost)
+	}
+}
+
+func TestUsersPaging(t *testing.T) {
+	for _, name := range []string{"pagea", "pageb", "pagec"} {
+		createTestUser(t, name, false)
+	}
+	fetch := func(query string) usersPage {
+		t.Helper()
+		w := serveAs(getUsersHandler, httptest.NewRequest(http.MethodGet, "/api/users?"+query, nil), 0)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d", query, w.Code)
+		}
+		var page usersPage
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+	w := serveAs(getUsersHandler, httptest.NewRequest(http.MethodGet, "/api/users", nil), 0)
+	var all []User
+	if err := json.NewDecoder(w.Body).Decode(&all); err != nil {
+		t.Fatal(err)
+	}
+
+	var byCursor, byOffset []string
+	for after := 0; ; {
+		page := fetch("limit=2&after=" + strconv.Itoa(after))
+		if page.NextOffset != 0 {
+			t.Error("after mode returned next_offset")
+		}
+		for _, u := range page.Users {
+			byCursor = append(byCursor, u.Name)
+		}
+		if after = page.NextCursor; after == 0 {
+			break
+		}
+	}
+	for offset := 0; ; {
+		page := fetch("limit=2&offset=" + strconv.Itoa(offset))
+		if page.NextCursor != 0 {
+			t.Error("offset mode returned next_cursor")
+		}
+		for _, u := range page.Users {
+			byOffset = append(byOffset, u.Name)
+		}
+		if offset = page.NextOffset; offset == 0 {
+			break
+		}
+	}
+	var names []string
+	for _, u := range all {
+		names = append(names, u.Name)
+	}
+	if strings.Join(byCursor, ",") != strings.Join(names, ",") || strings.Join(byOffset, ",") != strings.Join(names, ",") {
+		t.Errorf("got %v by cursor and %v by offset, want %v", byCursor, byOffset, names)
+	}
+}
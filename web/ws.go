@@ -0,0 +1,115 @@
+package web
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/Nerdberg/fahrmarke/arplib"
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// socketMessage is what /api/ws sends: a "snapshot" with every visible user
+// on connect, then an "update" with the users whose presence changed. Users
+// have the /api/users shape.
+type socketMessage struct {
+	Type  string `json:"type"`
+	Users []User `json:"users"`
+}
+
+const (
+	socketPingInterval = 30 * time.Second
+	socketWriteTimeout = 10 * time.Second
+)
+
+// presenceSocketHandler is the WebSocket variant of presenceStreamHandler.
+// Messages from the client are not expected, only control frames are read.
+func presenceSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if !acquireStream() {
+		apierror(w, r, "Too many event streams, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer releaseStream()
+	changes, cancel := arplib.Subscribe()
+	defer cancel()
+
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		log.Println("WebSocket upgrade failed:", err)
+		return
+	}
+	defer conn.CloseNow()
+	ctx := conn.CloseRead(r.Context())
+
+	users, err := getUsers(false, true)
+	if err != nil {
+		log.Println("Failed to load users for WebSocket snapshot:", err)
+		conn.Close(websocket.StatusInternalError, "failed to load users")
+		return
+	}
+	if users == nil {
+		users = []User{}
+	}
+	if err := writeSocket(ctx, conn, socketMessage{Type: "snapshot", Users: users}); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(socketPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-streamsDone:
+			conn.Close(websocket.StatusGoingAway, "server shutting down")
+			return
+		case c := <-changes:
+			users, err := changedUsers(c)
+			if err != nil {
+				log.Println("Failed to load changed users:", err)
+				continue
+			}
+			if len(users) == 0 {
+				continue
+			}
+			if err := writeSocket(ctx, conn, socketMessage{Type: "update", Users: users}); err != nil {
+				return
+			}
+		case <-ping.C:
+			pctx, done := context.WithTimeout(ctx, socketWriteTimeout)
+			err := conn.Ping(pctx)
+			done()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeSocket(ctx context.Context, conn *websocket.Conn, msg socketMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, socketWriteTimeout)
+	defer cancel()
+	return wsjson.Write(ctx, conn, msg)
+}
+
+// changedUsers returns the visible users named in c with their current
+// presence.
+func changedUsers(c arplib.Change) ([]User, error) {
+	ids := make(map[int]bool, len(c.Online)+len(c.Offline))
+	for _, id := range append(c.Online, c.Offline...) {
+		ids[id] = true
+	}
+	users, err := getUsers(false, true)
+	if err != nil {
+		return nil, err
+	}
+	var changed []User
+	for _, u := range users {
+		if ids[u.ID] {
+			changed = append(changed, u)
+		}
+	}
+	return changed, nil
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+func TestPresenceSocket(t *testing.T) {
+	userID := createTestUser(t, "socket", false)
+	addTestDevice(t, userID, "02:00:00:00:12:75")
+
+	srv := httptest.NewServer(http.HandlerFunc(presenceSocketHandler))
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+
+	var msg socketMessage
+	if err := wsjson.Read(ctx, conn, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "snapshot" {
+		t.Fatalf("got %q first, want the snapshot", msg.Type)
+	}
+	found := false
+	for _, u := range msg.Users {
+		if u.ID == userID {
+			found = true
+			if u.Online {
+				t.Error("user online in the snapshot before any scan")
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("user %d missing from the snapshot %+v", userID, msg.Users)
+	}
+
+	scanOnce(t, "02:00:00:00:12:75")
+	if err := wsjson.Read(ctx, conn, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "update" || len(msg.Users) != 1 || msg.Users[0].ID != userID || !msg.Users[0].Online {
+		t.Errorf("got %+v, want an update with user %d online", msg, userID)
+	}
+	conn.Close(websocket.StatusNormalClosure, "")
+}